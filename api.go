@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -213,6 +214,12 @@ func (e *ErrDownloadFiles) Error() string {
 }
 
 func DownloadDir(ctx context.Context, sess Session, remoteDir string, localDir string, deleteAfter func(remote, local string) bool, okFiles *[]File) error {
+	return DownloadDirConfined(ctx, sess, remoteDir, localDir, ConfineNone, deleteAfter, okFiles)
+}
+
+// DownloadDirConfined 和 DownloadDir 一样，但是按 mode 检查远程列表中的文件名， 不会写到 localDir 之外
+// (包括通过本地的符号链接)
+func DownloadDirConfined(ctx context.Context, sess Session, remoteDir string, localDir string, mode ConfineMode, deleteAfter func(remote, local string) bool, okFiles *[]File) error {
 	fis, err := sess.List(remoteDir)
 	if err != nil {
 		return errors.Wrap(err, "枚举远程目录失败")
@@ -222,14 +229,21 @@ func DownloadDir(ctx context.Context, sess Session, remoteDir string, localDir s
 	var errorList []error
 
 	for _, fi := range fis {
-		filename := filepath.Join(localDir, fi.Name())
 		remoteFile := fi.Name()
 		if remoteDir != "" {
 			remoteFile = filepath.Join(remoteDir, remoteFile)
 		}
 
+		// 远程列表中的文件名不可信，如 "../../etc/cron.d/x"
+		filename, err := confineLocalPath(localDir, fi.Name(), mode, true)
+		if err != nil {
+			filenames = append(filenames, remoteFile)
+			errorList = append(errorList, err)
+			continue
+		}
+
 		if fi.IsDir() {
-			err = DownloadDir(ctx, sess, remoteFile, filename, deleteAfter, okFiles)
+			err = DownloadDirConfined(ctx, sess, remoteFile, filename, mode, deleteAfter, okFiles)
 			if err != nil {
 				if e, ok := err.(*ErrDownloadFiles); ok {
 					filenames = append(filenames, e.Filenames...)
@@ -280,3 +294,86 @@ func DownloadDir(ctx context.Context, sess Session, remoteDir string, localDir s
 	}
 	return nil
 }
+
+// CopyFile 将 src 中的文件复制到 dst 中
+func CopyFile(ctx context.Context, src Session, srcPath string, dst Session, dstPath string) (int64, error) {
+	// 同一个数据库中的文件直接在数据库中复制
+	if src == dst {
+		if copyer, ok := src.(interface {
+			Copy(from, to string) (int64, error)
+		}); ok {
+			return copyer.Copy(srcPath, dstPath)
+		}
+	}
+
+	// open source file
+	srcFile, err := src.Read(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	// create destination file
+	dstFile, err := dst.Write(dstPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+
+	// copy source file to destination file
+	bytes, err := io.Copy(dstFile, srcFile)
+	if err != nil {
+		return bytes, err
+	}
+
+	return bytes, dstFile.Close()
+}
+
+// CopyDir 将 src 中的目录复制到 dst 中，okFiles 中的 Local 为源路径， Remote 为目标路径
+func CopyDir(ctx context.Context, src Session, srcDir string, dst Session, dstDir string, okFiles *[]File) error {
+	fis, err := src.List(srcDir)
+	if err != nil {
+		return errors.Wrap(err, "枚举源目录失败")
+	}
+
+	var filenames []string
+	var errorList []error
+
+	for _, fi := range fis {
+		srcFile := path.Join(srcDir, fi.Name())
+		dstFile := path.Join(dstDir, fi.Name())
+
+		if fi.IsDir() {
+			err = CopyDir(ctx, src, srcFile, dst, dstFile, okFiles)
+			if err != nil {
+				if e, ok := err.(*ErrDownloadFiles); ok {
+					filenames = append(filenames, e.Filenames...)
+					errorList = append(errorList, e.ErrorList...)
+				} else {
+					filenames = append(filenames, srcFile)
+					errorList = append(errorList, err)
+				}
+			}
+			continue
+		}
+
+		_, err = CopyFile(ctx, src, srcFile, dst, dstFile)
+		if err != nil {
+			filenames = append(filenames, srcFile)
+			errorList = append(errorList, err)
+			continue
+		}
+		*okFiles = append(*okFiles, File{
+			Local:  srcFile,
+			Remote: dstFile,
+		})
+	}
+
+	if len(filenames) != 0 {
+		return &ErrDownloadFiles{
+			Filenames: filenames,
+			ErrorList: errorList,
+		}
+	}
+	return nil
+}
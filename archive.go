@@ -0,0 +1,611 @@
+package scopy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrArchiveUnsupported = errors.New("scopy: operation is unsupported by archive")
+	ErrArchiveReadOnly    = errors.New("scopy: archive is opened for reading")
+	ErrArchiveWriteOnly   = errors.New("scopy: archive is opened for writing")
+	ErrArchiveEntryBusy   = errors.New("scopy: previous archive entry is not closed")
+)
+
+// ArchiveWriteMode 根据 mode 和文件是否存在来判断以读还是写的方式打开归档文件,
+// mode 为 "write"/"w" 时为写, 为 "read"/"r" 时为读, 为空时文件不存在则为写
+func ArchiveWriteMode(filename, mode string) bool {
+	switch strings.ToLower(mode) {
+	case "write", "w":
+		return true
+	case "read", "r":
+		return false
+	}
+	_, err := os.Stat(filename)
+	return os.IsNotExist(err)
+}
+
+func cleanArchivePath(pa string) string {
+	pa = strings.Trim(path.Clean("/"+strings.Replace(pa, "\\", "/", -1)), "/")
+	return pa
+}
+
+type archiveEntry struct {
+	name    string
+	isDir   bool
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (e *archiveEntry) Name() string       { return e.name }
+func (e *archiveEntry) IsDir() bool        { return e.isDir }
+func (e *archiveEntry) Size() int64        { return e.size }
+func (e *archiveEntry) ModTime() time.Time { return e.modTime }
+func (e *archiveEntry) Sys() interface{}   { return nil }
+func (e *archiveEntry) Mode() fs.FileMode {
+	if e.isDir {
+		return fs.ModeDir | (e.mode & fs.ModePerm)
+	}
+	return e.mode & fs.ModePerm
+}
+
+// archiveIndex 记录归档中的所有条目，key 为清理后的全路径
+type archiveIndex struct {
+	mu      sync.RWMutex
+	entries map[string]*archiveEntry
+}
+
+func (idx *archiveIndex) add(fullname string, isDir bool, size int64, mode fs.FileMode, modTime time.Time) {
+	fullname = cleanArchivePath(fullname)
+	if fullname == "" {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.entries == nil {
+		idx.entries = map[string]*archiveEntry{}
+	}
+	idx.entries[fullname] = &archiveEntry{
+		name:    path.Base(fullname),
+		isDir:   isDir,
+		size:    size,
+		mode:    mode,
+		modTime: modTime,
+	}
+
+	// 有些归档中没有目录条目，这里补上
+	for dir := path.Dir(fullname); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := idx.entries[dir]; ok {
+			break
+		}
+		idx.entries[dir] = &archiveEntry{
+			name:    path.Base(dir),
+			isDir:   true,
+			mode:    0755,
+			modTime: modTime,
+		}
+	}
+}
+
+func (idx *archiveIndex) get(fullname string) *archiveEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.entries[cleanArchivePath(fullname)]
+}
+
+func (idx *archiveIndex) list(dir string) ([]fs.FileInfo, error) {
+	dir = cleanArchivePath(dir)
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if dir != "" {
+		e := idx.entries[dir]
+		if e == nil {
+			return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+		}
+		if !e.isDir {
+			return nil, &fs.PathError{Op: "list", Path: dir, Err: errors.New("not a directory")}
+		}
+	}
+
+	var list []fs.FileInfo
+	for fullname, e := range idx.entries {
+		parent := path.Dir(fullname)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Name() < list[b].Name()
+	})
+	return list, nil
+}
+
+// Zip 打开一个 zip 文件作为 Session, write 为 true 时新建 zip 文件，
+// 写入的内容在 Close 时才会完整
+func Zip(filename string, write bool) (*zipTarget, error) {
+	if write {
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &zipTarget{
+			file: f,
+			w:    zip.NewWriter(f),
+		}, nil
+	}
+
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	target := &zipTarget{
+		r:     r,
+		files: map[string]*zip.File{},
+	}
+	for _, f := range r.File {
+		name := cleanArchivePath(f.Name)
+		if name == "" {
+			continue
+		}
+		isDir := f.FileInfo().IsDir()
+		target.index.add(name, isDir, int64(f.UncompressedSize64), f.Mode(), f.Modified)
+		if !isDir {
+			target.files[name] = f
+		}
+	}
+	return target, nil
+}
+
+type zipTarget struct {
+	index archiveIndex
+
+	r     *zip.ReadCloser
+	files map[string]*zip.File
+
+	file    *os.File
+	mu      sync.Mutex
+	w       *zip.Writer
+	writing *zipEntryWriter
+}
+
+func (st *zipTarget) Close() error {
+	if st.r != nil {
+		return st.r.Close()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.w == nil {
+		return nil
+	}
+	err := st.w.Close()
+	st.w = nil
+	return joinError(err, st.file.Close())
+}
+
+func (st *zipTarget) List(remotePath string) ([]fs.FileInfo, error) {
+	return st.index.list(remotePath)
+}
+
+func (st *zipTarget) Exists(pa string) (bool, error) {
+	return st.index.get(pa) != nil, nil
+}
+
+func (st *zipTarget) Read(remotePath string) (io.ReadCloser, error) {
+	if st.r == nil {
+		return nil, ErrArchiveWriteOnly
+	}
+	f := st.files[cleanArchivePath(remotePath)]
+	if f == nil {
+		return nil, &fs.PathError{Op: "open", Path: remotePath, Err: fs.ErrNotExist}
+	}
+	return f.Open()
+}
+
+type zipEntryWriter struct {
+	st   *zipTarget
+	name string
+	w    io.Writer
+	size int64
+	done bool
+}
+
+func (w *zipEntryWriter) Write(data []byte) (int, error) {
+	if w.done {
+		return 0, fs.ErrClosed
+	}
+	n, err := w.w.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *zipEntryWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.st.mu.Lock()
+	defer w.st.mu.Unlock()
+	if w.st.writing == w {
+		w.st.writing = nil
+	}
+	w.st.index.add(w.name, false, w.size, 0644, time.Now())
+	return nil
+}
+
+// Write 每次只能有一个条目处于写状态，前一个条目必须先 Close
+func (st *zipTarget) Write(remotePath string) (io.WriteCloser, error) {
+	if st.w == nil {
+		if st.r != nil {
+			return nil, ErrArchiveReadOnly
+		}
+		return nil, fs.ErrClosed
+	}
+	name := cleanArchivePath(remotePath)
+	if name == "" {
+		return nil, &fs.PathError{Op: "write", Path: remotePath, Err: fs.ErrInvalid}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.writing != nil {
+		return nil, ErrArchiveEntryBusy
+	}
+
+	w, err := st.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.writing = &zipEntryWriter{
+		st:   st,
+		name: name,
+		w:    w,
+	}
+	return st.writing, nil
+}
+
+func (st *zipTarget) WriteFile(remotePath string, data []byte) error {
+	w, err := st.Write(remotePath)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return joinError(err, w.Close())
+}
+
+func (st *zipTarget) Rename(from, to string) error {
+	return ErrArchiveUnsupported
+}
+
+func (st *zipTarget) Delete(pa string) error {
+	return ErrArchiveUnsupported
+}
+
+func isGzipName(filename string) bool {
+	lower := strings.ToLower(filename)
+	return strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+// Tar 打开一个 tar 文件作为 Session，文件名以 .gz 或 .tgz 结尾时使用 gzip 压缩,
+// write 为 true 时新建 tar 文件，写入的内容在 Close 时才会完整
+func Tar(filename string, write bool) (*tarTarget, error) {
+	compressed := isGzipName(filename)
+
+	if write {
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		target := &tarTarget{
+			filename:   filename,
+			compressed: compressed,
+			file:       f,
+		}
+		if compressed {
+			target.gz = gzip.NewWriter(f)
+			target.w = tar.NewWriter(target.gz)
+		} else {
+			target.w = tar.NewWriter(f)
+		}
+		return target, nil
+	}
+
+	target := &tarTarget{
+		filename:   filename,
+		compressed: compressed,
+		offsets:    map[string]int64{},
+	}
+	err := target.scan(func(name string, hdr *tar.Header, offset int64, r io.Reader) (bool, error) {
+		isDir := hdr.Typeflag == tar.TypeDir
+		if !isDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return false, nil
+		}
+		target.index.add(name, isDir, hdr.Size, hdr.FileInfo().Mode(), hdr.ModTime)
+		if !isDir && offset >= 0 {
+			target.offsets[name] = offset
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+type tarTarget struct {
+	index      archiveIndex
+	filename   string
+	compressed bool
+
+	// offsets 为未压缩 tar 中各个文件数据的起始位置，可以直接读取
+	offsets map[string]int64
+
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	w    *tar.Writer
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// scan 从头遍历归档，fn 返回 true 时停止遍历，此时文件不会被关闭，由 fn 负责
+func (st *tarTarget) scan(fn func(name string, hdr *tar.Header, offset int64, r io.Reader) (bool, error)) error {
+	f, err := os.Open(st.filename)
+	if err != nil {
+		return err
+	}
+	closeFile := true
+	defer func() {
+		if closeFile {
+			f.Close()
+		}
+	}()
+
+	var counter *countingReader
+	var tr *tar.Reader
+	if st.compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		tr = tar.NewReader(gz)
+	} else {
+		// archive/tar 按块读取且不做预读，所以读完头后的位置就是数据的起始位置
+		counter = &countingReader{r: f}
+		tr = tar.NewReader(counter)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		name := cleanArchivePath(hdr.Name)
+		if name == "" {
+			continue
+		}
+
+		offset := int64(-1)
+		if counter != nil && hdr.Typeflag != tar.TypeGNUSparse {
+			offset = counter.n
+		}
+		stop, err := fn(name, hdr, offset, &fileReadCloser{Reader: tr, f: f})
+		if err != nil {
+			return err
+		}
+		if stop {
+			closeFile = false
+			return nil
+		}
+	}
+}
+
+type fileReadCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *fileReadCloser) Close() error {
+	return r.f.Close()
+}
+
+func (st *tarTarget) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.w == nil {
+		return nil
+	}
+	err := st.w.Close()
+	st.w = nil
+	if st.gz != nil {
+		err = joinError(err, st.gz.Close())
+	}
+	return joinError(err, st.file.Close())
+}
+
+func (st *tarTarget) List(remotePath string) ([]fs.FileInfo, error) {
+	return st.index.list(remotePath)
+}
+
+func (st *tarTarget) Exists(pa string) (bool, error) {
+	return st.index.get(pa) != nil, nil
+}
+
+// Read 对于未压缩的 tar 直接定位到数据位置，对于压缩的 tar 需要从头遍历
+func (st *tarTarget) Read(remotePath string) (io.ReadCloser, error) {
+	if st.offsets == nil {
+		return nil, ErrArchiveWriteOnly
+	}
+
+	name := cleanArchivePath(remotePath)
+	e := st.index.get(name)
+	if e == nil || e.isDir {
+		return nil, &fs.PathError{Op: "open", Path: remotePath, Err: fs.ErrNotExist}
+	}
+
+	if offset, ok := st.offsets[name]; ok {
+		f, err := os.Open(st.filename)
+		if err != nil {
+			return nil, err
+		}
+		return &fileReadCloser{
+			Reader: io.NewSectionReader(f, offset, e.size),
+			f:      f,
+		}, nil
+	}
+
+	var result io.ReadCloser
+	err := st.scan(func(entryName string, hdr *tar.Header, offset int64, r io.Reader) (bool, error) {
+		if entryName != name || hdr.Typeflag == tar.TypeDir {
+			return false, nil
+		}
+		result = r.(io.ReadCloser)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, &fs.PathError{Op: "open", Path: remotePath, Err: fs.ErrNotExist}
+	}
+	return result, nil
+}
+
+func (st *tarTarget) writeEntry(name string, size int64, r io.Reader) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.w == nil {
+		return fs.ErrClosed
+	}
+
+	now := time.Now()
+	err := st.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  now,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(st.w, r); err != nil {
+		return err
+	}
+	st.index.add(name, false, size, 0644, now)
+	return nil
+}
+
+// tarEntryWriter 因为 tar 头中需要文件大小，所以数据会先写到临时文件中，在 Close 时写入归档
+type tarEntryWriter struct {
+	st   *tarTarget
+	name string
+	tmp  *os.File
+	size int64
+	done bool
+}
+
+func (w *tarEntryWriter) Write(data []byte) (int, error) {
+	if w.done {
+		return 0, fs.ErrClosed
+	}
+	if w.tmp == nil {
+		tmp, err := ioutil.TempFile("", "scopy_tar")
+		if err != nil {
+			return 0, err
+		}
+		w.tmp = tmp
+	}
+	n, err := w.tmp.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *tarEntryWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.tmp == nil {
+		return w.st.writeEntry(w.name, 0, bytes.NewReader(nil))
+	}
+	defer func() {
+		w.tmp.Close()
+		os.Remove(w.tmp.Name())
+	}()
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.st.writeEntry(w.name, w.size, w.tmp)
+}
+
+func (st *tarTarget) Write(remotePath string) (io.WriteCloser, error) {
+	if st.offsets != nil {
+		return nil, ErrArchiveReadOnly
+	}
+	name := cleanArchivePath(remotePath)
+	if name == "" {
+		return nil, &fs.PathError{Op: "write", Path: remotePath, Err: fs.ErrInvalid}
+	}
+	return &tarEntryWriter{
+		st:   st,
+		name: name,
+	}, nil
+}
+
+func (st *tarTarget) WriteFile(remotePath string, data []byte) error {
+	if st.offsets != nil {
+		return ErrArchiveReadOnly
+	}
+	name := cleanArchivePath(remotePath)
+	if name == "" {
+		return &fs.PathError{Op: "write", Path: remotePath, Err: fs.ErrInvalid}
+	}
+	return st.writeEntry(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (st *tarTarget) Rename(from, to string) error {
+	return ErrArchiveUnsupported
+}
+
+func (st *tarTarget) Delete(pa string) error {
+	return ErrArchiveUnsupported
+}
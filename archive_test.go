@@ -0,0 +1,161 @@
+package scopy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	for _, name := range []string{"a.zip", "a.tar", "a.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			testArchive(t, name)
+		})
+	}
+}
+
+func TestArchiveRelativeURL(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(filepath.Join(tmp, "backups"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	w, _, err := Open("zip://backups/a.zip", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "backups", "a.zip")); err != nil {
+		t.Error(err)
+	}
+}
+
+func testArchive(t *testing.T, archiveName string) {
+	tmp, err := ioutil.TempDir("", "scopy_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "bc",
+		"b/d/e.txt":   "bde",
+		"b/d/f/g.txt": "bdfg",
+	}
+
+	src := filepath.Join(tmp, "src")
+	for name, content := range files {
+		filename := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiveFile := filepath.Join(tmp, archiveName)
+	scheme := "tar"
+	if filepath.Ext(archiveName) == ".zip" {
+		scheme = "zip"
+	}
+
+	w, _, err := Open(scheme+"://"+filepath.ToSlash(archiveFile), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var okFiles []File
+	err = UploadDir(context.Background(), src, w, "", false, &okFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteFile("h.txt", []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := Open(scheme+"://"+filepath.ToSlash(archiveFile), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	fis, err := r.List("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "c.txt" || names[1] != "d" {
+		t.Error("want [c.txt d], got", names)
+	}
+
+	if err := r.WriteFile("x.txt", []byte("x")); err != ErrArchiveReadOnly {
+		t.Error("want ErrArchiveReadOnly, got", err)
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	okFiles = nil
+	err = DownloadDir(context.Background(), r, "", dst, func(remote, local string) bool {
+		return false
+	}, &okFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files["h.txt"] = "h"
+	for name, content := range files {
+		bs, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(bs) != content {
+			t.Error(name, ": want", content, "got", string(bs))
+		}
+	}
+
+	ResetMem("test_archive")
+	defer ResetMem("test_archive")
+	mem := Mem("test_archive")
+	okFiles = nil
+	if err = CopyDir(context.Background(), r, "b", mem, "x", &okFiles); err != nil {
+		t.Fatal(err)
+	}
+	if len(okFiles) != 3 {
+		t.Error("want 3 files, got", okFiles)
+	}
+	exists, err := mem.Exists("x/d/f/g.txt")
+	if err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("x/d/f/g.txt isnot exists")
+	}
+}
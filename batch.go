@@ -0,0 +1,278 @@
+package scopy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+
+	aceql_http "github.com/mei-rune/aceql-http-go"
+)
+
+var ErrBatchDone = errors.New("scopy: batch is already committed or rolled back")
+
+// Batch 在一个事务中写入、改名和删除多个文件，这些修改在 Commit 时一起生效，或者在 Rollback 时一起撤销。
+// 成员文件的 Writer 必须在 Commit 之前关闭; 任何一个操作失败后 Commit 都会回滚并返回这个错误
+type Batch interface {
+	Write(remotePath string) (io.WriteCloser, error)
+	WriteFile(remotePath string, data []byte) error
+	Rename(from, to string) error
+	Delete(remotePath string) error
+	Commit() error
+	Rollback() error
+}
+
+// batchState 记录批处理中的成员文件和第一个错误
+type batchState struct {
+	done    bool
+	err     error
+	writers []*error // 每个成员文件的 lastError, Close 成功后为 fs.ErrClosed
+}
+
+func (b *batchState) check() error {
+	if b.done {
+		return ErrBatchDone
+	}
+	return nil
+}
+
+// fail 记录操作的错误，删除不存在的文件不算失败
+func (b *batchState) fail(err error) error {
+	if err != nil && b.err == nil && !errors.Is(err, os.ErrNotExist) {
+		b.err = err
+	}
+	return err
+}
+
+// result 返回 Commit 前批处理的状态，有错误或有没有关闭的成员文件时必须回滚
+func (b *batchState) result() error {
+	if b.err != nil {
+		return b.err
+	}
+	for _, lastError := range b.writers {
+		if *lastError == nil {
+			return errors.New("scopy: a file in the batch is not closed")
+		}
+		if *lastError != fs.ErrClosed {
+			return *lastError
+		}
+	}
+	return nil
+}
+
+type dbBatch struct {
+	batchState
+	st *dbTarget
+}
+
+// Begin 开始一个批处理
+func (st *dbTarget) Begin() (Batch, error) {
+	if st.tx != nil {
+		return nil, errors.New("scopy: target is already bound to a transaction")
+	}
+	tx, err := st.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbBatch{st: st.WithTx(tx)}, nil
+}
+
+func (b *dbBatch) Write(remotePath string) (io.WriteCloser, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	w, err := b.st.Write(remotePath)
+	if err != nil {
+		return nil, b.fail(err)
+	}
+	b.writers = append(b.writers, &w.(*dbFileWriter).lastError)
+	return w, nil
+}
+
+func (b *dbBatch) WriteFile(remotePath string, data []byte) (reterr error) {
+	w, err := b.Write(remotePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := w.Close(); err != nil {
+			reterr = err
+		}
+	}()
+	return w.(*dbFileWriter).OneWrite(data)
+}
+
+func (b *dbBatch) Rename(from, to string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.fail(b.st.Rename(from, to))
+}
+
+func (b *dbBatch) Delete(remotePath string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.fail(b.st.Delete(remotePath))
+}
+
+func (b *dbBatch) Commit() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	b.done = true
+	if err := b.result(); err != nil {
+		return joinError(err, b.st.tx.Rollback())
+	}
+	return b.st.tx.Commit()
+}
+
+func (b *dbBatch) Rollback() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	b.done = true
+	return b.st.tx.Rollback()
+}
+
+// sqlhttpBatch 重新登录得到自己的 aceql 连接并关闭它的自动提交，批处理中的语句在 Commit 时一起提交, 成员文件不再设置自己的 savepoint。
+// target 的其它操作仍然使用 target 自己的连接，不受批处理的影响。
+// 批处理的会话失效后不会重新登录，因为新的连接是自动提交的，之后的操作和 Commit 都会返回 errBatchSessionLost
+type sqlhttpBatch struct {
+	batchState
+	st   *sqlhttpTarget
+	sess *aceql_http.Session
+}
+
+// errBatchSessionLost 表示批处理或事务的会话失效了，没有提交的语句已经被服务器丢弃
+var errBatchSessionLost = errors.New("scopy: session of the batch is lost, the batch is rolled back")
+
+// Begin 开始一个批处理
+func (st *sqlhttpTarget) Begin() (Batch, error) {
+	bound := *st
+	bound.enableSavepoint = false
+	bound.sess = nil
+
+	sess, err := bound.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := aceqlCall(bound.c, sess, "set_auto_commit/false"); err != nil {
+		aceqlCall(bound.c, sess, "close")
+		return nil, err
+	}
+	bound.batch = true
+	return &sqlhttpBatch{st: &bound, sess: sess}, nil
+}
+
+// aceqlCall 调用 aceql 的连接上没有参数的操作, 如 commit 和 rollback
+func aceqlCall(c *aceql_http.Client, sess *aceql_http.Session, action string) error {
+	req, err := http.NewRequest(http.MethodGet, c.CreateURL("session/"+sess.SessionID+"/connection/"+sess.ConnectionID+"/"+action, nil), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	hc := c.Hc
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	response, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return aceql_http.ToResponseError(response)
+	}
+
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Status != aceql_http.OK {
+		return errors.New("scopy: " + action + ": " + result.Status)
+	}
+	return nil
+}
+
+// end 提交或回滚批处理, 然后关闭批处理的连接
+func (b *sqlhttpBatch) end(action string) error {
+	b.done = true
+	if b.st.sess != b.sess {
+		return errBatchSessionLost
+	}
+	err := aceqlCall(b.st.c, b.sess, action)
+	if err != nil && action == "commit" {
+		err = joinError(err, aceqlCall(b.st.c, b.sess, "rollback"))
+	}
+	// 关闭失败时服务器会在会话超时后回收连接, 不影响提交的结果
+	aceqlCall(b.st.c, b.sess, "close")
+	return err
+}
+
+func (b *sqlhttpBatch) Write(remotePath string) (io.WriteCloser, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	w, err := b.st.Write(remotePath)
+	if err != nil {
+		return nil, b.fail(err)
+	}
+	b.writers = append(b.writers, &w.(*sqlhttpFileWriter).lastError)
+	return w, nil
+}
+
+func (b *sqlhttpBatch) WriteFile(remotePath string, data []byte) (reterr error) {
+	w, err := b.Write(remotePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := w.Close(); err != nil {
+			reterr = err
+		}
+	}()
+	return w.(*sqlhttpFileWriter).OneWrite(data)
+}
+
+func (b *sqlhttpBatch) Rename(from, to string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.fail(b.st.Rename(from, to))
+}
+
+func (b *sqlhttpBatch) Delete(remotePath string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.fail(b.st.Delete(remotePath))
+}
+
+func (b *sqlhttpBatch) Commit() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	// 会话失效后服务器已经丢弃了没有提交的语句
+	if b.st.sess != b.sess {
+		return b.end("commit")
+	}
+	if err := b.result(); err != nil {
+		return joinError(err, b.Rollback())
+	}
+	return b.end("commit")
+}
+
+func (b *sqlhttpBatch) Rollback() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.end("rollback")
+}
@@ -3,7 +3,6 @@ package scopy
 import (
 	"io"
 	"io/fs"
-	"path"
 )
 
 func Changedir(sess Session, dir string) Session {
@@ -16,9 +15,23 @@ func Changedir(sess Session, dir string) Session {
   }
 }
 
+// ChangedirConfined 和 Changedir 一样，但是所有路径都被限制在 dir 之下, 见 ConfineMode
+func ChangedirConfined(sess Session, dir string, mode ConfineMode) Session {
+	return changedirSession{
+		Session: sess,
+		dir:     dir,
+		confine: mode,
+	}
+}
+
 type changedirSession struct {
 	Session
-	dir string
+	dir     string
+	confine ConfineMode
+}
+
+func (ds changedirSession) join(remotePath string) (string, error) {
+	return confinePath(ds.dir, remotePath, ds.confine)
 }
 
 func (ds changedirSession) Close() error {
@@ -26,29 +39,61 @@ func (ds changedirSession) Close() error {
 }
 
 func (ds changedirSession) List(remotePath string) ([]fs.FileInfo, error) {
-	return ds.Session.List(path.Join(ds.dir, remotePath))
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return ds.Session.List(pa)
 }
 
 func (ds changedirSession) Read(remotePath string) (io.ReadCloser, error) {
-	return ds.Session.Read(path.Join(ds.dir, remotePath))
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return ds.Session.Read(pa)
 }
 
 func (ds changedirSession) Write(remotePath string) (io.WriteCloser, error) {
-	return ds.Session.Write(path.Join(ds.dir, remotePath))
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return ds.Session.Write(pa)
 }
 
 func (ds changedirSession) WriteFile(remotePath string, data []byte) error {
-	return ds.Session.WriteFile(path.Join(ds.dir, remotePath), data)
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return err
+	}
+	return ds.Session.WriteFile(pa, data)
 }
 
 func (ds changedirSession) Exists(remotePath string) (bool, error) {
-	return ds.Session.Exists(path.Join(ds.dir, remotePath))
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return false, err
+	}
+	return ds.Session.Exists(pa)
 }
 
 func (ds changedirSession) Rename(from, to string) error {
-	return ds.Session.Rename(path.Join(ds.dir, from), path.Join(ds.dir, from))
+	fromPath, err := ds.join(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := ds.join(to)
+	if err != nil {
+		return err
+	}
+	return ds.Session.Rename(fromPath, toPath)
 }
 
 func (ds changedirSession) Delete(remotePath string) error {
-	return ds.Session.Delete(path.Join(ds.dir, remotePath))
+	pa, err := ds.join(remotePath)
+	if err != nil {
+		return err
+	}
+	return ds.Session.Delete(pa)
 }
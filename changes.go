@@ -0,0 +1,247 @@
+package scopy
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 启用 DBOptions.ChangeFeed 后，写完、改名和删除文件时在 "<表名>_changes" 表中追加一条记录,
+// 记录的 id 是单调递增的，消费者保存最后处理的 id 作为游标, 用 Changes 或 Watch 读取之后的变更。
+// 改名被记录为删除原来的文件和写入新的文件。
+// 并发的事务中 id 较小的记录可能后提交, Watch 返回的迭代器会记住跳过的 id, 在之后的轮询中查找它们，
+// 直到找到或超过 DefaultChangeGapTimeout (回滚的事务也会跳过 id), 所以它返回的变更不一定按 id 递增
+
+const (
+	ChangeWrite  = "write"
+	ChangeDelete = "delete"
+
+	DefaultChangePollInterval = time.Second
+	DefaultChangeBatchSize    = 100
+	DefaultChangeGapTimeout   = time.Minute
+
+	// maxChangeGaps 是迭代器最多记住的跳过的 id 的个数
+	maxChangeGaps = 500
+)
+
+// Change 是文件的一次变更
+type Change struct {
+	ID   int64 // 游标
+	Path string
+	Op   string // ChangeWrite 或 ChangeDelete
+	Time time.Time
+}
+
+// changeTable 返回文件表对应的变更表的表名
+func changeTable(table string) string {
+	return table + "_changes"
+}
+
+// logChange 记录文件的变更，没有启用 DBOptions.ChangeFeed 时什么也不做
+func logChange(e execer, stmts *sqlStatements, opts DBOptions, op string, uuid string) error {
+	if !opts.ChangeFeed {
+		return nil
+	}
+	_, err := e.exec(stmts.changeInsert, uuid, op)
+	return err
+}
+
+// listChanges 返回命名空间中 id 大于 since 的变更
+func listChanges(e execer, stmts *sqlStatements, d *dialect, opts DBOptions, since int64, limit int) ([]Change, error) {
+	if limit <= 0 {
+		limit = DefaultChangeBatchSize
+	}
+	query, args := stmts.changeList, []interface{}{since}
+	if prefix := opts.namespacePrefix(); prefix != "" {
+		query, args = stmts.changeListPrefix, append(args, prefixArgs(prefix)...)
+	}
+	var changes []Change
+	err := e.query(query+d.limit(limit), args, func(scan func(dest ...interface{}) error) error {
+		var c Change
+		var created nullTime
+		if err := scan(&c.ID, &c.Path, &c.Op, &created); err != nil {
+			return err
+		}
+		c.Path, c.Time = opts.path(c.Path), created.Time
+		changes = append(changes, c)
+		return nil
+	})
+	return changes, err
+}
+
+// listChangesByID 返回命名空间中指定 id 的变更
+func listChangesByID(e execer, stmts *sqlStatements, opts DBOptions, ids []int64) ([]Change, error) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := stmts.changeGet + "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+	prefix := opts.namespacePrefix()
+	var changes []Change
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		var c Change
+		var created nullTime
+		if err := scan(&c.ID, &c.Path, &c.Op, &created); err != nil {
+			return err
+		}
+		// 其它命名空间的变更
+		if !strings.HasPrefix(c.Path, prefix) {
+			return nil
+		}
+		c.Path, c.Time = opts.path(c.Path), created.Time
+		changes = append(changes, c)
+		return nil
+	})
+	return changes, err
+}
+
+func lastChange(e execer, stmts *sqlStatements) (int64, error) {
+	var id sql.NullInt64
+	err := e.query(stmts.changeLast, nil, func(scan func(dest ...interface{}) error) error {
+		return scan(&id)
+	})
+	return id.Int64, err
+}
+
+// ChangeIterator 逐个返回变更，没有新的变更时按间隔轮询
+type ChangeIterator struct {
+	list       func(since int64, limit int) ([]Change, error)
+	get        func(ids []int64) ([]Change, error)
+	cursor     int64 // 已经读到的最大的 id
+	interval   time.Duration
+	gapTimeout time.Duration
+	gaps       map[int64]time.Time // 小于 cursor 但还没有读到的 id 和发现它的时间
+	buffer     []Change
+}
+
+// Cursor 返回下次可以从它开始的 id, 它之前的变更都已经被 Next 返回了。
+// 有还没有读到的 id 时它小于最后一个被 Next 返回的变更的 id, 从它开始时可能重复返回一些变更
+func (it *ChangeIterator) Cursor() int64 {
+	cursor := it.cursor
+	for id := range it.gaps {
+		if id-1 < cursor {
+			cursor = id - 1
+		}
+	}
+	for _, c := range it.buffer {
+		if c.ID-1 < cursor {
+			cursor = c.ID - 1
+		}
+	}
+	return cursor
+}
+
+// poll 读取跳过的 id 和 cursor 之后的变更
+func (it *ChangeIterator) poll() ([]Change, error) {
+	var changes []Change
+	if len(it.gaps) > 0 {
+		now := time.Now()
+		ids := make([]int64, 0, len(it.gaps))
+		for id, found := range it.gaps {
+			if now.Sub(found) > it.gapTimeout {
+				delete(it.gaps, id)
+			} else {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			late, err := it.get(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range late {
+				delete(it.gaps, c.ID)
+			}
+			changes = append(changes, late...)
+		}
+	}
+
+	next, err := it.list(it.cursor, DefaultChangeBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, c := range next {
+		for id := it.cursor + 1; id < c.ID && len(it.gaps) < maxChangeGaps; id++ {
+			it.gaps[id] = now
+		}
+		it.cursor = c.ID
+	}
+	return append(changes, next...), nil
+}
+
+// Next 返回下一个变更，没有新的变更时阻塞到有变更或 ctx 结束
+func (it *ChangeIterator) Next(ctx context.Context) (Change, error) {
+	for len(it.buffer) == 0 {
+		changes, err := it.poll()
+		if err != nil {
+			return Change{}, err
+		}
+		if len(changes) > 0 {
+			it.buffer = changes
+			break
+		}
+
+		timer := time.NewTimer(it.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Change{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	c := it.buffer[0]
+	it.buffer = it.buffer[1:]
+	return c, nil
+}
+
+func newChangeIterator(e func() execer, stmts *sqlStatements, d *dialect, opts DBOptions, since int64, interval time.Duration) (*ChangeIterator, error) {
+	if interval <= 0 {
+		interval = DefaultChangePollInterval
+	}
+	if since < 0 {
+		last, err := lastChange(e(), stmts)
+		if err != nil {
+			return nil, err
+		}
+		since = last
+	}
+	return &ChangeIterator{
+		list: func(since int64, limit int) ([]Change, error) {
+			return listChanges(e(), stmts, d, opts, since, limit)
+		},
+		get: func(ids []int64) ([]Change, error) {
+			return listChangesByID(e(), stmts, opts, ids)
+		},
+		cursor:     since,
+		interval:   interval,
+		gapTimeout: DefaultChangeGapTimeout,
+		gaps:       map[int64]time.Time{},
+	}, nil
+}
+
+// Changes 返回 id 大于 since 的变更，最多 limit 个, limit 为 0 时用 DefaultChangeBatchSize
+func (st *dbTarget) Changes(since int64, limit int) ([]Change, error) {
+	return listChanges(st.execer(), st.stmts, st.dialect, st.opts, since, limit)
+}
+
+// Watch 返回从 since 之后开始的变更的迭代器, since 小于 0 时从最新的变更之后开始,
+// interval 是没有新的变更时轮询的间隔，为 0 时用 DefaultChangePollInterval
+func (st *dbTarget) Watch(since int64, interval time.Duration) (*ChangeIterator, error) {
+	return newChangeIterator(st.execer, st.stmts, st.dialect, st.opts, since, interval)
+}
+
+// Changes 返回 id 大于 since 的变更，最多 limit 个, limit 为 0 时用 DefaultChangeBatchSize
+func (st *sqlhttpTarget) Changes(since int64, limit int) ([]Change, error) {
+	return listChanges(st.execer(), st.stmts, st.dialect, st.opts, since, limit)
+}
+
+// Watch 返回从 since 之后开始的变更的迭代器, since 小于 0 时从最新的变更之后开始,
+// interval 是没有新的变更时轮询的间隔，为 0 时用 DefaultChangePollInterval
+func (st *sqlhttpTarget) Watch(since int64, interval time.Duration) (*ChangeIterator, error) {
+	return newChangeIterator(st.execer, st.stmts, st.dialect, st.opts, since, interval)
+}
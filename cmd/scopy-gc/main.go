@@ -0,0 +1,53 @@
+// scopy-gc 清理数据库中的文件表
+//
+//	scopy-gc -url "db+sqlite:/data/files.db" -retention 720h -max-size 10737418240
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mei-rune/scopy"
+)
+
+type garbageCollector interface {
+	GC(scopy.GCOptions) (scopy.GCResult, error)
+}
+
+func main() {
+	var urlstr, username, password string
+	var opts scopy.GCOptions
+	flag.StringVar(&urlstr, "url", "", "文件表的 url, 如 db+sqlite:/data/files.db 或 db+http://host:9090/aceql?sc_dbname=db")
+	flag.StringVar(&username, "username", "", "数据库的用户名")
+	flag.StringVar(&password, "password", "", "数据库的密码")
+	flag.DurationVar(&opts.Retention, "retention", 0, "删除最后一次写入早于这个时间之前的文件, 为 0 时不删除")
+	flag.Int64Var(&opts.MaxTotalSize, "max-size", 0, "所有文件的总大小的上限(字节)，为 0 时不限制")
+	flag.DurationVar(&opts.IncompleteAge, "incomplete-age", scopy.DefaultGCIncompleteAge, "没有写完的文件经过这个时间后被删除，小于 0 时不删除")
+	flag.IntVar(&opts.BatchSize, "batch", scopy.DefaultGCBatchSize, "一个事务中最多删除的文件数")
+	flag.Parse()
+
+	if urlstr == "" {
+		flag.Usage()
+		log.Fatalln("缺少参数 url")
+	}
+
+	sess, _, err := scopy.Open(urlstr, username, password)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer sess.Close()
+
+	gc, ok := sess.(garbageCollector)
+	if !ok {
+		log.Fatalln("'" + urlstr + "' 不是数据库中的文件表")
+	}
+	result, err := gc.GC(opts)
+	fmt.Printf("files: %d, incomplete: %d, bytes: %d, version chunks: %d, blobs: %d, changes: %d\n",
+		result.Files, result.Incomplete, result.Bytes, result.Versions, result.Blobs, result.Changes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
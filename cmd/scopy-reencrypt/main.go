@@ -0,0 +1,61 @@
+// scopy-reencrypt 将数据库中的文件表的块改为用新的密钥加密
+//
+//	scopy-reencrypt -url "db+sqlite:/data/files.db" -keys /etc/scopy/keys.json
+//
+// 密钥文件的格式见 scopy.LoadKeyFile, 轮换密钥时将新的密钥加到文件中并修改 current
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mei-rune/scopy"
+)
+
+type reencrypter interface {
+	ReEncrypt(batchSize int) (int64, error)
+}
+
+func main() {
+	var urlstr, username, password, keyFile string
+	var batchSize int
+	flag.StringVar(&urlstr, "url", "", "文件表的 url, 如 db+sqlite:/data/files.db 或 db+http://host:9090/aceql?sc_dbname=db")
+	flag.StringVar(&username, "username", "", "数据库的用户名")
+	flag.StringVar(&password, "password", "", "数据库的密码")
+	flag.StringVar(&keyFile, "keys", "", "密钥文件, 不指定时使用 url 中的 sc_key_file 参数")
+	flag.IntVar(&batchSize, "batch", scopy.DefaultGCBatchSize, "一个事务中最多处理的块数")
+	flag.Parse()
+
+	if urlstr == "" {
+		flag.Usage()
+		log.Fatalln("缺少参数 url")
+	}
+	if keyFile != "" {
+		sep := "?"
+		if strings.Contains(urlstr, "?") {
+			sep = "&"
+		}
+		urlstr += sep + "sc_key_file=" + url.QueryEscape(keyFile)
+	}
+
+	sess, _, err := scopy.Open(urlstr, username, password)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer sess.Close()
+
+	target, ok := sess.(reencrypter)
+	if !ok {
+		log.Fatalln("'" + urlstr + "' 不是数据库中的文件表")
+	}
+	count, err := target.ReEncrypt(batchSize)
+	fmt.Printf("chunks: %d\n", count)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,96 @@
+package scopy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 数据库后端可以压缩每个块, 压缩算法记录在块的 encoding 列中，为空时是没有压缩的,
+// 所以压缩过的块和没有压缩的块可以在同一个文件中
+const (
+	EncodingNone = ""
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case EncodingNone, EncodingGzip, EncodingZstd:
+		return nil
+	}
+	return errors.New("scopy: compression '" + encoding + "' is unsupported")
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd 创建共享的 zstd 编码器和解码器, 它们的 EncodeAll 和 DecodeAll 可以并发调用
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// encodeChunk 压缩一个块，压缩后没有变小时返回原来的数据和 EncodingNone
+func encodeChunk(encoding string, data []byte) ([]byte, string, error) {
+	var compressed []byte
+	switch encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		compressed = buf.Bytes()
+	case EncodingZstd:
+		if err := initZstd(); err != nil {
+			return nil, "", err
+		}
+		compressed = zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data, EncodingNone, nil
+	}
+
+	if len(compressed) >= len(data) {
+		return data, EncodingNone, nil
+	}
+	return compressed, encoding, nil
+}
+
+// decodeChunk 解压一个块
+func decodeChunk(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingNone:
+		return data, nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case EncodingZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, checkEncoding(encoding)
+}
@@ -0,0 +1,162 @@
+package scopy
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConfineMode 指定如何处理超出根目录的路径
+type ConfineMode int
+
+const (
+	// ConfineNone 不做任何检查，和以前的行为一样
+	ConfineNone ConfineMode = iota
+
+	// ConfineReject 拒绝超出根目录的路径，返回 *PathEscapeError
+	ConfineReject
+
+	// ConfineNormalize 将路径当作相对于根目录的绝对路径，如 "../../etc/x" 会变为 "etc/x",
+	// 但本地的符号链接指向根目录之外时仍然会返回 *PathEscapeError
+	ConfineNormalize
+)
+
+// ParseConfineMode 解析 "reject", "normalize" 等字符串，空字符串和 "none" 为 ConfineNone
+func ParseConfineMode(s string) (ConfineMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none", "false":
+		return ConfineNone, nil
+	case "reject", "strict", "true":
+		return ConfineReject, nil
+	case "normalize":
+		return ConfineNormalize, nil
+	}
+	return ConfineNone, errors.New("confine mode '" + s + "' is unsupported")
+}
+
+// PathEscapeError 表示路径超出了根目录
+type PathEscapeError struct {
+	Root string
+	Path string
+}
+
+func (e *PathEscapeError) Error() string {
+	return "scopy: path '" + e.Path + "' is outside of '" + e.Root + "'"
+}
+
+func IsPathEscape(err error) bool {
+	var e *PathEscapeError
+	return errors.As(err, &e)
+}
+
+func isEscaped(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, "../")
+}
+
+// confinePath 将 '/' 分隔的 name 和 root 连接起来, 反斜杠也被当作分隔符
+func confinePath(root, name string, mode ConfineMode) (string, error) {
+	if mode == ConfineNone {
+		return path.Join(root, name), nil
+	}
+
+	cleaned := strings.Replace(name, "\\", "/", -1)
+	if mode == ConfineNormalize {
+		return path.Join(root, path.Clean("/"+cleaned)), nil
+	}
+
+	cleaned = strings.TrimLeft(path.Clean(cleaned), "/")
+	if isEscaped(cleaned) {
+		return "", &PathEscapeError{Root: root, Path: name}
+	}
+	return path.Join(root, cleaned), nil
+}
+
+// SafeJoin 将 name 连接到本地目录 root 下， name 超出 root 时 (包括通过符号链接) 返回 *PathEscapeError
+func SafeJoin(root, name string) (string, error) {
+	return confineLocalPath(root, name, ConfineReject, true)
+}
+
+// confineLocalPath 将 name 连接到本地目录 root 下，followLast 为 false 时不检查最后一级的符号链接,
+// 用于删除和改名这种只操作链接本身的情况
+func confineLocalPath(root, name string, mode ConfineMode, followLast bool) (string, error) {
+	if mode == ConfineNone {
+		return filepath.Join(root, name), nil
+	}
+
+	slashed, err := confinePath("/", filepath.ToSlash(name), mode)
+	if err != nil {
+		return "", &PathEscapeError{Root: root, Path: name}
+	}
+	if vol := filepath.VolumeName(filepath.FromSlash(strings.TrimPrefix(slashed, "/"))); vol != "" {
+		return "", &PathEscapeError{Root: root, Path: name}
+	}
+	fullpath := filepath.Join(root, filepath.FromSlash(slashed))
+
+	checkpath := fullpath
+	if !followLast {
+		checkpath = filepath.Dir(fullpath)
+	}
+	if err := checkSymlinks(root, checkpath); err != nil {
+		if IsPathEscape(err) {
+			return "", &PathEscapeError{Root: root, Path: name}
+		}
+		return "", err
+	}
+	return fullpath, nil
+}
+
+// checkSymlinks 检查 fullpath 中已存在的部分在解析符号链接之后是否还在 root 之下
+func checkSymlinks(root, fullpath string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return err
+	}
+
+	p := fullpath
+	for hops := 0; hops < 255; hops++ {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			real, err = filepath.Abs(real)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(realRoot, real)
+			if err != nil || isEscaped(filepath.ToSlash(rel)) {
+				return &PathEscapeError{Root: root, Path: fullpath}
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		// 指向不存在文件的符号链接，写入时会在链接的目标处新建文件，所以要检查目标
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(p), target)
+			}
+			p = target
+			continue
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return nil
+		}
+		p = parent
+	}
+	return &PathEscapeError{Root: root, Path: fullpath}
+}
@@ -0,0 +1,190 @@
+package scopy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConfinePath(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		mode   ConfineMode
+		result string
+		escape bool
+	}{
+		{name: "a/b.txt", mode: ConfineReject, result: "/data/a/b.txt"},
+		{name: "/a/b.txt", mode: ConfineReject, result: "/data/a/b.txt"},
+		{name: "a/../b.txt", mode: ConfineReject, result: "/data/b.txt"},
+		{name: "../b.txt", mode: ConfineReject, escape: true},
+		{name: "a/../../b.txt", mode: ConfineReject, escape: true},
+		{name: "..\\..\\etc\\x", mode: ConfineReject, escape: true},
+		{name: "../../etc/cron.d/x", mode: ConfineNormalize, result: "/data/etc/cron.d/x"},
+		{name: "../../etc/cron.d/x", mode: ConfineNone, result: "/etc/cron.d/x"},
+	} {
+		result, err := confinePath("/data", test.name, test.mode)
+		if test.escape {
+			if !IsPathEscape(err) {
+				t.Error(test.name, ": want escape error, got", result, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.name, ":", err)
+			continue
+		}
+		if result != test.result {
+			t.Error(test.name, ": want", test.result, "got", result)
+		}
+	}
+}
+
+func TestOSConfined(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_confine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	target := OSConfined(root, ConfineReject)
+	if err := target.WriteFile("../outside/x.txt", []byte("x")); !IsPathEscape(err) {
+		t.Error("want escape error, got", err)
+	}
+	if _, err := target.Read("../outside/secret.txt"); !IsPathEscape(err) {
+		t.Error("want escape error, got", err)
+	}
+	if err := target.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Error(err)
+	}
+
+	normalized := OSConfined(root, ConfineNormalize)
+	if err := normalized.WriteFile("../../a.txt", []byte("b")); err != nil {
+		t.Error(err)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "b" {
+		t.Error("want b, got", string(bs))
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []*osTarget{target, normalized} {
+		if _, err := st.Read("link/secret.txt"); !IsPathEscape(err) {
+			t.Error("want escape error, got", err)
+		}
+		if _, err := st.List("link"); !IsPathEscape(err) {
+			t.Error("want escape error, got", err)
+		}
+		if err := st.WriteFile("dangling", []byte("x")); !IsPathEscape(err) {
+			t.Error("want escape error, got", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Error("file is created outside of root")
+	}
+
+	// 删除链接本身是允许的
+	if err := target.Delete("link"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangedirConfined(t *testing.T) {
+	ResetMem("test_confine")
+	defer ResetMem("test_confine")
+
+	sess := ChangedirConfined(Mem("test_confine"), "a/b", ConfineReject)
+	if err := sess.WriteFile("../c.txt", []byte("c")); !IsPathEscape(err) {
+		t.Error("want escape error, got", err)
+	}
+	if err := sess.WriteFile("c/../d.txt", []byte("d")); err != nil {
+		t.Error(err)
+	}
+	exists, err := Mem("test_confine").Exists("a/b/d.txt")
+	if err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("a/b/d.txt isnot exists")
+	}
+}
+
+type evilFileInfo string
+
+func (fi evilFileInfo) Name() string       { return string(fi) }
+func (fi evilFileInfo) IsDir() bool        { return false }
+func (fi evilFileInfo) Size() int64        { return 4 }
+func (fi evilFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi evilFileInfo) ModTime() time.Time { return time.Now() }
+func (fi evilFileInfo) Sys() interface{}   { return nil }
+
+// evilSession 模拟一个返回恶意文件名的服务器
+type evilSession struct {
+	Session
+}
+
+func (st evilSession) List(remotePath string) ([]fs.FileInfo, error) {
+	return []fs.FileInfo{evilFileInfo("../evil.txt"), evilFileInfo("good.txt")}, nil
+}
+
+func (st evilSession) Read(remotePath string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader([]byte("evil"))), nil
+}
+
+func TestDownloadDirEscape(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_confine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	localDir := filepath.Join(tmp, "dst")
+	var okFiles []File
+	err = DownloadDirConfined(context.Background(), evilSession{}, "", localDir, ConfineReject, func(remote, local string) bool {
+		return false
+	}, &okFiles)
+	e, ok := err.(*ErrDownloadFiles)
+	if !ok {
+		t.Fatal("want *ErrDownloadFiles, got", err)
+	}
+	if len(e.ErrorList) != 1 || !IsPathEscape(e.ErrorList[0]) {
+		t.Error("want escape error, got", e.ErrorList)
+	}
+	if len(okFiles) != 1 || okFiles[0].Remote != "good.txt" {
+		t.Error("want good.txt, got", okFiles)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "evil.txt")); !os.IsNotExist(err) {
+		t.Error("file is created outside of local dir")
+	}
+}
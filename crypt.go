@@ -0,0 +1,298 @@
+package scopy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 启用加密后每个块在压缩后用 AES-GCM 加密, 块的 key_id 列记录了加密用的密钥的 id,
+// key_id 为空的块是没有加密的。密文的前面是随机的 nonce, 块的压缩算法和块的 uuid 及序号 (blob 是它的 hash)
+// 作为附加数据参与认证, 这样块不能被换到其它的文件或位置。 key_id 以 boundKeySuffix 结尾的块才绑定了 uuid 和序号,
+// 之前写入的块的附加数据只有压缩算法, 可以用 ReEncrypt 改为新的格式
+
+// boundKeySuffix 加在 key_id 后面，表示附加数据中有块的 uuid 和序号
+const boundKeySuffix = "#b"
+
+var ErrNoKeyProvider = errors.New("scopy: chunk is encrypted but no key provider is set")
+
+// KeyProvider 提供加密用的密钥，密钥的长度必须是 16, 24 或 32 字节
+type KeyProvider interface {
+	// CurrentKey 返回加密新的数据时用的密钥和它的 id
+	CurrentKey() (string, []byte, error)
+
+	// Key 返回 id 对应的密钥，用于解密
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys 是保存在内存中的密钥，轮换密钥时将新的密钥加到 Keys 中并修改 Current,
+// 然后用 ReEncrypt 将已有的块改为用新的密钥加密
+type StaticKeys struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"` // json 中是 base64 编码的
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, errors.New("scopy: key '" + id + "' is not found")
+	}
+	return key, nil
+}
+
+// LoadKeyFile 从 json 文件中读取 StaticKeys, 格式为 {"current": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}}
+func LoadKeyFile(filename string) (*StaticKeys, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := &StaticKeys{}
+	if err := json.Unmarshal(bs, keys); err != nil {
+		return nil, errWrap(err, "密钥文件 '"+filename+"' 的格式不正确")
+	}
+	if _, _, err := keys.CurrentKey(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkBinding 是文件的块在附加数据中的位置信息
+func chunkBinding(uuid string, seq int) string {
+	return uuid + "\x00" + strconv.Itoa(seq)
+}
+
+// blobBinding 是去重的 blob 在附加数据中的位置信息, blob 被多个文件共享，所以只绑定它的 hash
+func blobBinding(hash string) string {
+	return "\x00blob\x00" + hash
+}
+
+func additionalData(encoding, bind string) []byte {
+	return []byte(encoding + "\x00" + bind)
+}
+
+// sealChunk 用当前的密钥加密一个块，keys 为 nil 时不加密, bind 是 chunkBinding 或 blobBinding 的返回值
+func sealChunk(keys KeyProvider, encoding, bind string, data []byte) ([]byte, string, error) {
+	if keys == nil {
+		return data, "", nil
+	}
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", err
+	}
+	return gcm.Seal(nonce, nonce, data, additionalData(encoding, bind)), id + boundKeySuffix, nil
+}
+
+// openChunk 解密一个块, keyID 为空时块是没有加密的
+func openChunk(keys KeyProvider, keyID, encoding, bind string, data []byte) ([]byte, error) {
+	if keyID == "" {
+		return data, nil
+	}
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	ad := []byte(encoding)
+	if strings.HasSuffix(keyID, boundKeySuffix) {
+		keyID = strings.TrimSuffix(keyID, boundKeySuffix)
+		ad = additionalData(encoding, bind)
+	}
+	key, err := keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("scopy: encrypted chunk is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], ad)
+}
+
+// reencryptTable 分批将不是用当前的密钥加密的块改为用当前的密钥加密, query 返回 (id, data, encoding, key_id, uuid, 序号),
+// blob 的表中 uuid 是 hash
+func reencryptTable(st tableStore, keys KeyProvider, query, update string, batchSize int, blob bool) (int64, error) {
+	id, _, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	id += boundKeySuffix
+
+	var total int64
+	for {
+		type chunk struct {
+			id       int64
+			data     []byte
+			encoding string
+			keyID    string
+			bind     string
+		}
+		var chunks []chunk
+		err := st.execer().query(query, []interface{}{id}, func(scan func(dest ...interface{}) error) error {
+			var c chunk
+			var encoding, keyID sql.NullString
+			var owner string
+			var seq int
+			if err := scan(&c.id, &c.data, &encoding, &keyID, &owner, &seq); err != nil {
+				return err
+			}
+			c.encoding, c.keyID = encoding.String, keyID.String
+			if blob {
+				c.bind = blobBinding(owner)
+			} else {
+				c.bind = chunkBinding(owner, seq)
+			}
+			chunks = append(chunks, c)
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		if len(chunks) == 0 {
+			return total, nil
+		}
+
+		err = st.inTx(func(e execer) error {
+			for _, c := range chunks {
+				plain, err := openChunk(keys, c.keyID, c.encoding, c.bind, c.data)
+				if err != nil {
+					return err
+				}
+				sealed, newID, err := sealChunk(keys, c.encoding, c.bind, plain)
+				if err != nil {
+					return err
+				}
+				if _, err := e.exec(update, sealed, newID, c.id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += int64(len(chunks))
+
+		if len(chunks) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// resealFile 在改名或复制后将文件 to 的块从原来的 uuid (from) 重新绑定到 to, 要和改名在同一个事务中调用。
+// 只有绑定了 uuid 的加密块需要处理，去重的块的数据在 blob 中，不需要处理。
+// skipBroken 为 true 时跳过不能解密的块, 用于隔离损坏的文件
+func resealFile(e execer, stmts *sqlStatements, keys KeyProvider, from, to string, skipBroken bool) error {
+	type chunk struct {
+		id    int64
+		seq   int
+		keyID string
+	}
+	var chunks []chunk
+	err := e.query(stmts.resealChunks, []interface{}{to}, func(scan func(dest ...interface{}) error) error {
+		var c chunk
+		if err := scan(&c.id, &c.seq, &c.keyID); err != nil {
+			return err
+		}
+		if strings.HasSuffix(c.keyID, boundKeySuffix) {
+			chunks = append(chunks, c)
+		}
+		return nil
+	})
+	if err != nil || len(chunks) == 0 {
+		return err
+	}
+	if keys == nil && !skipBroken {
+		return ErrNoKeyProvider
+	}
+
+	for _, c := range chunks {
+		var data []byte
+		var encoding sql.NullString
+		err := e.query(stmts.resealRead, []interface{}{c.id}, func(scan func(dest ...interface{}) error) error {
+			return scan(&data, &encoding)
+		})
+		if err != nil {
+			return err
+		}
+		plain, err := openChunk(keys, c.keyID, encoding.String, chunkBinding(from, c.seq), data)
+		if err != nil {
+			if skipBroken {
+				continue
+			}
+			return err
+		}
+		sealed, keyID, err := sealChunk(keys, encoding.String, chunkBinding(to, c.seq), plain)
+		if err != nil {
+			return err
+		}
+		if _, err := e.exec(stmts.rekeyUpdate, sealed, keyID, c.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runReencrypt(st tableStore, stmts *sqlStatements, d *dialect, opts DBOptions, batchSize int) (int64, error) {
+	if opts.Keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+	if opts.Namespace != "" {
+		return 0, ErrNamespaceUnsupported
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultGCBatchSize
+	}
+	count, err := reencryptTable(st, opts.Keys, stmts.rekeySelect+d.limit(batchSize), stmts.rekeyUpdate, batchSize, false)
+	if err != nil {
+		return count, err
+	}
+	n, err := reencryptTable(st, opts.Keys, stmts.verRekeySelect+d.limit(batchSize), stmts.verRekeyUpdate, batchSize, false)
+	count += n
+	if err != nil {
+		return count, err
+	}
+	n, err = reencryptTable(st, opts.Keys, stmts.blobRekeySelect+d.limit(batchSize), stmts.blobRekeyUpdate, batchSize, true)
+	return count + n, err
+}
+
+// ReEncrypt 将不是用 DBOptions.Keys 的当前密钥加密的块 (包括没有加密的块、历史版本和去重的 blob) 改为用当前的密钥加密,
+// 每批 batchSize 个块在一个事务中, 返回处理的块数。 它作用于整个表，有命名空间时返回 ErrNamespaceUnsupported
+func (st *dbTarget) ReEncrypt(batchSize int) (int64, error) {
+	return runReencrypt(st, st.stmts, st.dialect, st.opts, batchSize)
+}
+
+// ReEncrypt 将不是用 DBOptions.Keys 的当前密钥加密的块 (包括没有加密的块、历史版本和去重的 blob) 改为用当前的密钥加密,
+// 返回处理的块数。 它作用于整个表，有命名空间时返回 ErrNamespaceUnsupported
+func (st *sqlhttpTarget) ReEncrypt(batchSize int) (int64, error) {
+	return runReencrypt(st, st.stmts, st.dialect, st.opts, batchSize)
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"io"
 	"io/fs"
-	"strings"
+	"os"
 	"time"
 )
 
@@ -17,6 +17,7 @@ const (
 	DefaultMaxSize = 5 * 1024 * 1024
 )
 
+// 下面是通用的语句，dbTarget 和 sqlhttpTarget 会根据数据库类型用 newStatements 生成实际执行的语句
 var (
 	DefaultResetSQL = `drop table IF EXISTS tpt_files`
 
@@ -36,68 +37,132 @@ var (
 	DefaultRenameSQL       = `update tpt_files set uuid = ? where uuid = ?`
 	DefaultDeleteSQLByUUID = `delete from tpt_files where uuid = ?`
 	DefaultDeleteSQL       = `delete from tpt_files where id = ?`
-	DefaultListSql         = `select fl.uuid as uuid, count(fl.datalength) as length, max(fl.created_at) as created_at from (select tpt_files.uuid as uuid, length(tpt_files.data) as datalength, tpt_files.created_at as created_at from tpt_files) fl group by fl.uuid`
+	DefaultListSql         = `select fl.uuid as uuid, sum(fl.datalength) as length, max(fl.created_at) as created_at from (select tpt_files.uuid as uuid, length(tpt_files.data) as datalength, tpt_files.created_at as created_at from tpt_files) fl group by fl.uuid`
 	DefaultExistSql        = `select 1 from tpt_files where uuid = ?`
 
 	DefaultReadDataByID  = `select data from tpt_files where id = ?`
 	DefaultReadIDsByUUID = `select id, partitioning_sequence from tpt_files where uuid = ? order by partitioning_sequence`
 )
 
+// DB 打开数据库中的文件表，sqlite 会自动建表，其它数据库需要调用 EnsureSchema 建表或升级表
 func DB(dbDrv, dbURL, dbTable string, maxSize int) (*dbTarget, error) {
+	return DBWithMapping(dbDrv, dbURL, TableMapping{Table: dbTable}, maxSize)
+}
+
+// DBWithMapping 和 DB 一样, 但是可以指定表名和列名的映射，用于使用已有的表
+func DBWithMapping(dbDrv, dbURL string, mapping TableMapping, maxSize int) (*dbTarget, error) {
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
 	conn, err := sql.Open(dbDrv, dbURL)
 	if err != nil {
 		return nil, err
 	}
+	target, err := DBConnWithMapping(conn, dbDrv, mapping, maxSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	target.ownConn = true
+	return target, nil
+}
+
+// DBConn 和 DB 一样，但是使用调用者的连接池 conn, dbDrv 是 conn 的驱动名，用于选择 sql 方言。
+// Close 不会关闭 conn
+func DBConn(conn *sql.DB, dbDrv, dbTable string, maxSize int) (*dbTarget, error) {
+	return DBConnWithMapping(conn, dbDrv, TableMapping{Table: dbTable}, maxSize)
+}
+
+// DBConnWithMapping 和 DBConn 一样, 但是可以指定表名和列名的映射
+func DBConnWithMapping(conn *sql.DB, dbDrv string, mapping TableMapping, maxSize int) (*dbTarget, error) {
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
 	if maxSize < 1024 {
 		maxSize = DefaultMaxSize
 	}
+	d := dialectOf(dbDrv)
+
 	target := &dbTarget{
 		conn:    conn,
 		maxSize: maxSize,
-
-		insertSql:       DefaultInsertSQL,
-		readSqlByUUID:   DefaultReadSQLByUUID,
-		renameSql:       DefaultRenameSQL,
-		deleteSqlByUUID: DefaultDeleteSQLByUUID,
-		listSql:         DefaultListSql,
-		existSql:        DefaultExistSql,
+		dialect: d,
+		table:   mapping.name(),
+		mapping: mapping,
 	}
+	target.stmts = newStatements(d, mapping)
 
-	if dbTable != "" {
-		target.insertSql = strings.Replace(DefaultInsertSQL, "tpt_files", dbTable, -1)
-		target.readSqlByUUID = strings.Replace(DefaultReadSQLByUUID, "tpt_files", dbTable, -1)
-		target.renameSql = strings.Replace(DefaultRenameSQL, "tpt_files", dbTable, -1)
-		target.deleteSqlByUUID = strings.Replace(DefaultDeleteSQLByUUID, "tpt_files", dbTable, -1)
-		target.listSql = strings.Replace(DefaultListSql, "tpt_files", dbTable, -1)
-		target.existSql = strings.Replace(DefaultExistSql, "tpt_files", dbTable, -1)
+	if d.name == DialectSQLite {
+		// sqlite 用于没有数据库服务器的场景，自动建表
+		if err := target.EnsureSchema(); err != nil {
+			return nil, err
+		}
 	}
 
 	return target, nil
 }
 
 type dbTarget struct {
-	conn *sql.DB
+	conn    *sql.DB
+	ownConn bool // conn 是 DB 打开的, Close 时要关闭它
+
+	// tx 不为 nil 时写、改名和删除都在调用者的事务中执行, 见 WithTx
+	tx *sql.Tx
+
+	dialect *dialect
+	table   string
+	mapping TableMapping
 
 	maxSize int
+	opts    DBOptions
+
+	stmts *sqlStatements
+}
 
-	insertSql       string
-	readSqlByUUID   string
-	renameSql       string
-	deleteSqlByUUID string
-	listSql         string
-	existSql        string
+// SetOptions 设置可选功能, 必须在读写文件之前调用。 可选功能和表的映射不兼容时返回错误，原来的设置不变
+func (st *dbTarget) SetOptions(opts DBOptions) error {
+	if err := st.mapping.checkOptions(opts); err != nil {
+		return err
+	}
+	st.opts = opts
+	return nil
 }
 
 func (st *dbTarget) Close() error {
+	if !st.ownConn {
+		return nil
+	}
 	return st.conn.Close()
 }
 
+// WithTx 返回在调用者的事务 tx 中执行写、改名和删除的 dbTarget, 可以将文件和业务数据在一个事务中提交。
+// 事务的提交和回滚由调用者负责，出错时调用者必须回滚 tx。 Read 也在 tx 中执行，能读到 tx 中没有提交的数据,
+// 读完之前不要提交或回滚 tx
+func (st *dbTarget) WithTx(tx *sql.Tx) *dbTarget {
+	bound := *st
+	bound.ownConn = false
+	bound.tx = tx
+	return &bound
+}
+
+// db 返回执行语句用的连接，绑定了调用者的事务时返回事务
+func (st *dbTarget) db() sqlConn {
+	if st.tx != nil {
+		return st.tx
+	}
+	return st.conn
+}
+
 type dbFileWriter struct {
 	st *dbTarget
 	tx *sql.Tx
 
-	uuid string
-	idx  int
+	uuid    string
+	idx     int
+	tracker *metaTracker
+	quota   int64 // 剩余的配额，小于 0 时没有配额
+	limit   int   // 块大小的上限, 见 StorageAdaptive
+	lo      largeObject
 
 	isCommited bool
 	lastError  error
@@ -157,6 +222,10 @@ func (w *dbFileWriter) Write(data []byte) (int, error) {
 	}
 
 	w.buffer = append(w.buffer, data...)
+	w.buffer, w.lastError = splitChunks(w.buffer, w.limit, w.write)
+	if w.lastError != nil {
+		return 0, w.lastError
+	}
 	return len(data), nil
 }
 
@@ -172,23 +241,55 @@ func (w *dbFileWriter) write(last bool, data []byte) error {
 		total = DataEnd
 	}
 
-	var err error
+	if err := useQuota(&w.quota, len(data)); err != nil {
+		return err
+	}
+	if w.tracker != nil {
+		w.tracker.add(data)
+	}
+	if w.st.opts.Storage == StorageLargeObject {
+		if err := writeLargeObject(w.execer(), w.st.stmts, &w.lo, w.uuid, w.idx == 0, last, data); err != nil {
+			return err
+		}
+		w.idx++
+		return w.writeMeta(last)
+	}
+	if w.idx == 0 {
+		if w.st.opts.Versioned {
+			if err := archiveVersion(w.execer(), w.st.stmts, w.st.opts, w.uuid); err != nil {
+				return err
+			}
+		}
+		if err := clearFile(w.execer(), w.st.stmts, w.st.opts, w.uuid); err != nil {
+			return err
+		}
+	}
+	if w.st.opts.Dedup {
+		if err := writeDedupChunk(w.execer(), w.st.stmts, w.st.opts, w.uuid, total, w.idx, data); err != nil {
+			return err
+		}
+		w.idx++
+		return w.writeMeta(last)
+	}
+
+	stored, encoding, err := encodeChunk(w.st.opts.Compression, data)
+	if err != nil {
+		return err
+	}
+	stored, keyID, err := sealChunk(w.st.opts.Keys, encoding, chunkBinding(w.uuid, w.idx), stored)
+	if err != nil {
+		return err
+	}
+
 	retried := false
 
 retry:
 
-	if w.tx != nil {
-		_, err = w.tx.Exec(w.st.insertSql, w.uuid, total, w.idx, data)
-	} else {
-		_, err = w.st.conn.Exec(w.st.insertSql, w.uuid, total, w.idx, data)
-	}
+	_, err = w.exec(w.st.stmts.insert, w.uuid, total, w.idx, stored, len(data), encoding, keyID, nil)
 	if err != nil {
-		if strings.Contains(err.Error(), "Error 1062") {
-			if w.tx != nil {
-				_, err = w.tx.Exec(w.st.deleteSqlByUUID, w.uuid)
-			} else {
-				_, err = w.st.conn.Exec(w.st.deleteSqlByUUID, w.uuid)
-			}
+		// 其它的连接同时写入了这个文件
+		if w.idx == 0 && w.st.dialect.isDuplicateKey(err) {
+			_, err = w.exec(w.st.stmts.deleteByUUID, w.uuid)
 			if err == nil {
 				if !retried {
 					retried = true
@@ -200,7 +301,36 @@ retry:
 		return err
 	}
 	w.idx++
-	return nil
+	return w.writeMeta(last)
+}
+
+// writeMeta 在写完最后一块后更新元数据和记录变更
+func (w *dbFileWriter) writeMeta(last bool) error {
+	if !last {
+		return nil
+	}
+	if w.tracker != nil {
+		if err := writeMeta(w.execer(), w.st.stmts, w.uuid, w.tracker.finish(w.idx)); err != nil {
+			return err
+		}
+	}
+	return logChange(w.execer(), w.st.stmts, w.st.opts, ChangeWrite, w.uuid)
+}
+
+func (w *dbFileWriter) execer() execer {
+	conn := w.st.db()
+	if w.tx != nil {
+		conn = w.tx
+	}
+	return sqlExecer{conn: conn, dialect: w.st.dialect}
+}
+
+func (w *dbFileWriter) exec(query string, args ...interface{}) (sql.Result, error) {
+	query = w.st.dialect.rebind(query)
+	if w.tx != nil {
+		return w.tx.Exec(query, args...)
+	}
+	return w.st.db().Exec(query, args...)
 }
 
 func (w *dbFileWriter) OneWrite(data []byte) error {
@@ -214,21 +344,49 @@ func (w *dbFileWriter) OneWrite(data []byte) error {
 		}
 		w.buffer = w.buffer[:0]
 	}
+	data, w.lastError = splitChunks(data, w.limit, w.write)
+	if w.lastError != nil {
+		return w.lastError
+	}
 	w.lastError = w.write(true, data)
 	return w.lastError
 }
 
 func (st *dbTarget) Write(remotePath string) (io.WriteCloser, error) {
-	tx, err := st.conn.Begin()
+	if err := checkStorage(st.dialect, st.opts); err != nil {
+		return nil, err
+	}
+	key := st.opts.key(remotePath)
+	quota, err := quotaLeft(st.execer(), st.stmts, st.opts, key)
 	if err != nil {
 		return nil, err
 	}
+	limit, err := chunkLimit(st.execer(), st.dialect, st.opts, st.maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// 绑定了调用者的事务时直接在它里面写，不提交
+	var tx *sql.Tx
+	if st.tx == nil {
+		tx, err = st.conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	var tracker *metaTracker
+	if st.opts.Metadata {
+		tracker = newMetaTracker(remotePath, FileMeta{})
+	}
 	return &dbFileWriter{
-		st:   st,
-		tx:   tx,
-		uuid: remotePath,
-		idx:  0,
+		st:      st,
+		tx:      tx,
+		uuid:    key,
+		idx:     0,
+		tracker: tracker,
+		quota:   quota,
+		limit:   limit,
 	}, nil
 }
 
@@ -245,147 +403,45 @@ func (st *dbTarget) WriteFile(remotePath string, data []byte) (reterr error) {
 	return w.(*dbFileWriter).OneWrite(data)
 }
 
-type dbFileReader struct {
-	rows *sql.Rows
-
-	lastErr error
-	lastIdx int
-	buffer  []byte
-	data    []byte
-}
-
-func (r *dbFileReader) Close() error {
-	err := r.rows.Close()
-	return err
-}
-
 var ErrIndexSequence = errors.New("index sequence is error")
 
-func (r *dbFileReader) Read(data []byte) (int, error) {
-	if r.lastErr != nil {
-		return 0, r.lastErr
-	}
-
-	if len(data) == 0 {
-		return 0, nil
-	}
-
-	for len(r.data) == 0 {
-		if !r.rows.Next() {
-			r.lastErr = r.rows.Err()
-			if r.lastErr != nil {
-				return 0, r.lastErr
-			}
-			r.lastErr = io.EOF
-			return 0, io.EOF
-		}
-
-		var id int64
-		var uuid string
-		var total sql.NullInt64
-		var idx int
-		var dbdata = r.buffer
-		var created sql.NullTime
-		if len(dbdata) > 0 {
-			dbdata = dbdata[:0]
-		}
-
-		r.lastErr = r.rows.Scan(&id, &uuid, &total, &idx, &dbdata, &created)
-		if r.lastErr != nil {
-			return 0, r.lastErr
-		}
-
-		if idx != r.lastIdx+1 {
-			return 0, ErrIndexSequence
-		}
-		r.lastIdx = idx
-
-		r.data = dbdata
-	}
-
-	if len(r.data) == 0 {
-		return 0, io.EOF
-	}
-
-	if len(r.data) > len(data) {
-		n := copy(data, r.data[:len(data)])
-		r.data = r.data[n:]
-		return n, nil
-	}
-
-	n := copy(data, r.data)
-	r.data = r.data[n:]
-	return n, nil
-}
-
-func (st *dbTarget) Read(remotePath string) (io.ReadCloser, error) {
-	rows, err := st.conn.Query(st.readSqlByUUID, remotePath)
-	if err != nil {
-		return nil, err
-	}
-	// defer rows.Close()
-
-	return &dbFileReader{
-		rows:    rows,
-		lastIdx: -1,
-
-		// lastErr error
-		// buffer []byte
-		// data []byte
-	}, nil
-}
-
 type fileStat struct {
 	name    string
+	isDir   bool
 	size    int64
 	modTime time.Time
+	meta    *FileMeta
 }
 
-func (fs *fileStat) Name() string       { return fs.name }
-func (fs *fileStat) IsDir() bool        { return false }
-func (fs *fileStat) Size() int64        { return fs.size }
-func (fs *fileStat) Mode() fs.FileMode  { return 0 }
-func (fs *fileStat) ModTime() time.Time { return fs.modTime }
-func (fs *fileStat) Sys() interface{}   { return nil }
-
-func (st *dbTarget) List(remotePath string) ([]fs.FileInfo, error) {
-	if remotePath != "" {
-		return nil, errors.New("remotePath must is empty")
+func (fs *fileStat) Name() string { return fs.name }
+func (fs *fileStat) IsDir() bool  { return fs.isDir }
+func (fs *fileStat) Size() int64  { return fs.size }
+func (fs *fileStat) Mode() fs.FileMode {
+	if fs.isDir {
+		return os.ModeDir | 0755
 	}
-
-	rows, err := st.conn.Query(st.listSql)
-	if err != nil {
-		return nil, err
+	if fs.meta != nil {
+		return fs.meta.Mode
 	}
-	defer rows.Close()
-
-	var list []fs.FileInfo
-	for rows.Next() {
-		var uuid string
-		var length sql.NullInt64
-		var created sql.NullTime
-
-		err = rows.Scan(&uuid, &length, &created)
-		if err != nil {
-			return nil, err
-		}
-
-		if !length.Valid {
-			length.Int64 = -1
-		}
-		list = append(list, &fileStat{
-			name:    uuid,
-			size:    length.Int64,
-			modTime: created.Time,
-		})
+	return 0
+}
+func (fs *fileStat) ModTime() time.Time { return fs.modTime }
+func (fs *fileStat) Sys() interface{} {
+	if fs.meta != nil {
+		return fs.meta
 	}
-	return list, rows.Err()
+	return nil
+}
+
+// List 返回目录下的文件和子目录，uuid 中用 / 分隔的部分被看作目录
+func (st *dbTarget) List(remotePath string) ([]fs.FileInfo, error) {
+	return listDir(st.execer(), st.stmts, st.dialect, st.opts.Metadata, st.opts.dir(remotePath))
 }
 
 func (st *dbTarget) Exists(pa string) (bool, error) {
 	var count = 0
 
-	err := st.conn.QueryRow(st.existSql, pa).Scan(&count)
+	err := st.db().QueryRow(st.dialect.rebind(st.stmts.exist), st.opts.key(pa)).Scan(&count)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -396,13 +452,85 @@ func (st *dbTarget) Exists(pa string) (bool, error) {
 }
 
 func (st *dbTarget) Rename(from, to string) error {
-	_, err := st.conn.Exec(st.renameSql, to, from)
-	return err
+	from, to = st.opts.key(from), st.opts.key(to)
+	if from == to {
+		return nil
+	}
+	return st.inTx(func(e execer) error {
+		return renameFile(e, st.stmts, st.opts, from, to)
+	})
+}
+
+// renameFile 在事务中将文件 from 改名为 to, from 和 to 是已经加上了命名空间的 uuid
+func renameFile(e execer, stmts *sqlStatements, opts DBOptions, from, to string) error {
+	count, err := e.exec(stmts.rename, to, from)
+	if err != nil {
+		return err
+	}
+	// 加密的块绑定了 uuid, 要重新加密
+	if err := resealFile(e, stmts, opts.Keys, from, to, false); err != nil {
+		return err
+	}
+	if opts.Metadata {
+		if _, err := e.exec(stmts.metaRename, to, from); err != nil {
+			return err
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if err := logChange(e, stmts, opts, ChangeDelete, from); err != nil {
+		return err
+	}
+	return logChange(e, stmts, opts, ChangeWrite, to)
 }
 
 func (st *dbTarget) Delete(remotePath string) error {
-	_, err := st.conn.Exec(st.deleteSqlByUUID, remotePath)
-	return err
+	remotePath = st.opts.key(remotePath)
+	conn := st.db()
+	var tx *sql.Tx
+	if st.tx == nil && (st.opts.Metadata || st.opts.Versioned || st.opts.Dedup || st.opts.ChangeFeed || st.opts.Storage == StorageLargeObject) {
+		var err error
+		tx, err = st.conn.Begin()
+		if err != nil {
+			return err
+		}
+		conn = tx
+	}
+	e := sqlExecer{conn: conn, dialect: st.dialect}
+
+	var err error
+	if st.opts.Versioned {
+		err = archiveVersion(e, st.stmts, st.opts, remotePath)
+	}
+	if err == nil {
+		err = releaseFile(e, st.stmts, st.opts, remotePath)
+	}
+	var count int64
+	if err == nil {
+		count, err = e.exec(st.stmts.deleteByUUID, remotePath)
+	}
+	if err == nil && st.opts.Metadata {
+		_, err = e.exec(st.stmts.metaDelete, remotePath)
+	}
+	if err == nil && count > 0 {
+		err = logChange(e, st.stmts, st.opts, ChangeDelete, remotePath)
+	}
+	if tx != nil {
+		if err != nil {
+			return joinError(err, tx.Rollback())
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return os.ErrNotExist
+	}
+	return nil
 }
 
 func joinError(err1, err2 error) error {
@@ -0,0 +1,2163 @@
+package scopy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newSQLiteTarget(t *testing.T, dbTable string, maxSize int) *dbTarget {
+	tmp, err := ioutil.TempDir("", "scopy_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(tmp)
+	})
+
+	target, err := DB("sqlite3", filepath.Join(tmp, "files.db"), dbTable, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		target.Close()
+	})
+	return target
+}
+
+func TestSQLite(t *testing.T) {
+	target := newSQLiteTarget(t, "", 0)
+	runTest(t, target)
+	runTest(t, target)
+}
+
+func TestSQLiteOpen(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	target, _, err := Open("db+sqlite3://"+filepath.ToSlash(filepath.Join(tmp, "files.db"))+"?sc_dbtable=abc&sc_dbmeta=true", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	runTest(t, target)
+	runTest(t, target)
+}
+
+func TestSQLiteChunks(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	if err := target.WriteFile("big.bin", big); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := target.Write("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(big); i += 100 {
+		end := i + 100
+		if end > len(big) {
+			end = len(big)
+		}
+		if _, err := w.Write(big[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := target.Read("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, big) {
+		t.Error("content is mismatch, got", len(bs), "bytes")
+	}
+
+	// 读的过程中文件被覆盖时返回错误，不会混合新旧的块
+	r, err = target.Read("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.WriteFile("big.bin", bytes.ToUpper(big)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Error("want io.ErrUnexpectedEOF, got", err)
+	}
+	r.Close()
+
+	// 覆盖为较小的文件
+	if err := target.WriteFile("big.bin", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = target.Read("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "small" {
+		t.Error("want small, got", len(bs), "bytes")
+	}
+
+	var count int
+	if err := target.conn.QueryRow("select count(*) from tpt_files where uuid = ?", "big.bin").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("want 1 chunk after overwrite, got", count)
+	}
+
+	fis, err := target.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "big.bin" || fis[0].ModTime().IsZero() {
+		t.Error("want big.bin, got", fis)
+	} else if fis[0].Size() != 5 {
+		t.Error("want 5, got", fis[0].Size())
+	}
+}
+
+func TestSQLiteErrors(t *testing.T) {
+	target := newSQLiteTarget(t, "", 0)
+
+	if err := target.WriteFile("a.txt", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := target.conn.Exec(target.stmts.insert, "a.txt", DataNone, 0, []byte("abc"), 3, EncodingNone, "", nil)
+	if !IsDuplicateKey(err) {
+		t.Error("want duplicate key error, got", err)
+	}
+
+	if err := target.Delete("a.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := target.Delete("a.txt"); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+	ok, err := DeleteFileIfExists(context.Background(), target, "a.txt")
+	if err != nil || ok {
+		t.Error("want false, got", ok, err)
+	}
+}
+
+func TestSQLiteDir(t *testing.T) {
+	target := newSQLiteTarget(t, "", 0)
+
+	for _, name := range []string{"a.txt", "d1/b.txt", "d1/d2/c.txt", "d1/f.txt", "d1x/e.txt", "d1/d2/d3/g.txt", "d1/d4/h.txt", "/d5/i.txt", "d_%/j.txt", "dd/k.txt"} {
+		if err := target.WriteFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(fis []fs.FileInfo) []string {
+		var results []string
+		for _, fi := range fis {
+			if fi.IsDir() {
+				results = append(results, fi.Name()+"/")
+			} else {
+				results = append(results, fi.Name())
+			}
+		}
+		return results
+	}
+
+	for _, test := range []struct {
+		dir    string
+		result []string
+	}{
+		{dir: "", result: []string{"a.txt", "d1/", "d1x/", "d5/", "d_%/", "dd/"}},
+		{dir: "d1", result: []string{"b.txt", "d2/", "d4/", "f.txt"}},
+		{dir: "d1/", result: []string{"b.txt", "d2/", "d4/", "f.txt"}},
+		{dir: "d1/d2", result: []string{"c.txt", "d3/"}},
+		{dir: "d_%", result: []string{"j.txt"}},
+		{dir: "d3", result: nil},
+	} {
+		fis, err := target.List(test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := names(fis); !reflect.DeepEqual(result, test.result) {
+			t.Error(test.dir, ": want", test.result, "got", result)
+		}
+	}
+
+	fis, err := Changedir(target, "d1").List("d2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := names(fis); !reflect.DeepEqual(result, []string{"c.txt", "d3/"}) {
+		t.Error("want [c.txt d3/], got", result)
+	}
+
+	tmp, err := ioutil.TempDir("", "scopy_sqlite_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var okFiles []File
+	err = DownloadDir(context.Background(), target, "d1", tmp, func(remote, local string) bool { return false }, &okFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(tmp, "d2", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "d1/d2/c.txt" {
+		t.Error("want d1/d2/c.txt, got", string(bs))
+	}
+	if len(okFiles) != 5 {
+		t.Error("want 5 files, got", okFiles)
+	}
+}
+
+func TestSQLiteMetadata(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	// 启用前写入的文件需要重建元数据
+	big := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	if err := target.WriteFile("d/old.bin", big); err != nil {
+		t.Fatal(err)
+	}
+	target.SetOptions(DBOptions{Metadata: true})
+	if err := target.RebuildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	w, err := target.WriteWithMeta("d/a.txt", FileMeta{ModTime: mtime, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := target.Stat("d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, ok := fi.Sys().(*FileMeta)
+	if !ok {
+		t.Fatalf("want *FileMeta, got %T", fi.Sys())
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	if fi.Size() != 5 || fi.Mode() != 0600 || !fi.ModTime().Equal(mtime) ||
+		meta.Chunks != 1 || meta.Hash != hex.EncodeToString(sum[:]) || meta.ContentType != mime.TypeByExtension(".txt") {
+		t.Errorf("unexpected meta: %+v", meta)
+	}
+
+	fi, err = target.Stat("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Error("want dir")
+	}
+	if _, err := target.Stat("nonexist"); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+
+	fis, err := target.List("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 || fis[0].Name() != "a.txt" || fis[1].Name() != "old.bin" {
+		t.Fatal("want [a.txt old.bin], got", fis)
+	}
+	if fis[1].Size() != int64(len(big)) || fis[1].Sys().(*FileMeta).Chunks != 1 {
+		t.Errorf("unexpected meta: %+v", fis[1].Sys())
+	}
+
+	if err := target.Rename("d/a.txt", "d/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Delete("d/old.bin"); err != nil {
+		t.Fatal(err)
+	}
+	fis, err = target.List("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "b.txt" || fis[0].Size() != 5 {
+		t.Error("want [b.txt], got", fis)
+	}
+}
+
+func TestSQLiteReadAhead(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	w, err := target.Write("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(big); i += 100 {
+		end := i + 100
+		if end > len(big) {
+			end = len(big)
+		}
+		if _, err := w.Write(big[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, readAhead := range []int{0, 1, 3} {
+		target.SetOptions(DBOptions{ReadAhead: readAhead})
+
+		r, err := target.Read("big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, big) {
+			t.Error(readAhead, ": content is mismatch, got", len(bs), "bytes")
+		}
+
+		// 没有读完就关闭
+		r, err = target.Read("big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := target.Read("nonexist"); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+}
+
+func TestSQLiteRandomAccess(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < 5; i++ {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: "f" + strconv.Itoa(i) + ".txt", Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte(strconv.Itoa(i)), 3000))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+
+	w, err := target.Write("a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(content); i += 100 {
+		end := i + 100
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := w.Write(content[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := target.Read("a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("want io.ReadSeeker")
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		t.Fatal("want io.ReaderAt")
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Fatal("want", len(content), "got", size)
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 5 {
+		t.Fatal("want 5 files, got", len(zr.File))
+	}
+	fr, err := zr.File[3].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(fr)
+	fr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, bytes.Repeat([]byte("3"), 3000)) {
+		t.Error("content of f3.txt is mismatch")
+	}
+
+	for _, offset := range []int64{0, 1023, 1024, 5000, size - 10} {
+		if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		bs := make([]byte, 10)
+		if _, err := io.ReadFull(rs, bs); err != nil {
+			t.Fatal(offset, err)
+		}
+		if !bytes.Equal(bs, content[offset:offset+10]) {
+			t.Error(offset, ": content is mismatch")
+		}
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/a.zip", nil)
+	req.Header.Set("Range", "bytes=2000-2999")
+	resp := httptest.NewRecorder()
+	http.ServeContent(resp, req, "a.zip", time.Time{}, rs)
+	if resp.Code != http.StatusPartialContent {
+		t.Fatal("want 206, got", resp.Code)
+	}
+	if !bytes.Equal(resp.Body.Bytes(), content[2000:3000]) {
+		t.Error("range content is mismatch")
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	target := newSQLiteTarget(t, "", 0)
+
+	if err := target.DropSchema(); err != nil {
+		t.Fatal(err)
+	}
+	version, err := target.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Error("want 0, got", version)
+	}
+
+	if err := target.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟旧版本写入的数据
+	_, err = target.conn.Exec("insert into tpt_files(uuid, partitioning_count, partitioning_sequence, data, created_at) values(?, ?, ?, ?, ?)",
+		"a.txt", DataNone, 0, []byte("abc"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 版本 4 用已有的文件初始化元数据表，这时还没有 data_size 列
+	checkSize := func() {
+		var size int64
+		if err := target.conn.QueryRow("select size from tpt_files_meta where uuid = ?", "a.txt").Scan(&size); err != nil {
+			t.Fatal(err)
+		}
+		if size != 3 {
+			t.Error("want 3, got", size)
+		}
+	}
+	if err := target.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	checkSize()
+
+	if err := target.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	checkSize()
+	version, err = target.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Error("want", LatestSchemaVersion(), "got", version)
+	}
+	if err := target.Migrate(1); err == nil {
+		t.Error("want error when downgrade")
+	}
+
+	r, err := target.Read("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "abc" {
+		t.Error("want abc, got", string(bs))
+	}
+}
+
+// 版本中的一个语句失败时整个版本被回滚，修复后可以再次升级
+func TestSQLiteMigrateRollback(t *testing.T) {
+	target := newSQLiteTarget(t, "", 0)
+	if err := target.DropSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Migrate(6); err != nil {
+		t.Fatal(err)
+	}
+
+	// 版本 7 在文件表和历史版本表上都增加 encoding 列，让第二个语句失败
+	if _, err := target.conn.Exec("alter table tpt_files_versions rename to tpt_files_versions_bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Migrate(7); err == nil {
+		t.Fatal("want error")
+	}
+	if version, err := target.SchemaVersion(); err != nil || version != 6 {
+		t.Error("want 6, got", version, err)
+	}
+	if _, err := target.conn.Exec("select encoding from tpt_files"); err == nil {
+		t.Error("encoding column of tpt_files should be rolled back")
+	}
+
+	if _, err := target.conn.Exec("alter table tpt_files_versions_bak rename to tpt_files_versions"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := target.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+		t.Error("want", LatestSchemaVersion(), "got", version, err)
+	}
+}
+
+func readVersion(t *testing.T, target *dbTarget, remotePath string, version int) string {
+	t.Helper()
+	r, err := target.ReadVersion(remotePath, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestSQLiteVersions(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true, Versioned: true})
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	for _, content := range [][]byte{[]byte("v1"), big, []byte("v3")} {
+		w, err := target.Write("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(content); i += 100 {
+			end := i + 100
+			if end > len(content) {
+				end = len(content)
+			}
+			w.Write(content[i:end])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := target.ListVersions("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Version != 1 || versions[1].Size != int64(len(big)) ||
+		!versions[2].Current || versions[2].Version != 3 || versions[2].Size != 2 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	if s := readVersion(t, target, "a.txt", 1); s != "v1" {
+		t.Error("want v1, got", s)
+	}
+	if s := readVersion(t, target, "a.txt", 2); s != string(big) {
+		t.Error("want big file, got", len(s))
+	}
+	if s := readVersion(t, target, "a.txt", 3); s != "v3" {
+		t.Error("want v3, got", s)
+	}
+	if _, err := target.ReadVersion("a.txt", 9); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+
+	if err := target.RestoreVersion("a.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+	if s := readVersion(t, target, "a.txt", 4); s != "v1" {
+		t.Error("want v1, got", s)
+	}
+	fi, err := target.Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 2 {
+		t.Error("want 2, got", fi.Size())
+	}
+	if err := target.RestoreVersion("a.txt", 9); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+
+	// 删除的文件也可以恢复
+	if err := target.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = target.ListVersions("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || versions[3].Current {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	if err := target.RestoreVersion("a.txt", 3); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := target.Exists("a.txt"); err != nil || !exists {
+		t.Error("want exists, got", exists, err)
+	}
+
+	count, err := target.PruneVersions("", 2, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("want versions pruned")
+	}
+	versions, err = target.ListVersions("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Version != 3 || versions[2].Version != 5 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	if _, err := target.PruneVersions("a.txt", 0, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = target.ListVersions("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || !versions[0].Current || versions[0].Version != 1 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+}
+
+func TestSQLiteGC(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true})
+
+	old := target.dialect.timeValue(time.Now().Add(-48 * time.Hour))
+	insert := func(uuid string, count, seq int, data string) {
+		t.Helper()
+		_, err := target.conn.Exec("insert into tpt_files(uuid, partitioning_count, partitioning_sequence, data, data_size, created_at) values(?, ?, ?, ?, ?, ?)",
+			uuid, count, seq, []byte(data), len(data), old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 中断的写入留下的块
+	insert("broken.txt", DataStart, 0, "abc")
+	insert("broken.txt", DataEnd, 1, "def")
+	// 过期的文件
+	insert("old1.txt", DataNone, 0, "old1")
+	insert("old2.txt", DataStart, 0, "old2")
+	insert("old2.txt", DataNone, 1, "old2")
+	if err := target.RebuildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := target.WriteFile(name, bytes.Repeat([]byte("x"), 100)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	result, err := target.GC(GCOptions{Retention: 24 * time.Hour, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Incomplete != 1 || result.Files != 2 || result.Bytes != 18 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	result, err = target.GC(GCOptions{MaxTotalSize: 150, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 2 || result.Bytes != 200 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	fis, err := target.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "c.txt" {
+		t.Error("want [c.txt], got", fis)
+	}
+	if exists, err := target.Exists("broken.txt"); err != nil || exists {
+		t.Error("want not exists, got", exists, err)
+	}
+}
+
+// 文件的时间是数据库写入的，GC 和清理历史版本时也要用数据库的时间比较，调用者在其它时区时结果也一样
+func TestSQLiteServerClock(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Versioned: true, ChangeFeed: true})
+	zone := time.FixedZone("UTC+8", 8*60*60)
+
+	for _, name := range []string{"old.txt", "new.txt", "new.txt"} {
+		if err := target.WriteFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, table := range []string{"tpt_files", "tpt_files_changes"} {
+		_, err := target.conn.Exec("update "+table+" set created_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now', '-2 hours') where uuid = ?", "old.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count, err := target.PruneVersions("", 0, time.Now().In(zone).Add(-time.Minute)); err != nil || count != 0 {
+		t.Error("want 0, got", count, err)
+	}
+	if count, err := target.PruneVersions("", 0, time.Now().In(zone).Add(time.Minute)); err != nil || count != 1 {
+		t.Error("want 1, got", count, err)
+	}
+
+	result, err := target.GC(GCOptions{Retention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 1 || result.Changes != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if exists, err := target.Exists("new.txt"); err != nil || !exists {
+		t.Error("want new.txt exists, got", exists, err)
+	}
+	if exists, err := target.Exists("old.txt"); err != nil || exists {
+		t.Error("want old.txt deleted, got", exists, err)
+	}
+}
+
+func TestSQLiteFsck(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true})
+
+	insert := func(uuid string, count, seq int, data string) {
+		t.Helper()
+		_, err := target.conn.Exec("insert into tpt_files(uuid, partitioning_count, partitioning_sequence, data, data_size, created_at) values(?, ?, ?, ?, ?, ?)",
+			uuid, count, seq, []byte(data), len(data), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("d/gap.txt", DataStart, 0, "abc")
+	insert("d/gap.txt", DataNone, 2, "def")
+	insert("d/nofinal.txt", DataStart, 0, "abc")
+	insert("d/zero.txt", DataStart, 0, "abc")
+	insert("d/zero.txt", DataNone, 1, "")
+	insert("d/empty.txt", DataNone, 0, "")
+	if err := target.RebuildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.WriteFile("d/good.txt", []byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.WriteFile("d/bad.txt", []byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.conn.Exec("update tpt_files set data = ? where uuid = ?", []byte("evil"), "d/bad.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := target.Fsck(FsckOptions{Dir: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 ||
+		files[0].Path != "d/gap.txt" || files[0].Problems != FsckMissingSequence ||
+		files[1].Path != "d/nofinal.txt" || files[1].Problems != FsckMissingFinal ||
+		files[2].Path != "d/zero.txt" || files[2].Problems != FsckZeroLength {
+		t.Fatalf("unexpected result: %+v", files)
+	}
+
+	files, err = target.Fsck(FsckOptions{Checksum: true, Repair: FsckQuarantine})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 || files[0].Path != "d/bad.txt" || files[0].Problems != FsckChecksum || !files[0].Repaired {
+		t.Fatalf("unexpected result: %+v", files)
+	}
+	fis, err := target.List(DefaultQuarantineDir + "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 4 {
+		t.Error("want 4 quarantined files, got", fis)
+	}
+
+	files, err = target.Fsck(FsckOptions{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("unexpected result: %+v", files)
+	}
+
+	files, err = target.Fsck(FsckOptions{Dir: DefaultQuarantineDir, QuarantineDir: "other", Repair: FsckDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("unexpected result: %+v", files)
+	}
+	fis, err = target.List(DefaultQuarantineDir + "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "bad.txt" {
+		t.Error("want [bad.txt], got", fis)
+	}
+}
+
+func TestSQLiteCompression(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	content := bytes.Repeat([]byte("id,name,value\n1,abc,123\n"), 200)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		target.SetOptions(DBOptions{Compression: encoding, Metadata: true})
+		name := encoding + ".csv"
+
+		w, err := target.Write(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(content); i += 400 {
+			w.Write(content[i : i+400])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var stored, chunks int64
+		err = target.conn.QueryRow("select sum(length(data)), count(*) from tpt_files where uuid = ? and encoding = ?", name, encoding).Scan(&stored, &chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunks < 2 || stored >= int64(len(content))/2 {
+			t.Errorf("%s: want compressed chunks, got %d chunks and %d bytes", encoding, chunks, stored)
+		}
+
+		fi, err := target.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("%s: want size %d, got %d", encoding, len(content), fi.Size())
+		}
+
+		// 没有压缩的块也可以读
+		var offset, size int
+		err = target.conn.QueryRow("select data_size from tpt_files where uuid = ? and partitioning_sequence = 0", name).Scan(&offset)
+		if err == nil {
+			err = target.conn.QueryRow("select data_size from tpt_files where uuid = ? and partitioning_sequence = 1", name).Scan(&size)
+		}
+		if err == nil {
+			_, err = target.conn.Exec("update tpt_files set data = ?, encoding = NULL where uuid = ? and partitioning_sequence = 1",
+				content[offset:offset+size], name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := target.Read(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, content) {
+			t.Errorf("%s: content mismatch, got %d bytes", encoding, len(bs))
+		}
+	}
+
+	// 不能压缩的数据保存为原始数据
+	target.SetOptions(DBOptions{Compression: EncodingGzip})
+	if err := target.WriteFile("small.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	var encoding sql.NullString
+	if err := target.conn.QueryRow("select encoding from tpt_files where uuid = ?", "small.txt").Scan(&encoding); err != nil {
+		t.Fatal(err)
+	}
+	if encoding.String != EncodingNone {
+		t.Error("want no compression, got", encoding.String)
+	}
+}
+
+func readAll(t *testing.T, target *dbTarget, remotePath string) ([]byte, error) {
+	t.Helper()
+	r, err := target.Read(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestSQLiteEncryption(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	secret := bytes.Repeat([]byte("secret text "), 300)
+	if err := target.WriteFile("plain.txt", secret); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	target.SetOptions(DBOptions{Keys: keys, Compression: EncodingGzip})
+	w, err := target.Write("enc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(secret); i += 600 {
+		w.Write(secret[i : i+600])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []byte
+	var keyID string
+	if err := target.conn.QueryRow("select data, key_id from tpt_files where uuid = ? and partitioning_sequence = 0", "enc.txt").Scan(&stored, &keyID); err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "k1"+boundKeySuffix || bytes.Contains(stored, []byte("secret")) {
+		t.Errorf("want encrypted chunk, got key %q", keyID)
+	}
+
+	bs, err := readAll(t, target, "enc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, secret) {
+		t.Error("content mismatch")
+	}
+
+	// 没有密钥时不能读
+	target.SetOptions(DBOptions{})
+	if _, err := readAll(t, target, "enc.txt"); err != ErrNoKeyProvider {
+		t.Error("want ErrNoKeyProvider, got", err)
+	}
+
+	// 轮换密钥
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = "k2"
+	target.SetOptions(DBOptions{Keys: keys})
+	count, err := target.ReEncrypt(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks int64
+	if err := target.conn.QueryRow("select count(*) from tpt_files").Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if count != chunks {
+		t.Errorf("want %d chunks, got %d", chunks, count)
+	}
+	delete(keys.Keys, "k1")
+	for _, name := range []string{"plain.txt", "enc.txt"} {
+		bs, err := readAll(t, target, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(bs, secret) {
+			t.Error(name, ": content mismatch")
+		}
+	}
+
+	// 篡改的块不能读
+	if _, err := target.conn.Exec("update tpt_files set data = ? where uuid = ? and partitioning_sequence = 0", append(stored[:len(stored)-1:len(stored)-1], 0), "enc.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(t, target, "enc.txt"); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestSQLiteEncryptionBinding(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	target.SetOptions(DBOptions{Keys: keys})
+
+	content := bytes.Repeat([]byte("0123456789"), 250)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := target.Write(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(content); i += 1000 {
+			end := i + 1000
+			if end > len(content) {
+				end = len(content)
+			}
+			if _, err := w.Write(content[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 改名和复制后重新绑定了 uuid
+	if err := target.Rename("a.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Copy("c.txt", "d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c.txt", "d.txt"} {
+		bs, err := readAll(t, target, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(bs, content) {
+			t.Error(name, ": content mismatch")
+		}
+	}
+
+	chunk := func(name string, seq int) []byte {
+		t.Helper()
+		var data []byte
+		if err := target.conn.QueryRow("select data from tpt_files where uuid = ? and partitioning_sequence = ?", name, seq).Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	replace := func(name string, seq int, data []byte) {
+		t.Helper()
+		if _, err := target.conn.Exec("update tpt_files set data = ? where uuid = ? and partitioning_sequence = ?", data, name, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 其它文件的块和同一个文件的其它位置的块都不能解密
+	replace("d.txt", 0, chunk("b.txt", 0))
+	if _, err := readAll(t, target, "d.txt"); err == nil {
+		t.Error("want error for a chunk from another file")
+	}
+	first, second := chunk("b.txt", 0), chunk("b.txt", 1)
+	replace("b.txt", 0, second)
+	replace("b.txt", 1, first)
+	if _, err := readAll(t, target, "b.txt"); err == nil {
+		t.Error("want error for swapped chunks")
+	}
+
+	// 之前的格式的块只绑定了压缩算法，仍然可以读，ReEncrypt 将它改为新的格式
+	gcm, err := newGCM(keys.Keys["k1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if err := target.conn.QueryRow("select data_size from tpt_files where uuid = ? and partitioning_sequence = 0", "c.txt").Scan(&size); err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := gcm.Seal(nonce, nonce, content[:size], []byte(EncodingNone))
+	if _, err := target.conn.Exec("update tpt_files set data = ?, key_id = ? where uuid = ? and partitioning_sequence = 0", legacy, "k1", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := readAll(t, target, "c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, content) {
+		t.Error("content mismatch")
+	}
+	replace("b.txt", 0, first)
+	replace("b.txt", 1, second)
+	replace("d.txt", 0, legacy)
+	if _, err := target.conn.Exec("update tpt_files set key_id = ? where uuid = ? and partitioning_sequence = 0", "k1", "d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	count, err := target.ReEncrypt(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want 2 chunks, got %d", count)
+	}
+	for _, name := range []string{"b.txt", "c.txt", "d.txt"} {
+		bs, err := readAll(t, target, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(bs, content) {
+			t.Error(name, ": content mismatch")
+		}
+	}
+}
+
+func TestSQLiteDedup(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true, Versioned: true, Dedup: true, Compression: EncodingGzip})
+
+	blobs := func() (count, refs int64) {
+		t.Helper()
+		if err := target.conn.QueryRow("select count(*), coalesce(sum(refcount), 0) from tpt_files_blobs").Scan(&count, &refs); err != nil {
+			t.Fatal(err)
+		}
+		return count, refs
+	}
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		w, err := target.Write(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(content); i += 400 {
+			end := i + 400
+			if end > len(content) {
+				end = len(content)
+			}
+			w.Write(content[i:end])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, refs := blobs()
+	var chunks int64
+	if err := target.conn.QueryRow("select count(*) from tpt_files").Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if count*3 != chunks || refs != chunks {
+		t.Fatalf("want %d blobs with %d refs, got %d blobs with %d refs", chunks/3, chunks, count, refs)
+	}
+
+	// 复制和改名只修改引用
+	size, err := target.Copy("a.txt", "d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("want size %d, got %d", len(content), size)
+	}
+	if err := target.Rename("b.txt", "e.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Copy("notexist.txt", "f.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("want ErrNotExist, got", err)
+	}
+	if _, err := target.Copy("a.txt", "a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Error("want ErrInvalid, got", err)
+	}
+	if bs, err := readAll(t, target, "a.txt"); err != nil || !bytes.Equal(bs, content) {
+		t.Error("want a.txt unchanged", err)
+	}
+	if n, _ := blobs(); n != count {
+		t.Errorf("want %d blobs, got %d", count, n)
+	}
+
+	files, err := target.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("want 4 files, got %d", len(files))
+	}
+	for _, fi := range files {
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("%s: want size %d, got %d", fi.Name(), len(content), fi.Size())
+		}
+		bs, err := readAll(t, target, fi.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, content) {
+			t.Error(fi.Name(), ": content mismatch")
+		}
+	}
+
+	// 覆盖时旧的内容保存为历史版本，blob 仍然被引用
+	if err := target.WriteFile("a.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.RestoreVersion("a.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := readAll(t, target, "a.txt"); err != nil || !bytes.Equal(bs, content) {
+		t.Error("restore: content mismatch", err)
+	}
+
+	for _, name := range []string{"a.txt", "c.txt", "d.txt", "e.txt"} {
+		if err := target.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := target.PruneVersions("", 0, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, refs := blobs(); refs != 0 {
+		t.Errorf("want 0 refs, got %d", refs)
+	}
+	result, err := target.GC(GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Blobs != count+1 {
+		t.Errorf("want %d blobs deleted, got %+v", count+1, result)
+	}
+	if n, _ := blobs(); n != 0 {
+		t.Errorf("want no blobs, got %d", n)
+	}
+}
+
+func TestSQLiteDedupConcurrentBlob(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Dedup: true})
+
+	// 两个连接都没有找到 blob 后同时插入，第二次插入只增加引用计数，事务仍然可以提交
+	tx, err := target.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for i := 0; i < 2; i++ {
+		if _, err := tx.Exec(target.stmts.blobInsert, "h", []byte("abc"), 3, EncodingNone, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var refs int64
+	if err := target.conn.QueryRow("select refcount from tpt_files_blobs where hash = 'h'").Scan(&refs); err != nil {
+		t.Fatal(err)
+	}
+	if refs != 2 {
+		t.Error("want 2 refs, got", refs)
+	}
+}
+
+// 启用加密时 blob 的 hash 不是明文的 sha256
+func TestSQLiteDedupEncrypted(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Dedup: true, Keys: &StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}})
+
+	content := []byte("guessable content")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := target.WriteFile(name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int64
+	var hash string
+	if err := target.conn.QueryRow("select count(*), max(hash) from tpt_files_blobs").Scan(&count, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("want 1 blob, got %d", count)
+	}
+	sum := sha256.Sum256(content)
+	if hash == hex.EncodeToString(sum[:]) {
+		t.Error("want a keyed hash, got the sha256 of the content")
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		bs, err := readAll(t, target, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(bs, content) {
+			t.Error(name, ": content mismatch")
+		}
+	}
+}
+
+func TestSQLiteMapping(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dbfile := filepath.Join(tmp, "files.db")
+
+	// 已有的表，列名和默认的不一样
+	conn, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`CREATE TABLE legacy (
+  fid          INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id    varchar(20) NOT NULL,
+  file_name    varchar(200) NOT NULL,
+  chunk_count  int,
+  chunk_seq    int,
+  content      blob,
+  ts           varchar(30),
+
+  unique(tenant_id, file_name, chunk_seq)
+)`)
+	if err == nil {
+		_, err = conn.Exec("insert into legacy(tenant_id, file_name, chunk_count, chunk_seq, content, ts) values('b', 'b.txt', 0, 0, 'bbb', '2020-01-01T00:00:00.000Z')")
+	}
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := "&sc_dbcolumn_id=fid&sc_dbcolumn_uuid=file_name&sc_dbcolumn_partitioning_count=chunk_count" +
+		"&sc_dbcolumn_partitioning_sequence=chunk_seq&sc_dbcolumn_data=content&sc_dbcolumn_created_at=ts"
+	open := func(tenant string) Session {
+		t.Helper()
+		sess, _, err := Open("db+sqlite3://"+filepath.ToSlash(dbfile)+"?sc_dbtable=legacy"+columns+"&sc_dbextra_tenant_id="+tenant, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			sess.Close()
+		})
+		return sess
+	}
+
+	a := open("a")
+	runTest(t, a)
+
+	b := open("b")
+	files, err := b.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "b.txt" || files[0].Size() != 3 {
+		t.Fatalf("want b.txt only, got %v", files)
+	}
+	if exists, err := a.Exists("b.txt"); err != nil || exists {
+		t.Error("want b.txt not exists in tenant a", err)
+	}
+
+	if err := a.WriteFile("same.txt", []byte("aaa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteFile("same.txt", []byte("bbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete("same.txt"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Read("same.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(bs) != "bbbbb" {
+		t.Errorf("want bbbbb, got %q %v", bs, err)
+	}
+
+	if _, _, err := Open("db+sqlite3://"+filepath.ToSlash(dbfile)+"?sc_dbcolumn_name=x", "", ""); err == nil {
+		t.Error("want error for unknown column")
+	}
+}
+
+func TestSQLiteQueue(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true})
+
+	if _, err := target.Claim(ClaimOptions{}); err != ErrQueueEmpty {
+		t.Fatal("want ErrQueueEmpty, got", err)
+	}
+
+	for _, name := range []string{"in/1.txt", "in/2.txt", "other/3.txt"} {
+		if err := target.WriteFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 没有写完的文件不会被取走
+	if _, err := target.conn.Exec("insert into tpt_files(uuid, partitioning_count, partitioning_sequence, data, data_size, created_at) values('in/0.txt', ?, 0, 'abc', 3, '2000-01-01T00:00:00.000Z')", DataStart); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := target.Claim(ClaimOptions{Consumer: "c1", Dir: "in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := target.Claim(ClaimOptions{Consumer: "c2", Dir: "in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name != "in/1.txt" || second.Name != "in/2.txt" || first.Size != 8 {
+		t.Fatalf("unexpected claims: %+v, %+v", first, second)
+	}
+	if _, err := target.Claim(ClaimOptions{Dir: "in"}); err != ErrQueueEmpty {
+		t.Fatal("want ErrQueueEmpty, got", err)
+	}
+
+	r, err := first.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(bs) != "in/1.txt" {
+		t.Errorf("want in/1.txt, got %q %v", bs, err)
+	}
+	if err := first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := target.Exists("in/1.txt"); exists {
+		t.Error("want in/1.txt deleted")
+	}
+
+	// 放回队列后可以再次取走
+	if err := second.Release(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := target.Claim(ClaimOptions{Dir: "in", Timeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Name != "in/2.txt" {
+		t.Fatalf("want in/2.txt, got %s", again.Name)
+	}
+	if err := second.Ack(); err != ErrClaimLost {
+		t.Error("want ErrClaimLost, got", err)
+	}
+
+	// 消费者崩溃后，超时的文件可以被其它消费者取走
+	time.Sleep(20 * time.Millisecond)
+	taken, err := target.Claim(ClaimOptions{Dir: "in", Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken.Name != "in/2.txt" {
+		t.Fatalf("want in/2.txt, got %s", taken.Name)
+	}
+	if err := again.Extend(); err != ErrClaimLost {
+		t.Error("want ErrClaimLost, got", err)
+	}
+	if err := taken.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := target.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "other" {
+		t.Errorf("want other only, got %v", files)
+	}
+}
+
+// 取走文件的时间是数据库写入的，超时也按数据库的时间计算
+func TestSQLiteQueueServerClock(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+
+	if err := target.WriteFile("in/1.txt", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	first, err := target.Claim(ClaimOptions{Consumer: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.conn.Exec("update tpt_files set claimed_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now', '-2 hours') where uuid = ?", "in/1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := target.Claim(ClaimOptions{Timeout: 3 * time.Hour}); err != ErrQueueEmpty {
+		t.Error("want ErrQueueEmpty, got", err)
+	}
+	second, err := target.Claim(ClaimOptions{Consumer: "c2", Timeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Name != "in/1.txt" {
+		t.Errorf("want in/1.txt, got %s", second.Name)
+	}
+	if err := first.Ack(); err != ErrClaimLost {
+		t.Error("want ErrClaimLost, got", err)
+	}
+}
+
+func TestSQLiteTx(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "scopy_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	conn, err := sql.Open("sqlite3", filepath.Join(tmp, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec("CREATE TABLE orders (id int, pdf varchar(200))"); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := DBConn(conn, "sqlite3", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.SetOptions(DBOptions{Metadata: true})
+
+	order := func(commit bool) {
+		t.Helper()
+		tx, err := conn.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("insert into orders(id, pdf) values(1, 'orders/1.pdf')"); err != nil {
+			t.Fatal(err)
+		}
+		bound := target.WithTx(tx)
+		if err := bound.WriteFile("orders/1.tmp", []byte("%PDF-1.4")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bound.Rename("orders/1.tmp", "orders/1.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		if exists, err := bound.Exists("orders/1.pdf"); err != nil || !exists {
+			t.Fatal("want orders/1.pdf exists in tx", err)
+		}
+		// 在事务中能读到事务中写入的数据
+		bs, err := readAll(t, bound, "orders/1.pdf")
+		if err != nil || string(bs) != "%PDF-1.4" {
+			t.Fatalf("want %%PDF-1.4 in tx, got %q %v", bs, err)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order(false)
+	if exists, err := target.Exists("orders/1.pdf"); err != nil || exists {
+		t.Fatal("want orders/1.pdf not exists after rollback", err)
+	}
+
+	order(true)
+	var count int
+	if err := conn.QueryRow("select count(*) from orders").Scan(&count); err != nil || count != 1 {
+		t.Fatal("want 1 order, got", count, err)
+	}
+	bs, err := readAll(t, target, "orders/1.pdf")
+	if err != nil || string(bs) != "%PDF-1.4" {
+		t.Fatalf("want %%PDF-1.4, got %q %v", bs, err)
+	}
+	fi, err := target.Stat("orders/1.pdf")
+	if err != nil || fi.Size() != 8 {
+		t.Fatal("want meta of orders/1.pdf", err)
+	}
+
+	// 删除在事务回滚后无效
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.WithTx(tx).Delete("orders/1.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := target.Exists("orders/1.pdf"); err != nil || !exists {
+		t.Fatal("want orders/1.pdf exists after rollback", err)
+	}
+
+	// Close 不关闭调用者的连接池
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteBatch(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true})
+	if err := target.WriteFile("export/old.csv", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(commit bool) error {
+		t.Helper()
+		batch, err := target.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := batch.Write("export/data.csv.tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			w.Write(bytes.Repeat([]byte("1,2,3\n"), 200))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Rename("export/data.csv.tmp", "export/data.csv"); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.WriteFile("export/index.json", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Delete("export/old.csv"); err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := batch.Write("export/manifest.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Write([]byte(`{"files": 2}`))
+		if !commit {
+			return batch.Rollback()
+		}
+		if err := manifest.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Commit(); err != nil {
+			return err
+		}
+		if err := batch.Commit(); err != ErrBatchDone {
+			t.Error("want ErrBatchDone, got", err)
+		}
+		return nil
+	}
+	names := func() []string {
+		t.Helper()
+		files, err := target.List("export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	if err := export(false); err != nil {
+		t.Fatal(err)
+	}
+	if list := names(); !reflect.DeepEqual(list, []string{"old.csv"}) {
+		t.Fatalf("want old.csv only after rollback, got %v", list)
+	}
+
+	if err := export(true); err != nil {
+		t.Fatal(err)
+	}
+	if list := names(); !reflect.DeepEqual(list, []string{"data.csv", "index.json", "manifest.json"}) {
+		t.Fatalf("unexpected files after commit: %v", list)
+	}
+
+	// 有没有关闭的成员文件时 Commit 会回滚
+	batch, err := target.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete("export/data.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Write("export/open.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err == nil {
+		t.Fatal("want error")
+	}
+	if exists, _ := target.Exists("export/data.csv"); !exists {
+		t.Error("want export/data.csv exists")
+	}
+}
+
+func TestSQLiteChanges(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Metadata: true, ChangeFeed: true})
+
+	it, err := target.Watch(-1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := target.WriteFile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Rename("a.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Delete("notexist.txt"); err == nil {
+		t.Fatal("want error")
+	}
+
+	changes, err := target.Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Op+" "+c.Path)
+	}
+	want := []string{"write a.txt", "write b.txt", "delete a.txt", "write c.txt", "delete b.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if changes, err := target.Changes(changes[1].ID, 2); err != nil || len(changes) != 2 || changes[0].Path != "a.txt" {
+		t.Errorf("unexpected changes after cursor: %v %v", changes, err)
+	}
+
+	// 迭代器从创建时最新的变更之后开始
+	for _, w := range want {
+		c, err := it.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Op+" "+c.Path != w {
+			t.Errorf("want %s, got %s %s", w, c.Op, c.Path)
+		}
+	}
+	if it.Cursor() != changes[len(changes)-1].ID {
+		t.Errorf("want cursor %d, got %d", changes[len(changes)-1].ID, it.Cursor())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = it.Next(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatal("want DeadlineExceeded, got", err)
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		target.WriteFile("d.txt", []byte("d"))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := it.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Op != ChangeWrite || c.Path != "d.txt" {
+		t.Errorf("want write d.txt, got %s %s", c.Op, c.Path)
+	}
+}
+
+// 模拟两个交错的事务: 事务 A 先分配到 id 2, 事务 B 分配到 id 3 并先提交
+func TestSQLiteChangesLateCommit(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{ChangeFeed: true})
+
+	it, err := target.Watch(-1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(id int64, name string) {
+		t.Helper()
+		if _, err := target.conn.Exec("insert into tpt_files_changes(id, uuid, op, created_at) values(?, ?, ?, ?)", id, name, ChangeWrite, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func(want string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := it.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Path != want {
+			t.Errorf("want %s, got %s", want, c.Path)
+		}
+	}
+
+	last, err := lastChange(target.execer(), target.stmts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(last+2, "b.txt")
+	next("a.txt")
+	next("b.txt")
+	if it.Cursor() != last {
+		t.Errorf("want cursor %d before the late change, got %d", last, it.Cursor())
+	}
+
+	commit(last+1, "c.txt")
+	next("c.txt")
+	if it.Cursor() != last+2 {
+		t.Errorf("want cursor %d, got %d", last+2, it.Cursor())
+	}
+
+	// 回滚的事务跳过的 id 超时后不再查找
+	commit(last+4, "d.txt")
+	next("d.txt")
+	it.gapTimeout = time.Nanosecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := it.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatal("want DeadlineExceeded, got", err)
+	}
+	if len(it.gaps) != 0 || it.Cursor() != last+4 {
+		t.Errorf("want no gaps and cursor %d, got %v %d", last+4, it.gaps, it.Cursor())
+	}
+}
+
+func TestSQLiteNamespace(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	tenant := func(ns string, quota int64) *dbTarget {
+		st := *target
+		st.SetOptions(DBOptions{Metadata: true, Versioned: true, ChangeFeed: true, Namespace: ns, Quota: quota})
+		return &st
+	}
+	a, b := tenant("a", 0), tenant("b", 0)
+
+	for _, f := range []struct {
+		st   *dbTarget
+		name string
+		data string
+	}{
+		{a, "x.txt", "a-x"},
+		{a, "dir/y.txt", "a-y"},
+		{b, "x.txt", "b-x"},
+		{a, "x.txt", "a-x2"},
+	} {
+		if err := f.st.WriteFile(f.name, []byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bs, err := readAll(t, a, "x.txt"); err != nil || string(bs) != "a-x2" {
+		t.Errorf("want a-x2, got %q %v", bs, err)
+	}
+	if bs, err := readAll(t, b, "x.txt"); err != nil || string(bs) != "b-x" {
+		t.Errorf("want b-x, got %q %v", bs, err)
+	}
+
+	names := func(st *dbTarget, dir string) []string {
+		list, err := st.List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range list {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	if got := names(a, ""); !reflect.DeepEqual(got, []string{"dir", "x.txt"}) {
+		t.Errorf("want [dir x.txt], got %v", got)
+	}
+	if got := names(b, "/"); !reflect.DeepEqual(got, []string{"x.txt"}) {
+		t.Errorf("want [x.txt], got %v", got)
+	}
+	if got := names(a, "dir"); !reflect.DeepEqual(got, []string{"y.txt"}) {
+		t.Errorf("want [y.txt], got %v", got)
+	}
+	// 没有命名空间时看到的是整个表
+	if got := names(target, ""); !reflect.DeepEqual(got, []string{"@a", "@b"}) {
+		t.Errorf("want [@a @b], got %v", got)
+	}
+
+	if ok, err := b.Exists("dir/y.txt"); err != nil || ok {
+		t.Errorf("dir/y.txt should not exist in b: %v", err)
+	}
+	if err := b.Delete("dir/y.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want ErrNotExist, got %v", err)
+	}
+	if fi, err := a.Stat("dir/y.txt"); err != nil || fi.Size() != 3 {
+		t.Errorf("unexpected stat: %v %v", fi, err)
+	}
+
+	if versions, err := a.ListVersions("x.txt"); err != nil || len(versions) != 2 {
+		t.Errorf("want 2 versions in a, got %v %v", versions, err)
+	}
+	if versions, err := b.ListVersions("x.txt"); err != nil || len(versions) != 1 {
+		t.Errorf("want 1 version in b, got %v %v", versions, err)
+	}
+	if count, err := b.PruneVersions("", 0, time.Now().Add(time.Hour)); err != nil || count != 0 {
+		t.Errorf("want nothing pruned in b, got %d %v", count, err)
+	}
+	if versions, err := a.ListVersions("x.txt"); err != nil || len(versions) != 2 {
+		t.Errorf("versions of a should be kept, got %v %v", versions, err)
+	}
+
+	changes, err := b.Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Op != ChangeWrite || changes[0].Path != "x.txt" {
+		t.Errorf("want [write x.txt] in b, got %v", changes)
+	}
+
+	usage, err := a.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Namespace != "a" || usage.Files != 2 || usage.Bytes != 7 {
+		t.Errorf("unexpected usage of a: %+v", usage)
+	}
+	if usage, err := target.Usage(); err != nil || usage.Files != 3 || usage.Bytes != 10 {
+		t.Errorf("unexpected usage of table: %+v %v", usage, err)
+	}
+
+	f, err := b.Claim(ClaimOptions{Consumer: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "x.txt" {
+		t.Errorf("want x.txt, got %s", f.Name)
+	}
+	if err := f.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Claim(ClaimOptions{Consumer: "t"}); err != ErrQueueEmpty {
+		t.Errorf("want ErrQueueEmpty, got %v", err)
+	}
+	if ok, err := a.Exists("x.txt"); err != nil || !ok {
+		t.Errorf("x.txt in a should not be acked: %v", err)
+	}
+
+	q := tenant("q", 10)
+	if err := q.WriteFile("1.txt", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.WriteFile("2.txt", []byte("123456")); err != ErrQuotaExceeded {
+		t.Errorf("want ErrQuotaExceeded, got %v", err)
+	}
+	if ok, err := q.Exists("2.txt"); err != nil || ok {
+		t.Errorf("2.txt should be rolled back: %v", err)
+	}
+	// 覆盖文件时原来的大小不计算在内
+	if err := q.WriteFile("1.txt", []byte("1234567890")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Copy("1.txt", "3.txt"); err != ErrQuotaExceeded {
+		t.Errorf("want ErrQuotaExceeded, got %v", err)
+	}
+	if usage, err := q.Usage(); err != nil || usage.Files != 1 || usage.Bytes != 10 || usage.Quota != 10 {
+		t.Errorf("unexpected usage of q: %+v %v", usage, err)
+	}
+
+	if _, err := parseDBOptions(url.Values{"sc_namespace": {"a/b"}}); err == nil {
+		t.Error("want error for invalid namespace")
+	}
+	opts, err := parseDBOptions(url.Values{"sc_namespace": {"t1"}, "sc_quota": {"1024"}})
+	if err != nil || opts.Namespace != "t1" || opts.Quota != 1024 {
+		t.Errorf("unexpected options: %+v %v", opts, err)
+	}
+}
+
+// 维护操作在有命名空间的 target 上只处理命名空间中的文件
+func TestSQLiteNamespaceMaintenance(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	tenant := func(ns string) *dbTarget {
+		st := *target
+		st.SetOptions(DBOptions{Namespace: ns})
+		return &st
+	}
+	a, b := tenant("a"), tenant("b")
+
+	for _, st := range []*dbTarget{a, b} {
+		for _, name := range []string{"1.txt", "2.txt"} {
+			if err := st.WriteFile(name, []byte("12345")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, uuid := range []string{"@a/broken.txt", "@b/broken.txt"} {
+		_, err := target.conn.Exec("insert into tpt_files(uuid, partitioning_count, partitioning_sequence, data, data_size, created_at) values(?, ?, 0, 'abc', 3, '2000-01-01T00:00:00.000Z')", uuid, DataStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(uuid string) bool {
+		t.Helper()
+		ok, err := target.Exists(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	broken, err := a.Fsck(FsckOptions{Repair: FsckQuarantine})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(broken) != 1 || broken[0].Path != "broken.txt" || !broken[0].Repaired {
+		t.Errorf("want [broken.txt] in a, got %+v", broken)
+	}
+	if !exists("@a/.quarantine/broken.txt") || exists("@a/broken.txt") || !exists("@b/broken.txt") {
+		t.Error("only broken.txt in a should be quarantined")
+	}
+
+	result, err := b.GC(GCOptions{MaxTotalSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Incomplete != 1 || result.Files != 1 {
+		t.Errorf("want 1 incomplete and 1 file deleted in b, got %+v", result)
+	}
+	if exists("@b/broken.txt") || exists("@b/1.txt") || !exists("@b/2.txt") {
+		t.Error("GC of b deleted unexpected files")
+	}
+	if !exists("@a/.quarantine/broken.txt") || !exists("@a/1.txt") || !exists("@a/2.txt") {
+		t.Error("GC of b should not delete files in a")
+	}
+
+	// 校验和是用命名空间中的路径读取文件计算的
+	c := tenant("c")
+	c.opts.Metadata = true
+	if err := c.WriteFile("good.txt", []byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if broken, err := c.Fsck(FsckOptions{Checksum: true}); err != nil || len(broken) != 0 {
+		t.Errorf("want no broken files in c, got %+v %v", broken, err)
+	}
+
+	if err := a.RebuildMetadata(); err != ErrNamespaceUnsupported {
+		t.Error("want ErrNamespaceUnsupported, got", err)
+	}
+	a.opts.Keys = &StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	if _, err := a.ReEncrypt(10); err != ErrNamespaceUnsupported {
+		t.Error("want ErrNamespaceUnsupported, got", err)
+	}
+}
+
+func TestSQLiteAdaptiveStorage(t *testing.T) {
+	target := newSQLiteTarget(t, "", 1024)
+	target.SetOptions(DBOptions{Storage: StorageAdaptive})
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := target.WriteFile("one.bin", big); err != nil {
+		t.Fatal(err)
+	}
+	w, err := target.Write("many.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(big); i += 3000 {
+		end := i + 3000
+		if end > len(big) {
+			end = len(big)
+		}
+		if _, err := w.Write(big[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"one.bin", "many.bin"} {
+		var count, max int
+		err := target.conn.QueryRow("select count(*), max(data_size) from tpt_files where uuid = ?", name).Scan(&count, &max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 10 || max != 1024 {
+			t.Errorf("%s: want 10 chunks of at most 1024 bytes, got %d chunks of %d bytes", name, count, max)
+		}
+		if bs, err := readAll(t, target, name); err != nil || !bytes.Equal(bs, big) {
+			t.Errorf("%s: content is mismatch, got %d bytes, %v", name, len(bs), err)
+		}
+	}
+
+	target.SetOptions(DBOptions{Storage: StorageLargeObject})
+	if _, err := target.Write("lo.bin"); err != ErrLargeObjectUnsupported {
+		t.Error("want ErrLargeObjectUnsupported, got", err)
+	}
+}
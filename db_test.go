@@ -32,14 +32,13 @@ func TestDB(t *testing.T) {
 		return
 	}
 
-	_, err = target.conn.Exec(DefaultResetSQL)
+	err = target.DropSchema()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	s := strings.Replace(DefaultInitSQL, "bytea", "blob", -1)
-	_, err = target.conn.Exec(s)
+	err = target.EnsureSchema()
 	if err != nil {
 		t.Error(err)
 		return
@@ -71,14 +70,13 @@ func TestDBOpen(t *testing.T) {
 		return
 	}
 
-	_, err = target.(*dbTarget).conn.Exec(DefaultResetSQL)
+	err = target.(*dbTarget).DropSchema()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	s := strings.Replace(DefaultInitSQL, "bytea", "blob", -1)
-	_, err = target.(*dbTarget).conn.Exec(s)
+	err = target.(*dbTarget).EnsureSchema()
 	if err != nil {
 		t.Error(err)
 		return
@@ -205,7 +203,7 @@ func runTest(t *testing.T, target Session) {
 		return
 	}
 	if exists {
-		err = target.Delete("AAA.txt")
+		err = target.Delete("BBB.txt")
 		if err != nil {
 			t.Error(err)
 			return
@@ -0,0 +1,111 @@
+package scopy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ErrDuplicateKey 表示违反了唯一约束, 自定义的 execer 可以返回它
+var ErrDuplicateKey = errors.New("scopy: duplicate key")
+
+const (
+	mysqlErrDupEntry     = 1062
+	mysqlErrDupFieldName = 1060
+
+	postgresUniqueViolation = "23505"
+
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+
+	mssqlErrDupKey      = 2627
+	mssqlErrDupKeyIndex = 2601
+
+	oracleErrUniqueViolated = 1
+)
+
+// IsDuplicateKey 判断 err 是不是违反唯一约束的错误，支持 mysql, postgres (pq 和 pgx),
+// sqlite (mattn 和 modernc), sqlserver 和 oracle 的驱动, 其它的只能通过错误信息判断
+func IsDuplicateKey(err error) bool {
+	return dialectOf("").isDuplicateKey(err)
+}
+
+// isDuplicateKey 判断 err 是不是违反唯一约束的错误, mysql 和 mattn/go-sqlite3 是直接依赖，用它们的错误类型判断,
+// 其它的驱动通过错误类型上的方法来判断
+func (d *dialect) isDuplicateKey(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrDuplicateKey) {
+		return true
+	}
+
+	// github.com/lib/pq 和 github.com/jackc/pgx
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == postgresUniqueViolation
+	}
+
+	// github.com/microsoft/go-mssqldb
+	var mssqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &mssqlErr) {
+		number := mssqlErr.SQLErrorNumber()
+		return number == mssqlErrDupKey || number == mssqlErrDupKeyIndex
+	}
+
+	// github.com/go-sql-driver/mysql
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDupEntry
+	}
+
+	// github.com/mattn/go-sqlite3, 见 sqliteErrorCode
+	if code, ok := sqliteErrorCode(err); ok {
+		return code == sqliteConstraintUnique || code == sqliteConstraintPrimaryKey
+	}
+
+	// modernc.org/sqlite 和 github.com/godror/godror 都用 Code() 返回错误码，
+	// 只能根据数据库类型区分
+	var codeErr interface{ Code() int }
+	if errors.As(err, &codeErr) {
+		switch d.name {
+		case DialectSQLite:
+			return codeErr.Code() == sqliteConstraintUnique || codeErr.Code() == sqliteConstraintPrimaryKey
+		case DialectOracle:
+			return codeErr.Code() == oracleErrUniqueViolated
+		}
+	}
+
+	// aceql-http 等只返回错误信息
+	msg := err.Error()
+	for _, s := range []string{
+		"Error 1062",
+		"Duplicate entry",
+		"SQLSTATE 23505",
+		"duplicate key value violates unique constraint",
+		"UNIQUE constraint failed",
+		"Violation of PRIMARY KEY constraint",
+		"Violation of UNIQUE KEY constraint",
+		"Cannot insert duplicate key",
+		"ORA-00001",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDuplicateColumn 判断 err 是不是 mysql 中增加已经存在的列的错误
+func (d *dialect) isDuplicateColumn(err error) bool {
+	if err == nil || d.name != DialectMySQL {
+		return false
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDupFieldName
+	}
+	// aceql-http 等只返回错误信息
+	return strings.Contains(err.Error(), "Error 1060") || strings.Contains(err.Error(), "Duplicate column name")
+}
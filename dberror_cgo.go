@@ -0,0 +1,18 @@
+//go:build cgo
+
+package scopy
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteErrorCode 返回 github.com/mattn/go-sqlite3 的扩展错误码
+func sqliteErrorCode(err error) (int, bool) {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return int(sqliteErr.ExtendedCode), true
+	}
+	return 0, false
+}
@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package scopy
+
+// sqliteErrorCode 在没有 cgo 时 github.com/mattn/go-sqlite3 不能使用，也就不会有它的错误
+func sqliteErrorCode(err error) (int, bool) {
+	return 0, false
+}
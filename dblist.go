@@ -0,0 +1,210 @@
+package scopy
+
+import (
+	"database/sql"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// 数据库中的文件没有目录，uuid 中用 / 分隔的部分被看作目录,
+// 列目录时用 uuid 上的索引查询以 "dir/" 开头的文件, 不需要扫描整个表。
+// 子目录中的文件不会被返回，每个子目录只需要一次索引查找，见 listDir
+
+// dirPrefix 返回目录下的文件的 uuid 前缀, 根目录返回空字符串
+func dirPrefix(remotePath string) string {
+	if remotePath == "" || remotePath == "." || remotePath == "/" {
+		return ""
+	}
+	return strings.TrimSuffix(remotePath, "/") + "/"
+}
+
+// prefixArgs 返回 listPrefix 语句的参数，前缀总是以 / 结尾的，
+// 所以将最后的 / 换成 0 (它的下一个字符) 就是查询的上界
+func prefixArgs(prefix string) []interface{} {
+	return []interface{}{prefix, prefix[:len(prefix)-1] + "0"}
+}
+
+// prefixCondition 返回按前缀范围查询 column 的条件, postgres 中用 pattern 操作符，
+// 它按字节比较，并可以使用 varchar_pattern_ops 索引
+func (d *dialect) prefixCondition(column string) string {
+	if d.name == DialectPostgres {
+		return column + " ~>=~ ? and " + column + " ~<~ ?"
+	}
+	return column + " >= ? and " + column + " < ?"
+}
+
+// fromCondition 返回查询 column 不小于参数的条件，和 prefixCondition 一样在 postgres 中按字节比较
+func (d *dialect) fromCondition(column string) string {
+	if d.name == DialectPostgres {
+		return column + " ~>=~ ?"
+	}
+	return column + " >= ?"
+}
+
+// byteOrder 返回按 fromCondition 和 prefixCondition 的顺序排序的 order by 子句
+func (d *dialect) byteOrder(column string) string {
+	if d.name == DialectPostgres {
+		return " order by " + column + " using ~<~"
+	}
+	return " order by " + column
+}
+
+// likeEscape 是 like 模式中的转义字符
+const likeEscape = "!"
+
+// subdirPattern 返回匹配子目录中的文件的 like 模式，根目录下以 / 开头的 uuid 中第一个 / 被忽略
+func (d *dialect) subdirPattern(prefix string) string {
+	if prefix == "" {
+		return "_%/%"
+	}
+	special := "%_" + likeEscape
+	if d.name == DialectMSSQL {
+		special += "["
+	}
+	var sb strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(special, c) {
+			sb.WriteString(likeEscape)
+		}
+		sb.WriteRune(c)
+	}
+	sb.WriteString("%/%")
+	return sb.String()
+}
+
+// listDir 返回目录下的文件和子目录，metadata 为 true 时从元数据表中读取。
+// 文件是用一个查询返回的, 子目录是从更深的文件中合成的，每次查询下一个子目录中的第一个文件，
+// 然后跳过这个子目录，所以查询的次数和子目录的个数一样。 子目录没有时间
+func listDir(e execer, stmts *sqlStatements, d *dialect, metadata bool, remotePath string) ([]fs.FileInfo, error) {
+	prefix := dirPrefix(remotePath)
+	pattern := d.subdirPattern(prefix)
+
+	query, args := stmts.listFiles, []interface{}{pattern}
+	if prefix != "" {
+		query, args = stmts.listFilesPrefix, append(prefixArgs(prefix), pattern)
+	}
+	if metadata {
+		query = stmts.metaListFiles
+		if prefix != "" {
+			query = stmts.metaListFilesPrefix
+		}
+	}
+
+	var list []fs.FileInfo
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		var uuid string
+		var length sql.NullInt64
+		var created nullTime
+		var meta *FileMeta
+
+		if metadata {
+			var err error
+			uuid, meta, err = scanMeta(scan)
+			if err != nil {
+				return err
+			}
+			length.Int64, length.Valid = meta.Size, true
+			created.Time = meta.ModTime
+		} else if err := scan(&uuid, &length, &created); err != nil {
+			return err
+		}
+		// 在大小写不敏感的排序规则下，范围查询的结果可能多一些
+		if !strings.HasPrefix(uuid, prefix) {
+			return nil
+		}
+
+		name := uuid[len(prefix):]
+		if prefix == "" {
+			name = strings.TrimPrefix(name, "/")
+		}
+		if strings.IndexByte(name, '/') >= 0 {
+			return nil
+		}
+
+		if !length.Valid {
+			length.Int64 = -1
+		}
+		list = append(list, &fileStat{
+			name:    name,
+			size:    length.Int64,
+			modTime: created.Time,
+			meta:    meta,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := listSubdirs(e, stmts, metadata, prefix, pattern)
+	if err != nil {
+		return nil, err
+	}
+	list = append(list, dirs...)
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list, nil
+}
+
+// listSubdirs 返回目录下的子目录, 每次用 listDirs 查找下一个子目录中的第一个文件，然后将下限移到这个子目录之后
+func listSubdirs(e execer, stmts *sqlStatements, metadata bool, prefix, pattern string) ([]fs.FileInfo, error) {
+	var list []fs.FileInfo
+	seen := map[string]bool{}
+	from := prefix
+	for {
+		// 根目录下第一次查询时没有下限, oracle 中的空字符串是 null
+		query, args := stmts.listDirs, []interface{}{pattern}
+		if metadata {
+			query = stmts.metaListDirs
+		}
+		if prefix != "" {
+			query, args = stmts.listDirsPrefix, append(prefixArgs(prefix), pattern)
+			if metadata {
+				query = stmts.metaListDirsPrefix
+			}
+			args[0] = from
+		} else if from != "" {
+			query, args = stmts.listDirsFrom, []interface{}{from, pattern}
+			if metadata {
+				query = stmts.metaListDirsFrom
+			}
+		}
+
+		var uuid string
+		found := false
+		err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+			found = true
+			return scan(&uuid)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found || len(uuid) < len(prefix) {
+			return list, nil
+		}
+
+		offset := len(prefix)
+		name := uuid[offset:]
+		if prefix == "" && strings.HasPrefix(name, "/") {
+			offset++
+			name = name[1:]
+		}
+		idx := strings.IndexByte(name, '/')
+		if idx < 0 {
+			// 在大小写不敏感的排序规则下，like 的结果可能多一些
+			return list, nil
+		}
+		name = name[:idx]
+
+		// 在大小写不敏感的排序规则下，范围查询的结果可能多一些
+		if name != "" && strings.HasPrefix(uuid, prefix) && !seen[name] {
+			seen[name] = true
+			list = append(list, &fileStat{name: name, isDir: true})
+		}
+		// 子目录中的文件都以 "name/" 开头，将 / 换成 0 (它的下一个字符) 就跳过了整个子目录
+		from = uuid[:offset+idx] + "0"
+	}
+}
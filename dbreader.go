@@ -0,0 +1,356 @@
+package scopy
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+// chunkReader 按 partitioning_sequence 的顺序逐块读取文件, 内存中只保留当前的块和预读的块。
+// 它根据每个块的大小将偏移映射到块上，所以也实现了 io.ReaderAt 和 io.Seeker,
+// 可以直接用于 http.ServeContent 和 zip.NewReader
+type chunkReader struct {
+	// offsets[i] 是第 i 块在文件中的起始偏移, offsets[len(offsets)-1] 是文件的大小
+	offsets []int64
+	load    func(idx int) ([]byte, error)
+
+	// readAhead 是预读的块数， 为 0 时不预读
+	readAhead int
+	prefetch  chan chunkResult
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	pos     int64
+	next    int
+	skip    int64
+	data    []byte
+	lastErr error
+
+	// ReadAt 可以被并发调用，它缓存最后读取的一个块
+	cacheMu   sync.Mutex
+	cacheIdx  int
+	cacheData []byte
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+func newChunkReader(sizes []int64, readAhead int, load func(idx int) ([]byte, error)) *chunkReader {
+	offsets := make([]int64, len(sizes)+1)
+	for idx, size := range sizes {
+		offsets[idx+1] = offsets[idx] + size
+	}
+	return &chunkReader{
+		offsets:   offsets,
+		load:      load,
+		readAhead: readAhead,
+		cacheIdx:  -1,
+	}
+}
+
+func (r *chunkReader) count() int {
+	return len(r.offsets) - 1
+}
+
+// Size 返回文件的大小
+func (r *chunkReader) Size() int64 {
+	return r.offsets[len(r.offsets)-1]
+}
+
+// loadChunk 加载一个块并检查它解压后的大小是否和记录的一致
+func (r *chunkReader) loadChunk(idx int) ([]byte, error) {
+	data, err := r.load(idx)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != r.offsets[idx+1]-r.offsets[idx] {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.stopPrefetch()
+	if r.lastErr == nil || r.lastErr == io.EOF {
+		r.lastErr = fs.ErrClosed
+	}
+	return nil
+}
+
+func (r *chunkReader) startPrefetch() {
+	r.prefetch = make(chan chunkResult, r.readAhead)
+	r.done = make(chan struct{})
+	r.wg.Add(1)
+	go func(start int, prefetch chan chunkResult, done chan struct{}) {
+		defer r.wg.Done()
+		defer close(prefetch)
+
+		for idx := start; idx < r.count(); idx++ {
+			data, err := r.loadChunk(idx)
+			select {
+			case prefetch <- chunkResult{data: data, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}(r.next, r.prefetch, r.done)
+}
+
+func (r *chunkReader) stopPrefetch() {
+	if r.done != nil {
+		close(r.done)
+		r.wg.Wait()
+		r.done = nil
+		r.prefetch = nil
+	}
+}
+
+func (r *chunkReader) nextChunk() ([]byte, error) {
+	if r.readAhead <= 0 {
+		return r.loadChunk(r.next)
+	}
+
+	if r.prefetch == nil {
+		r.startPrefetch()
+	}
+	result, ok := <-r.prefetch
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return result.data, result.err
+}
+
+func (r *chunkReader) Read(data []byte) (int, error) {
+	if r.lastErr != nil {
+		return 0, r.lastErr
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	for len(r.data) == 0 {
+		if r.next >= r.count() {
+			return 0, io.EOF
+		}
+		chunk, err := r.nextChunk()
+		if err != nil {
+			r.lastErr = err
+			return 0, err
+		}
+		r.next++
+		r.data = chunk[r.skip:]
+		r.skip = 0
+	}
+
+	n := copy(data, r.data)
+	r.data = r.data[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+var errNegativeOffset = errors.New("scopy: negative offset")
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	if r.lastErr != nil && r.lastErr != io.EOF {
+		return 0, r.lastErr
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.Size()
+	default:
+		return 0, errors.New("scopy: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	if offset == r.pos {
+		return offset, nil
+	}
+
+	r.stopPrefetch()
+	r.pos = offset
+	r.data = nil
+	r.lastErr = nil
+	if offset >= r.Size() {
+		r.next = r.count()
+		r.skip = 0
+		return offset, nil
+	}
+	r.next = r.chunkAt(offset)
+	r.skip = offset - r.offsets[r.next]
+	return offset, nil
+}
+
+// chunkAt 返回包含 offset 的块
+func (r *chunkReader) chunkAt(offset int64) int {
+	return sort.Search(r.count(), func(i int) bool {
+		return r.offsets[i+1] > offset
+	})
+}
+
+func (r *chunkReader) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if r.lastErr == fs.ErrClosed {
+		return 0, r.lastErr
+	}
+
+	n := 0
+	for n < len(data) {
+		if off >= r.Size() {
+			return n, io.EOF
+		}
+		idx := r.chunkAt(off)
+		chunk, err := r.cachedChunk(idx)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(data[n:], chunk[off-r.offsets[idx]:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (r *chunkReader) cachedChunk(idx int) ([]byte, error) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	if r.cacheIdx == idx {
+		return r.cacheData, nil
+	}
+	data, err := r.loadChunk(idx)
+	if err != nil {
+		return nil, err
+	}
+	r.cacheIdx, r.cacheData = idx, data
+	return data, nil
+}
+
+// readChunks 返回文件所有块的 id 和大小, 并检查块的序号是否连续
+func readChunks(e execer, stmts *sqlStatements, remotePath string) ([]int64, []int64, error) {
+	return scanChunks(e, stmts.readChunksByUUID, []interface{}{remotePath}, remotePath)
+}
+
+// decodeStoredChunk 解密并解压一个块
+func decodeStoredChunk(keys KeyProvider, keyID, encoding, bind string, data []byte) ([]byte, error) {
+	data, err := openChunk(keys, keyID, encoding, bind, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(encoding, data)
+}
+
+// scanChunks 执行返回 (id, 序号, 大小) 的查询
+func scanChunks(e execer, query string, args []interface{}, remotePath string) ([]int64, []int64, error) {
+	var ids, sizes []int64
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		var id int64
+		var seq int
+		var size sql.NullInt64
+		if err := scan(&id, &seq, &size); err != nil {
+			return err
+		}
+		if seq != len(ids) {
+			return ErrIndexSequence
+		}
+		ids = append(ids, id)
+		sizes = append(sizes, size.Int64)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, &fs.PathError{Op: "open", Path: remotePath, Err: os.ErrNotExist}
+	}
+	return ids, sizes, nil
+}
+
+// Read 打开文件，它先读取所有块的 id 和大小, 然后在读的过程中一次加载一个块, 不会长时间占用数据库连接。
+// 返回的 io.ReadCloser 同时实现了 io.ReaderAt 和 io.Seeker
+func (st *dbTarget) Read(remotePath string) (io.ReadCloser, error) {
+	key := st.opts.key(remotePath)
+	if st.opts.Storage == StorageLargeObject {
+		r, err := st.openLargeObject(key)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return r, nil
+		}
+	}
+	ids, sizes, err := readChunks(st.execer(), st.stmts, key)
+	if err != nil {
+		return nil, err
+	}
+	return st.openChunks(st.stmts.readDataByID, ids, sizes), nil
+}
+
+// readConn 返回读取块用的连接和预读的块数。 绑定了调用者的事务时在事务中读，这样能读到事务中写入的块,
+// 事务中的语句不能并发执行，所以不预读
+func (st *dbTarget) readConn() (sqlConn, int) {
+	if st.tx != nil {
+		return st.tx, 0
+	}
+	return st.conn, st.opts.ReadAhead
+}
+
+// openChunks 返回按 id 逐块读取的 chunkReader, readData 是按 id 读取一个块的语句
+func (st *dbTarget) openChunks(readData string, ids, sizes []int64) *chunkReader {
+	conn, readAhead := st.readConn()
+	return newChunkReader(sizes, readAhead, func(idx int) ([]byte, error) {
+		data, err := loadChunkData(st.opts.Keys, conn.QueryRow(st.dialect.rebind(readData), ids[idx]).Scan)
+		if err == sql.ErrNoRows {
+			// 读的过程中文件被删除或覆盖了
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data, err
+	})
+}
+
+// Read 打开文件, 返回的 io.ReadCloser 同时实现了 io.ReaderAt 和 io.Seeker
+func (st *sqlhttpTarget) Read(remotePath string) (io.ReadCloser, error) {
+	ids, sizes, err := readChunks(st.execer(), st.stmts, st.opts.key(remotePath))
+	if err != nil {
+		return nil, err
+	}
+	return st.openChunks(st.stmts.readDataByID, ids, sizes), nil
+}
+
+// openChunks 返回按 id 逐块读取的 chunkReader, readData 是按 id 读取一个块的语句
+func (st *sqlhttpTarget) openChunks(readData string, ids, sizes []int64) *chunkReader {
+	e := st.execer()
+	// aceql-http 的会话不能并发使用，所以不预读
+	return newChunkReader(sizes, 0, func(idx int) ([]byte, error) {
+		var data []byte
+		found := false
+		err := e.query(readData, []interface{}{ids[idx]}, func(scan func(dest ...interface{}) error) error {
+			found = true
+			var err error
+			data, err = loadChunkData(st.opts.Keys, scan)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data, nil
+	})
+}
@@ -0,0 +1,262 @@
+package scopy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/fs"
+	"os"
+)
+
+// 启用 DBOptions.Dedup 后，块的数据按内容的 sha256 保存在 "<表名>_blobs" 表中，相同的块只保存一次,
+// 文件表和历史版本表中的行只记录 blob_hash 和块的大小。 blob 的 refcount 是引用它的行数，
+// 删除文件时减少引用计数, 引用计数为 0 的 blob 由 GC 删除。
+// 在去重模式下写入过文件后不要关闭去重模式，否则删除文件时不会减少引用计数，需要用 GCOptions.RecountBlobs 修正。
+// 启用加密时 hash 是用当前的密钥派生的 HMAC-SHA256, 不能用来猜测加密的块的内容，轮换密钥后相同的数据会保存为新的 blob
+
+// dedupHashLabel 用于从加密的密钥派生计算 blob 的 hash 的密钥
+const dedupHashLabel = "scopy dedup hash"
+
+// blobTable 返回文件表对应的 blob 表的表名
+func blobTable(table string) string {
+	return table + "_blobs"
+}
+
+// adjustRefs 执行 blobRelease 等修改引用计数的语句，它们的参数要传两次
+func adjustRefs(e execer, query string, args ...interface{}) error {
+	_, err := e.exec(query, append(args, args...)...)
+	return err
+}
+
+// releaseFile 减少文件当前的块引用的 blob 的引用计数，必须在删除块之前调用
+func releaseFile(e execer, stmts *sqlStatements, opts DBOptions, uuid string) error {
+	if opts.Storage == StorageLargeObject {
+		if _, err := e.exec(stmts.loUnlink, uuid); err != nil {
+			return err
+		}
+	}
+	if !opts.Dedup {
+		return nil
+	}
+	return adjustRefs(e, stmts.blobRelease, uuid)
+}
+
+// clearFile 删除文件原来的块，覆盖文件时在写第一块之前调用。 新的块是在同一个事务中写入的，
+// 所以读取者看到的总是完整的旧文件或新文件，不会混合新旧的块
+func clearFile(e execer, stmts *sqlStatements, opts DBOptions, uuid string) error {
+	if err := releaseFile(e, stmts, opts, uuid); err != nil {
+		return err
+	}
+	_, err := e.exec(stmts.deleteByUUID, uuid)
+	return err
+}
+
+// blobHash 返回 blob 的 hash, keys 不为 nil 时是 HMAC
+func blobHash(keys KeyProvider, data []byte) (string, error) {
+	if keys == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	_, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	kdf := hmac.New(sha256.New, key)
+	kdf.Write([]byte(dedupHashLabel))
+	mac := hmac.New(sha256.New, kdf.Sum(nil))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// storeBlob 保存一个块的数据，已经有相同的数据时只增加引用计数, 返回数据的 hash
+func storeBlob(e execer, stmts *sqlStatements, opts DBOptions, data []byte) (string, error) {
+	hash, err := blobHash(opts.Keys, data)
+	if err != nil {
+		return "", err
+	}
+
+	count, err := e.exec(stmts.blobRetain, hash)
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return hash, nil
+	}
+
+	stored, encoding, err := encodeChunk(opts.Compression, data)
+	if err != nil {
+		return "", err
+	}
+	stored, keyID, err := sealChunk(opts.Keys, encoding, blobBinding(hash), stored)
+	if err != nil {
+		return "", err
+	}
+	// 其它的连接同时写入了相同的数据时 blobInsert 只增加引用计数
+	if _, err := e.exec(stmts.blobInsert, hash, stored, int64(len(data)), encoding, keyID); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// writeDedupChunk 在去重模式下写一个块
+func writeDedupChunk(e execer, stmts *sqlStatements, opts DBOptions, uuid string, total, idx int, data []byte) error {
+	hash, err := storeBlob(e, stmts, opts, data)
+	if err != nil {
+		return err
+	}
+	_, err = e.exec(stmts.insert, uuid, total, idx, []byte(nil), int64(len(data)), EncodingNone, "", hash)
+	return err
+}
+
+// loadChunkData 从 readDataByID 等语句的结果中得到块的数据，去重的块的数据在 blob 中
+func loadChunkData(keys KeyProvider, scan func(dest ...interface{}) error) ([]byte, error) {
+	var data, blobData []byte
+	var encoding, keyID, blobEncoding, blobKeyID, blobHash sql.NullString
+	var uuid string
+	var seq int
+	if err := scan(&data, &encoding, &keyID, &blobData, &blobEncoding, &blobKeyID, &uuid, &seq, &blobHash); err != nil {
+		return nil, err
+	}
+	if blobData != nil {
+		return decodeStoredChunk(keys, blobKeyID.String, blobEncoding.String, blobBinding(blobHash.String), blobData)
+	}
+	return decodeStoredChunk(keys, keyID.String, encoding.String, chunkBinding(uuid, seq), data)
+}
+
+// gcBlobs 分批删除引用计数为 0 的 blob
+func gcBlobs(st tableStore, stmts *sqlStatements, d *dialect, batchSize int, recount bool) (int64, error) {
+	if recount {
+		if _, err := st.execer().exec(stmts.blobRecount); err != nil {
+			return 0, err
+		}
+	}
+
+	var count int64
+	for {
+		var ids []int64
+		err := st.execer().query(stmts.blobUnused+d.limit(batchSize), nil, func(scan func(dest ...interface{}) error) error {
+			var id int64
+			if err := scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil || len(ids) == 0 {
+			return count, err
+		}
+
+		err = st.inTx(func(e execer) error {
+			for _, id := range ids {
+				// 选出之后可能又被引用了，所以删除时再检查一次引用计数
+				n, err := e.exec(stmts.blobDelete, id)
+				if err != nil {
+					return err
+				}
+				count += n
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if len(ids) < batchSize {
+			return count, nil
+		}
+	}
+}
+
+// copyFile 在数据库中复制文件, 去重模式下只复制块的引用
+func copyFile(e execer, stmts *sqlStatements, opts DBOptions, from, to string) (int64, error) {
+	if from == to {
+		// 复制前会删除 to 原来的块
+		return 0, &fs.PathError{Op: "copy", Path: from, Err: fs.ErrInvalid}
+	}
+	left, err := quotaLeft(e, stmts, opts, to)
+	if err != nil {
+		return 0, err
+	}
+	if left >= 0 {
+		size, err := fileSize(e, stmts, from)
+		if err != nil {
+			return 0, err
+		}
+		if size > left {
+			return 0, ErrQuotaExceeded
+		}
+	}
+	if opts.Versioned {
+		if err := archiveVersion(e, stmts, opts, to); err != nil {
+			return 0, err
+		}
+	}
+	if err := releaseFile(e, stmts, opts, to); err != nil {
+		return 0, err
+	}
+	if _, err := e.exec(stmts.deleteByUUID, to); err != nil {
+		return 0, err
+	}
+	count, err := e.exec(stmts.copyFile, to, from)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, &fs.PathError{Op: "copy", Path: from, Err: os.ErrNotExist}
+	}
+	if err := resealFile(e, stmts, opts.Keys, from, to, false); err != nil {
+		return 0, err
+	}
+	if opts.Dedup {
+		if err := adjustRefs(e, stmts.blobRetainFile, to); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Storage == StorageLargeObject {
+		if err := copyLargeObject(e, stmts, from, to); err != nil {
+			return 0, err
+		}
+	}
+
+	var size sql.NullInt64
+	err = e.query(stmts.stat, []interface{}{to}, func(scan func(dest ...interface{}) error) error {
+		var uuid string
+		var created nullTime
+		return scan(&uuid, &size, &created)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.Metadata {
+		if _, err := e.exec(stmts.metaDelete, to); err != nil {
+			return 0, err
+		}
+		if _, err := e.exec(stmts.metaCopy, to, from); err != nil {
+			return 0, err
+		}
+	}
+	return size.Int64, logChange(e, stmts, opts, ChangeWrite, to)
+}
+
+// Copy 在数据库中复制文件，不需要读出数据，去重模式下只复制块的引用。返回文件的大小
+func (st *dbTarget) Copy(from, to string) (int64, error) {
+	var size int64
+	err := st.inTx(func(e execer) error {
+		var err error
+		size, err = copyFile(e, st.stmts, st.opts, st.opts.key(from), st.opts.key(to))
+		return err
+	})
+	return size, err
+}
+
+// Copy 在数据库中复制文件，不需要读出数据，去重模式下只复制块的引用。返回文件的大小
+func (st *sqlhttpTarget) Copy(from, to string) (int64, error) {
+	var size int64
+	err := st.inTx(func(e execer) error {
+		var err error
+		size, err = copyFile(e, st.stmts, st.opts, st.opts.key(from), st.opts.key(to))
+		return err
+	})
+	return size, err
+}
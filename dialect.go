@@ -0,0 +1,310 @@
+package scopy
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DialectUnknown  = ""
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+	DialectMSSQL    = "sqlserver"
+	DialectOracle   = "oracle"
+)
+
+// dialect 封装了各个数据库在 sql 语法上的差异
+type dialect struct {
+	name string
+}
+
+// dialectOf 根据数据库驱动名 (如 database/sql 中注册的名称或 dburl 中的 scheme) 选择方言
+func dialectOf(driverName string) *dialect {
+	switch strings.ToLower(driverName) {
+	case "mysql", "mymysql", "mariadb", "tidb", "memsql", "vitess":
+		return &dialect{name: DialectMySQL}
+	case "postgres", "postgresql", "pgx", "pq", "cockroachdb", "redshift":
+		return &dialect{name: DialectPostgres}
+	case "sqlite3", "sqlite", "moderncsqlite":
+		return &dialect{name: DialectSQLite}
+	case "sqlserver", "mssql", "azuresql":
+		return &dialect{name: DialectMSSQL}
+	case "oracle", "godror", "oci8", "ora":
+		return &dialect{name: DialectOracle}
+	}
+	return &dialect{name: DialectUnknown}
+}
+
+// now 返回当前时间的 sql 表达式
+func (d *dialect) now() string {
+	switch d.name {
+	case DialectSQLite:
+		// CURRENT_TIMESTAMP 在 sqlite 中是不带时区的 UTC 时间
+		return "strftime('%Y-%m-%dT%H:%M:%fZ', 'now')"
+	case DialectMSSQL, DialectOracle:
+		return "CURRENT_TIMESTAMP"
+	}
+	return "now()"
+}
+
+// timeValue 返回和 now() 写入的时间比较时用的参数, sqlite 中的时间是以字符串保存的
+func (d *dialect) timeValue(t time.Time) interface{} {
+	if d.name == DialectSQLite {
+		return t.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	return t
+}
+
+// ago 返回数据库的当前时间减去一段时间的表达式, 参数是 agoValue 的返回值。
+// 和 now() 写入的时间比较时要用它, 客户端的时间和时区可能和数据库服务器不一样
+func (d *dialect) ago() string {
+	switch d.name {
+	case DialectSQLite:
+		return "strftime('%Y-%m-%dT%H:%M:%fZ', 'now', ?)"
+	case DialectPostgres:
+		return "(now() - CAST(? AS BIGINT) * interval '1 microsecond')"
+	case DialectMSSQL:
+		return "DATEADD(second, ?, CURRENT_TIMESTAMP)"
+	case DialectOracle:
+		return "(CURRENT_TIMESTAMP - NUMTODSINTERVAL(? / 1000, 'SECOND'))"
+	}
+	return "(now() - interval ? microsecond)"
+}
+
+// agoValue 返回 ago() 的参数
+func (d *dialect) agoValue(age time.Duration) interface{} {
+	switch d.name {
+	case DialectSQLite:
+		return strconv.FormatFloat(-age.Seconds(), 'f', 3, 64) + " seconds"
+	case DialectMSSQL:
+		return -int64(age / time.Second)
+	case DialectOracle:
+		return age.Milliseconds()
+	}
+	return age.Microseconds()
+}
+
+// castInt 返回将参数转换为整数的表达式, postgres 不能推断 select 列表中的参数的类型
+func (d *dialect) castInt(param string) string {
+	if d.name == DialectPostgres {
+		return "CAST(" + param + " AS INTEGER)"
+	}
+	return param
+}
+
+// initSQL 返回建表语句, 它是 DefaultInitSQL 在各个数据库上的版本, 额外的常量列也是唯一约束的一部分
+func (d *dialect) initSQL(m TableMapping) string {
+	col := func(name string) string {
+		return d.quote(m.column(name))
+	}
+	var extra, unique string
+	for _, column := range m.extraColumns() {
+		extra += "\n  " + d.quote(column) + "              " + d.varcharType(200) + " NOT NULL,"
+		unique += d.quote(column) + ", "
+	}
+	return d.createTableIfNotExists(d.quoteTable(m.name()), `(
+  `+col("id")+`                `+d.idColumn()+`,
+  `+col("uuid")+`              `+d.varcharType(200)+` NOT NULL,
+  `+col("partitioning_count")+`             int,
+  `+col("partitioning_sequence")+`          int,
+  `+col("data")+`              `+d.blobType()+`,
+  `+col("created_at")+`        `+d.timestampType()+`,`+extra+`
+
+  unique(`+unique+col("uuid")+`, `+col("partitioning_sequence")+`)
+)`)
+}
+
+func (d *dialect) idColumn() string {
+	switch d.name {
+	case DialectMySQL:
+		return "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	case DialectSQLite:
+		return "INTEGER PRIMARY KEY AUTOINCREMENT"
+	case DialectMSSQL:
+		return "BIGINT IDENTITY(1,1) PRIMARY KEY"
+	case DialectOracle:
+		return "NUMBER(19) GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+	}
+	return "SERIAL PRIMARY KEY"
+}
+
+func (d *dialect) blobType() string {
+	switch d.name {
+	case DialectMySQL:
+		return "longblob"
+	case DialectSQLite, DialectOracle:
+		return "blob"
+	case DialectMSSQL:
+		return "varbinary(max)"
+	}
+	return "bytea"
+}
+
+func (d *dialect) timestampType() string {
+	if d.name == DialectMSSQL {
+		return "datetime2"
+	}
+	return "timestamp"
+}
+
+func (d *dialect) varcharType(size int) string {
+	if d.name == DialectOracle {
+		return "varchar2(" + strconv.Itoa(size) + ")"
+	}
+	return "varchar(" + strconv.Itoa(size) + ")"
+}
+
+func (d *dialect) bigintType() string {
+	if d.name == DialectOracle {
+		return "NUMBER(19)"
+	}
+	return "bigint"
+}
+
+// createTableIfNotExists 返回建表语句， table 是已经加了引号的表名, body 为括号括起来的列定义
+func (d *dialect) createTableIfNotExists(table, body string) string {
+	switch d.name {
+	case DialectMSSQL:
+		return "IF OBJECT_ID(N'" + strings.Replace(table, "'", "''", -1) + "', N'U') IS NULL CREATE TABLE " + table + " " + body
+	case DialectOracle:
+		return oracleIgnoreError("CREATE TABLE "+table+" "+body, -955)
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " " + body
+}
+
+func (d *dialect) dropTableIfExists(table string) string {
+	switch d.name {
+	case DialectMSSQL:
+		return "IF OBJECT_ID(N'" + strings.Replace(table, "'", "''", -1) + "', N'U') IS NOT NULL DROP TABLE " + table
+	case DialectOracle:
+		return oracleIgnoreError("DROP TABLE "+table, -942)
+	}
+	return "DROP TABLE IF EXISTS " + table
+}
+
+// addColumn 返回增加列的语句, 列已经存在时 postgres、sqlserver 和 oracle 中什么也不做,
+// mysql 和 sqlite 中会返回错误, 见 migrateSchema
+func (d *dialect) addColumn(table, column, definition string) string {
+	quotedTable, quotedColumn := d.quoteTable(table), d.quote(column)
+	switch d.name {
+	case DialectPostgres:
+		return "ALTER TABLE " + quotedTable + " ADD COLUMN IF NOT EXISTS " + quotedColumn + " " + definition
+	case DialectMSSQL:
+		return "IF COL_LENGTH(N'" + strings.Replace(quotedTable, "'", "''", -1) + "', N'" + strings.Replace(column, "'", "''", -1) + "') IS NULL" +
+			" ALTER TABLE " + quotedTable + " ADD " + quotedColumn + " " + definition
+	case DialectOracle:
+		return oracleIgnoreError("ALTER TABLE "+quotedTable+" ADD ("+quotedColumn+" "+definition+")", -1430)
+	}
+	return "ALTER TABLE " + quotedTable + " ADD COLUMN " + quotedColumn + " " + definition
+}
+
+// transactionalDDL 判断数据库中的 ddl 语句是否可以在事务中执行并回滚
+func (d *dialect) transactionalDDL() bool {
+	return d.name == DialectPostgres || d.name == DialectSQLite || d.name == DialectMSSQL
+}
+
+// createIndex 返回建索引的语句, 索引名中不能带有 schema, 所以 name 中的 . 会被替换为 _
+func (d *dialect) createIndex(name, table string, columns ...string) string {
+	quoted := make([]string, len(columns))
+	for idx := range columns {
+		quoted[idx] = d.quote(columns[idx])
+	}
+	return "CREATE INDEX " + d.quote(strings.Replace(name, ".", "_", -1)) + " ON " + d.quoteTable(table) + "(" + strings.Join(quoted, ", ") + ")"
+}
+
+// oracleIgnoreError 在 oracle 中执行 ddl 并忽略指定的错误码, 如表已存在 (-955)
+func oracleIgnoreError(stmt string, code int) string {
+	return "BEGIN EXECUTE IMMEDIATE '" + strings.Replace(stmt, "'", "''", -1) + "'; " +
+		"EXCEPTION WHEN OTHERS THEN IF SQLCODE != " + strconv.Itoa(code) + " THEN RAISE; END IF; END;"
+}
+
+// rebind 将语句中的 ? 转换为数据库的参数格式, 字符串中的 ? 不会被转换
+func (d *dialect) rebind(query string) string {
+	var prefix string
+	switch d.name {
+	case DialectPostgres:
+		prefix = "$"
+	case DialectMSSQL:
+		prefix = "@p"
+	case DialectOracle:
+		prefix = ":"
+	default:
+		return query
+	}
+
+	var sb strings.Builder
+	inString := false
+	idx := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inString = !inString
+		}
+		if c != '?' || inString {
+			sb.WriteByte(c)
+			continue
+		}
+		idx++
+		sb.WriteString(prefix)
+		sb.WriteString(strconv.Itoa(idx))
+	}
+	return sb.String()
+}
+
+// InitSQL 返回在 driverName 对应的数据库上创建表 dbTable 的语句
+func InitSQL(driverName, dbTable string) string {
+	if dbTable == "" {
+		dbTable = "tpt_files"
+	}
+	return dialectOf(driverName).initSQL(TableMapping{Table: dbTable})
+}
+
+// nullTime 和 sql.NullTime 一样, 但是可以从字符串中解析时间,
+// 因为 sqlite 等数据库在聚合函数 (如 max) 的结果中会以字符串返回时间
+type nullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (nt *nullTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		nt.Time, nt.Valid = time.Time{}, false
+		return nil
+	case time.Time:
+		nt.Time, nt.Valid = v, true
+		return nil
+	case []byte:
+		return nt.parse(string(v))
+	case string:
+		return nt.parse(v)
+	case int64:
+		nt.Time, nt.Valid = time.Unix(v, 0), true
+		return nil
+	}
+	return errors.New("scopy: cannot scan value into time")
+}
+
+func (nt *nullTime) parse(s string) error {
+	if s == "" {
+		nt.Time, nt.Valid = time.Time{}, false
+		return nil
+	}
+	t, err := ToDatetime(s)
+	if err != nil {
+		return err
+	}
+	nt.Time, nt.Valid = t, true
+	return nil
+}
+
+func (nt nullTime) Value() (driver.Value, error) {
+	if !nt.Valid {
+		return nil, nil
+	}
+	return nt.Time, nil
+}
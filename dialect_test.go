@@ -0,0 +1,336 @@
+package scopy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDialectRebind(t *testing.T) {
+	for _, test := range []struct {
+		driver string
+		result string
+	}{
+		{driver: "mysql", result: "select a from t where a = ? and b = '?' and c = ?"},
+		{driver: "sqlite3", result: "select a from t where a = ? and b = '?' and c = ?"},
+		{driver: "postgres", result: "select a from t where a = $1 and b = '?' and c = $2"},
+		{driver: "sqlserver", result: "select a from t where a = @p1 and b = '?' and c = @p2"},
+		{driver: "godror", result: "select a from t where a = :1 and b = '?' and c = :2"},
+	} {
+		result := dialectOf(test.driver).rebind("select a from t where a = ? and b = '?' and c = ?")
+		if result != test.result {
+			t.Error(test.driver, ": want", test.result, "got", result)
+		}
+	}
+}
+
+func TestInlineArgs(t *testing.T) {
+	result, err := inlineArgs(dialectOf(""), "select a from t where a = ? and b = '?' and c = ?", []interface{}{"x'y", 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "select a from t where a = 'x''y' and b = '?' and c = 12" {
+		t.Error(result)
+	}
+
+	if _, err := inlineArgs(dialectOf(""), "select a from t where a = ?", nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := inlineArgs(dialectOf(""), "select a from t where a = ?", []interface{}{1, 2}); err == nil {
+		t.Error("want error")
+	}
+
+	// mysql 中 \ 是转义字符，不能用它提前结束字符串
+	result, err = inlineArgs(dialectOf("mysql"), "select a from t where a = ?", []interface{}{`x\' or 1=1 -- `})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != `select a from t where a = 'x\\'' or 1=1 -- '` {
+		t.Error(result)
+	}
+
+	at := time.Date(2024, 1, 2, 11, 4, 5, 123456000, time.FixedZone("UTC+8", 8*60*60))
+	for _, test := range []struct {
+		driver  string
+		literal string
+	}{
+		{driver: "postgres", literal: "'2024-01-02 03:04:05.123456+00:00'"},
+		{driver: "sqlserver", literal: "'2024-01-02T03:04:05.123Z'"},
+		{driver: "godror", literal: "TIMESTAMP '2024-01-02 03:04:05.123456 +00:00'"},
+		{driver: "mysql", literal: "CONVERT_TZ('2024-01-02 03:04:05.123456', '+00:00', @@session.time_zone)"},
+	} {
+		result, err := inlineArgs(dialectOf(test.driver), "?", []interface{}{at})
+		if err != nil || result != test.literal {
+			t.Error(test.driver, ": want", test.literal, "got", result, err)
+		}
+	}
+}
+
+func TestDialectStatements(t *testing.T) {
+	for _, test := range []struct {
+		driver    string
+		readFirst string
+		upsert    string
+		counter   string
+	}{
+		{
+			driver:    "mysql",
+			readFirst: "select `id`, `uuid`, `partitioning_count`, `partitioning_sequence`, `data`, `created_at` from `s`.`files` order by `id` LIMIT 1",
+			upsert:    "INSERT INTO `s`.`files`(`k`, `v`, `t`) VALUES(?, ?, now()) ON DUPLICATE KEY UPDATE `v` = VALUES(`v`), `t` = VALUES(`t`)",
+			counter:   "INSERT INTO `s`.`files`(`k`, `n`) VALUES(?, 1) ON DUPLICATE KEY UPDATE `n` = `n` + 1",
+		},
+		{
+			driver:    "postgres",
+			readFirst: `select "id", "uuid", "partitioning_count", "partitioning_sequence", "data", "created_at" from "s"."files" order by "id" LIMIT 1`,
+			upsert:    `INSERT INTO "s"."files"("k", "v", "t") VALUES($1, $2, now()) ON CONFLICT ("k") DO UPDATE SET "v" = excluded."v", "t" = excluded."t"`,
+			counter:   `INSERT INTO "s"."files" AS dst("k", "n") VALUES($1, 1) ON CONFLICT ("k") DO UPDATE SET "n" = dst."n" + 1`,
+		},
+		{
+			driver:    "sqlserver",
+			readFirst: "select [id], [uuid], [partitioning_count], [partitioning_sequence], [data], [created_at] from [s].[files] order by [id] OFFSET 0 ROWS FETCH NEXT 1 ROWS ONLY",
+			upsert: "MERGE INTO [s].[files] WITH (HOLDLOCK) AS dst USING (SELECT @p1 AS [k], @p2 AS [v], CURRENT_TIMESTAMP AS [t]) AS src" +
+				" ON dst.[k] = src.[k]" +
+				" WHEN MATCHED THEN UPDATE SET dst.[v] = src.[v], dst.[t] = src.[t]" +
+				" WHEN NOT MATCHED THEN INSERT ([k], [v], [t]) VALUES (src.[k], src.[v], src.[t]);",
+			counter: "MERGE INTO [s].[files] WITH (HOLDLOCK) AS dst USING (SELECT @p1 AS [k], 1 AS [n]) AS src" +
+				" ON dst.[k] = src.[k]" +
+				" WHEN MATCHED THEN UPDATE SET dst.[n] = dst.[n] + 1" +
+				" WHEN NOT MATCHED THEN INSERT ([k], [n]) VALUES (src.[k], src.[n]);",
+		},
+		{
+			driver:    "godror",
+			readFirst: `select "ID", "UUID", "PARTITIONING_COUNT", "PARTITIONING_SEQUENCE", "DATA", "CREATED_AT" from "S"."FILES" order by "ID" FETCH FIRST 1 ROWS ONLY`,
+			upsert: `MERGE INTO "S"."FILES" dst USING (SELECT :1 AS "K", :2 AS "V", CURRENT_TIMESTAMP AS "T" FROM dual) src` +
+				` ON (dst."K" = src."K")` +
+				` WHEN MATCHED THEN UPDATE SET dst."V" = src."V", dst."T" = src."T"` +
+				` WHEN NOT MATCHED THEN INSERT ("K", "V", "T") VALUES (src."K", src."V", src."T")`,
+			counter: `MERGE INTO "S"."FILES" dst USING (SELECT :1 AS "K", 1 AS "N" FROM dual) src` +
+				` ON (dst."K" = src."K")` +
+				` WHEN MATCHED THEN UPDATE SET dst."N" = dst."N" + 1` +
+				` WHEN NOT MATCHED THEN INSERT ("K", "N") VALUES (src."K", src."N")`,
+		},
+		{
+			driver:    "",
+			readFirst: "select id, uuid, partitioning_count, partitioning_sequence, data, created_at from s.files order by id LIMIT 1",
+		},
+	} {
+		d := dialectOf(test.driver)
+		readFirst := d.rebind(newStatements(d, TableMapping{Table: "s.files"}).readFirst)
+		if readFirst != test.readFirst {
+			t.Error(test.driver, ": want", test.readFirst, "got", readFirst)
+		}
+
+		upsert := d.rebind(d.upsert(d.quoteTable("s.files"),
+			[]string{d.quote("k"), d.quote("v"), d.quote("t")},
+			[]string{"?", "?", d.now()},
+			[]string{d.quote("k")}))
+		if upsert != test.upsert {
+			t.Error(test.driver, ": want", test.upsert, "got", upsert)
+		}
+
+		counter := d.rebind(d.upsertCounter(d.quoteTable("s.files"),
+			[]string{d.quote("k"), d.quote("n")}, []string{"?", "1"},
+			[]string{d.quote("k")}, d.quote("n")))
+		if counter != test.counter {
+			t.Error(test.driver, ": want", test.counter, "got", counter)
+		}
+	}
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sqlstate " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+type mssqlError int32
+
+func (e mssqlError) Error() string         { return "mssql error" }
+func (e mssqlError) SQLErrorNumber() int32 { return int32(e) }
+
+func TestAddColumn(t *testing.T) {
+	for _, test := range []struct {
+		driver string
+		sql    string
+	}{
+		{driver: "mysql", sql: "ALTER TABLE `s`.`files` ADD COLUMN `c` bigint"},
+		{driver: "postgres", sql: `ALTER TABLE "s"."files" ADD COLUMN IF NOT EXISTS "c" bigint`},
+		{driver: "sqlserver", sql: "IF COL_LENGTH(N'[s].[files]', N'c') IS NULL ALTER TABLE [s].[files] ADD [c] bigint"},
+		{driver: "godror", sql: `BEGIN EXECUTE IMMEDIATE 'ALTER TABLE "S"."FILES" ADD ("C" bigint)'; EXCEPTION WHEN OTHERS THEN IF SQLCODE != -1430 THEN RAISE; END IF; END;`},
+	} {
+		if sql := dialectOf(test.driver).addColumn("s.files", "c", "bigint"); sql != test.sql {
+			t.Error(test.driver, ": want", test.sql, "got", sql)
+		}
+	}
+
+	mysqlDialect := dialectOf("mysql")
+	if !mysqlDialect.isDuplicateColumn(fmt.Errorf("migrate: %w", &mysql.MySQLError{Number: 1060})) {
+		t.Error("want duplicate column")
+	}
+	if mysqlDialect.isDuplicateColumn(&mysql.MySQLError{Number: 1062}) {
+		t.Error("want not duplicate column")
+	}
+}
+
+func TestIsDuplicateKey(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		result bool
+	}{
+		{err: nil, result: false},
+		{err: ErrDuplicateKey, result: true},
+		{err: fmt.Errorf("insert fail: %w", sqlStateError("23505")), result: true},
+		{err: sqlStateError("23503"), result: false},
+		{err: mssqlError(2627), result: true},
+		{err: mssqlError(2601), result: true},
+		{err: mssqlError(515), result: false},
+		{err: fmt.Errorf("insert fail: %w", &mysql.MySQLError{Number: 1062}), result: true},
+		{err: &mysql.MySQLError{Number: 1045}, result: false},
+		{err: errors.New("Error 1062 (23000): Duplicate entry 'a-0' for key 'uuid'"), result: true},
+		{err: errors.New("ORA-00001: unique constraint (A.B) violated"), result: true},
+		{err: errors.New("connection refused"), result: false},
+	} {
+		if result := IsDuplicateKey(test.err); result != test.result {
+			t.Error(test.err, ": want", test.result, "got", result)
+		}
+	}
+}
+
+func TestDialectListPrefix(t *testing.T) {
+	d := dialectOf("postgres")
+	stmts := newStatements(d, TableMapping{Table: "files"})
+	listPrefix := d.rebind(stmts.listFilesPrefix)
+	want := `select "uuid" as uuid, sum(coalesce("data_size", length("data"))) as length, max("created_at") as created_at from "files"` +
+		` where "uuid" ~>=~ $1 and "uuid" ~<~ $2 and "uuid" not like $3 escape '!' group by "uuid"`
+	if listPrefix != want {
+		t.Error("want", want, "got", listPrefix)
+	}
+	want = `select "uuid" from "files" where "uuid" ~>=~ $1 and "uuid" like $2 escape '!' order by "uuid" using ~<~ LIMIT 1`
+	if got := d.rebind(stmts.listDirsFrom); got != want {
+		t.Error("want", want, "got", got)
+	}
+
+	for _, test := range []struct {
+		driver, prefix, pattern string
+	}{
+		{"postgres", "", "_%/%"},
+		{"postgres", "a_b/", "a!_b/%/%"},
+		{"postgres", "100%!/", "100!%!!/%/%"},
+		{"postgres", "[a]/", "[a]/%/%"},
+		{"sqlserver", "[a]/", "![a]/%/%"},
+	} {
+		if pattern := dialectOf(test.driver).subdirPattern(test.prefix); pattern != test.pattern {
+			t.Error(test.driver, test.prefix, ": want", test.pattern, "got", pattern)
+		}
+	}
+
+	args := prefixArgs(dirPrefix("a/b/"))
+	if args[0] != "a/b/" || args[1] != "a/b0" {
+		t.Error("want [a/b/ a/b0], got", args)
+	}
+}
+
+func TestDialectMapping(t *testing.T) {
+	d := dialectOf("mysql")
+	stmts := newStatements(d, TableMapping{
+		Schema:  "s",
+		Table:   "files",
+		Columns: map[string]string{"uuid": "name"},
+		Extra:   map[string]string{"tenant_id": `x'\`},
+	})
+	want := "delete from `s`.`files` where `name` = ? and `tenant_id` = 'x''\\\\'"
+	if stmts.deleteByUUID != want {
+		t.Error("want", want, "got", stmts.deleteByUUID)
+	}
+	want = "insert into `s`.`files`(`name`, `partitioning_count`, `partitioning_sequence`, `data`, `data_size`, `encoding`, `key_id`, `blob_hash`, `created_at`, `tenant_id`)" +
+		" values(?, ?, ?, ?, ?, ?, ?, ?, now(), 'x''\\\\')"
+	if stmts.insert != want {
+		t.Error("want", want, "got", stmts.insert)
+	}
+
+	m := TableMapping{Extra: map[string]string{"tenant_id": "a"}}
+	for _, opts := range []DBOptions{{Metadata: true}, {Versioned: true}, {ChangeFeed: true}} {
+		if err := m.checkOptions(opts); err != ErrExtraUnsupported {
+			t.Errorf("%+v: want ErrExtraUnsupported, got %v", opts, err)
+		}
+	}
+	if err := m.checkOptions(DBOptions{Dedup: true, Compression: EncodingGzip}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialectStorage(t *testing.T) {
+	for _, test := range []struct {
+		packet  int64
+		maxSize int
+		want    int
+	}{
+		{0, DefaultMaxSize, DefaultMaxSize},
+		{64 * 1024 * 1024, DefaultMaxSize, DefaultMaxSize},
+		{4 * 1024 * 1024, DefaultMaxSize, 2*1024*1024 - 32*1024},
+		{1024, DefaultMaxSize, minChunkSize},
+	} {
+		if got := adaptiveChunkSize(test.packet, test.maxSize); got != test.want {
+			t.Error(test.packet, test.maxSize, ": want", test.want, "got", got)
+		}
+	}
+
+	if s := dialectOf("mysql").packetLimit(); s != "select @@max_allowed_packet" {
+		t.Error("unexpected packet limit query", s)
+	}
+	if s := dialectOf("postgres").packetLimit(); s != "" {
+		t.Error("want no packet limit for postgres, got", s)
+	}
+
+	d := dialectOf("postgres")
+	stmts := newStatements(d, TableMapping{Table: "files"})
+	want := `insert into "files"("uuid", "partitioning_count", "partitioning_sequence", "data", "data_size", "encoding", "key_id", "blob_hash", "created_at", "lo_oid")` +
+		` values($1, $2, $3, $4, $5, $6, $7, $8, now(), $9)`
+	if got := d.rebind(stmts.loInsert); got != want {
+		t.Error("want", want, "got", got)
+	}
+	want = `select lo_get("lo_oid", $1, $2) from "files" where "id" = $3`
+	if got := d.rebind(stmts.loRead); got != want {
+		t.Error("want", want, "got", got)
+	}
+	if stmts := newStatements(dialectOf("mysql"), TableMapping{}); stmts.loCreate != "" || stmts.loUnlink != "" {
+		t.Error("large object statements should be empty for mysql")
+	}
+
+	if err := checkStorage(dialectOf("mysql"), DBOptions{Storage: StorageLargeObject}); err != ErrLargeObjectUnsupported {
+		t.Error("want ErrLargeObjectUnsupported, got", err)
+	}
+	if err := checkStorage(d, DBOptions{Storage: StorageLargeObject, Dedup: true}); err == nil {
+		t.Error("want error for large object with dedup")
+	}
+	if storage, err := parseStorage("rows"); err != nil || storage != StorageRows {
+		t.Error("unexpected storage", storage, err)
+	}
+	if _, err := parseStorage("blob"); err == nil {
+		t.Error("want error for unknown storage")
+	}
+}
+
+func TestDialectAgo(t *testing.T) {
+	for _, test := range []struct {
+		driver string
+		ago    string
+		value  interface{}
+	}{
+		{"mysql", "(now() - interval ? microsecond)", int64(90000000)},
+		{"postgres", "(now() - CAST($1 AS BIGINT) * interval '1 microsecond')", int64(90000000)},
+		{"sqlite3", "strftime('%Y-%m-%dT%H:%M:%fZ', 'now', ?)", "-90.000 seconds"},
+		{"sqlserver", "DATEADD(second, @p1, CURRENT_TIMESTAMP)", int64(-90)},
+		{"godror", "(CURRENT_TIMESTAMP - NUMTODSINTERVAL(:1 / 1000, 'SECOND'))", int64(90000)},
+	} {
+		d := dialectOf(test.driver)
+		if ago := d.rebind(d.ago()); ago != test.ago {
+			t.Error(test.driver, ": want", test.ago, "got", ago)
+		}
+		if value := d.agoValue(90 * time.Second); value != test.value {
+			t.Error(test.driver, ": want", test.value, "got", value)
+		}
+	}
+}
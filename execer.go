@@ -0,0 +1,400 @@
+package scopy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	aceql_http "github.com/mei-rune/aceql-http-go"
+)
+
+// execer 屏蔽了 database/sql 和 aceql-http 在执行 sql 上的差异，语句中的参数都用 ? 表示,
+// 由 dialect 负责转换成各个数据库的格式
+type execer interface {
+	exec(query string, args ...interface{}) (int64, error)
+
+	// query 对每一行调用 fn, scan 和 sql.Rows.Scan 的用法一样
+	query(query string, args []interface{}, fn func(scan func(dest ...interface{}) error) error) error
+}
+
+// sqlConn 是 *sql.DB 和 *sql.Tx 的公共接口
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqlExecer struct {
+	conn    sqlConn
+	dialect *dialect
+}
+
+func (e sqlExecer) exec(query string, args ...interface{}) (int64, error) {
+	result, err := e.conn.Exec(e.dialect.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (e sqlExecer) query(query string, args []interface{}, fn func(scan func(dest ...interface{}) error) error) error {
+	rows, err := e.conn.Query(e.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+type sqlhttpExecer struct {
+	st *sqlhttpTarget
+}
+
+func (e sqlhttpExecer) exec(query string, args ...interface{}) (int64, error) {
+	params, err := toParamValues(args)
+	if err != nil {
+		return 0, err
+	}
+
+	retried := false
+retry:
+	sess, err := e.st.GetSession()
+	if err != nil {
+		return 0, err
+	}
+	count, err := e.st.c.ExecuteUpdate(sess, query, params, len(params) > 0)
+	if err != nil {
+		if aceql_http.IsInvalidOrExipredConnection(err) {
+			e.st.ClearSession()
+			if !retried {
+				retried = true
+				goto retry
+			}
+		}
+		return 0, err
+	}
+	return int64(count), nil
+}
+
+func (e sqlhttpExecer) query(query string, args []interface{}, fn func(scan func(dest ...interface{}) error) error) error {
+	// aceql-http 的 ExecuteQuery 不支持参数，所以这里直接将参数拼接到语句中
+	sqlstr, err := inlineArgs(e.st.dialect, query, args)
+	if err != nil {
+		return err
+	}
+
+	retried := false
+retry:
+	sess, err := e.st.GetSession()
+	if err != nil {
+		return err
+	}
+	results, err := e.st.c.ExecuteQuery(sess, sqlstr, nil, true)
+	if err != nil {
+		if aceql_http.IsInvalidOrExipredConnection(err) {
+			e.st.ClearSession()
+			if !retried {
+				retried = true
+				goto retry
+			}
+		}
+		return err
+	}
+
+	selectResults := results.ToSelectResult()
+	if len(selectResults.ResultSets) == 0 {
+		return nil
+	}
+	for _, row := range selectResults.ResultSets[0].Rows {
+		err := fn(func(dest ...interface{}) error {
+			if len(dest) > len(row) {
+				return errors.New("scopy: expected " + strconv.Itoa(len(dest)) + " columns, got " + strconv.Itoa(len(row)))
+			}
+			for idx := range dest {
+				if err := e.assign(sess, dest[idx], row[idx]); err != nil {
+					return errors.New("scopy: colum '" + row[idx].Name + "' is invalid: " + err.Error())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isBlobType(typ string) bool {
+	return typ == aceql_http.CLOB ||
+		typ == aceql_http.BLOB ||
+		typ == aceql_http.BINARY ||
+		typ == aceql_http.LONGVARBINARY ||
+		typ == aceql_http.VARBINARY
+}
+
+func (e sqlhttpExecer) assign(sess *aceql_http.Session, dest interface{}, field aceql_http.FieldValue) error {
+	if bs, ok := dest.(*[]byte); ok {
+		if field.Value == nil {
+			*bs = nil
+			return nil
+		}
+		s := fmt.Sprint(field.Value)
+		if !isBlobType(field.Type) {
+			*bs = []byte(s)
+			return nil
+		}
+		data, err := e.st.c.GetBlob(sess, s)
+		if err != nil {
+			if aceql_http.IsInvalidOrExipredConnection(err) {
+				e.st.ClearSession()
+			}
+			return err
+		}
+		*bs = data
+		return nil
+	}
+	return assignValue(dest, field.Value)
+}
+
+func isNullValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	s, ok := value.(string)
+	return ok && s == "NULL"
+}
+
+// assignValue 将 aceql-http 返回的值转换到 dest 中
+func assignValue(dest interface{}, value interface{}) error {
+	if scanner, ok := dest.(sql.Scanner); ok {
+		if isNullValue(value) {
+			return scanner.Scan(nil)
+		}
+		if f, ok := value.(float64); ok {
+			return scanner.Scan(int64(f))
+		}
+		return scanner.Scan(fmt.Sprint(value))
+	}
+
+	s := fmt.Sprint(value)
+	switch d := dest.(type) {
+	case *string:
+		if isNullValue(value) {
+			*d = ""
+			return nil
+		}
+		*d = s
+	case *int:
+		if isNullValue(value) {
+			*d = 0
+			return nil
+		}
+		i, err := parseInt(value)
+		if err != nil {
+			return err
+		}
+		*d = int(i)
+	case *int64:
+		if isNullValue(value) {
+			*d = 0
+			return nil
+		}
+		i, err := parseInt(value)
+		if err != nil {
+			return err
+		}
+		*d = i
+	case *bool:
+		if isNullValue(value) {
+			*d = false
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			i, e := parseInt(value)
+			if e != nil {
+				return err
+			}
+			b = i != 0
+		}
+		*d = b
+	case *time.Time:
+		if isNullValue(value) {
+			*d = time.Time{}
+			return nil
+		}
+		t, err := ToDatetime(s)
+		if err != nil {
+			return err
+		}
+		*d = t
+	case *interface{}:
+		*d = value
+	default:
+		return fmt.Errorf("unsupported dest type %T", dest)
+	}
+	return nil
+}
+
+func parseInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	}
+	return strconv.ParseInt(strings.TrimSpace(fmt.Sprint(value)), 10, 64)
+}
+
+func toParamValues(args []interface{}) ([]aceql_http.ParamValue, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	params := make([]aceql_http.ParamValue, 0, len(args))
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.VARCHAR, Value: v})
+		case int:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.INTEGER, Value: strconv.Itoa(v)})
+		case int64:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.BIGINT, Value: strconv.FormatInt(v, 10)})
+		case bool:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.BIT, Value: strconv.FormatBool(v)})
+		case time.Time:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.TIMESTAMP, Value: strconv.FormatInt(v.UnixMilli(), 10)})
+		case []byte:
+			params = append(params, aceql_http.ParamValue{Type: aceql_http.BLOB, Blob: v})
+		default:
+			return nil, fmt.Errorf("scopy: unsupported parameter type %T", arg)
+		}
+	}
+	return params, nil
+}
+
+// inlineArgs 将语句中的 ? 替换为参数在数据库 d 中的字面值，字符串中的 ? 不会被替换
+func inlineArgs(d *dialect, query string, args []interface{}) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+
+	var sb strings.Builder
+	inString := false
+	argIdx := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inString = !inString
+		}
+		if c != '?' || inString {
+			sb.WriteByte(c)
+			continue
+		}
+		if argIdx >= len(args) {
+			return "", errors.New("scopy: not enough arguments for '" + query + "'")
+		}
+		literal, err := d.sqlLiteral(args[argIdx])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(literal)
+		argIdx++
+	}
+	if argIdx != len(args) {
+		return "", errors.New("scopy: too many arguments for '" + query + "'")
+	}
+	return sb.String(), nil
+}
+
+// sqlLiteral 返回参数的字面值, 字符串按数据库的规则转义 (mysql 中的 \ 也是转义字符),
+// 时间换算为 UTC 后保留毫秒或微秒
+func (d *dialect) sqlLiteral(arg interface{}) (string, error) {
+	switch v := arg.(type) {
+	case string:
+		return d.literal(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		v = v.UTC()
+		switch d.name {
+		case DialectSQLite, DialectMSSQL:
+			// 和 sqlite 中 now() 写入的格式一样
+			return "'" + v.Format("2006-01-02T15:04:05.000Z") + "'", nil
+		case DialectPostgres:
+			return "'" + v.Format("2006-01-02 15:04:05.000000+00:00") + "'", nil
+		case DialectOracle:
+			return "TIMESTAMP '" + v.Format("2006-01-02 15:04:05.000000 +00:00") + "'", nil
+		case DialectMySQL:
+			// 老版本的 mysql 不支持带时区的字面值，换算为会话的时区
+			return "CONVERT_TZ('" + v.Format("2006-01-02 15:04:05.000000") + "', '+00:00', @@session.time_zone)", nil
+		}
+		return "'" + v.Format("2006-01-02 15:04:05.000000") + "'", nil
+	}
+	return "", fmt.Errorf("scopy: unsupported parameter type %T", arg)
+}
+
+// inTx 在一个事务中执行 fn, fn 返回错误时回滚。 绑定了调用者的事务时直接在它里面执行
+func (st *dbTarget) inTx(fn func(e execer) error) error {
+	if st.tx != nil {
+		return fn(sqlExecer{conn: st.tx, dialect: st.dialect})
+	}
+	tx, err := st.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(sqlExecer{conn: tx, dialect: st.dialect}); err != nil {
+		return joinError(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// inTx 在 aceql 的连接上关闭自动提交后执行 fn, fn 返回错误时回滚, 最后恢复自动提交。
+// 在批处理中时直接在批处理的连接上执行。 执行的过程中会话失效时不会重新登录，返回 errBatchSessionLost
+func (st *sqlhttpTarget) inTx(fn func(e execer) error) error {
+	if st.batch {
+		return fn(st.execer())
+	}
+	sess, err := st.GetSession()
+	if err != nil {
+		return err
+	}
+	if err := aceqlCall(st.c, sess, "set_auto_commit/false"); err != nil {
+		if aceql_http.IsInvalidOrExipredConnection(err) {
+			st.ClearSession()
+		}
+		return err
+	}
+
+	bound := *st
+	bound.batch = true
+	err = fn(bound.execer())
+	if bound.sess != sess {
+		// 服务器已经丢弃了没有提交的语句
+		st.ClearSession()
+		return joinError(err, errBatchSessionLost)
+	}
+	if err != nil {
+		err = joinError(err, aceqlCall(st.c, sess, "rollback"))
+	} else if err = aceqlCall(st.c, sess, "commit"); err != nil {
+		err = joinError(err, aceqlCall(st.c, sess, "rollback"))
+	}
+	return joinError(err, aceqlCall(st.c, sess, "set_auto_commit/true"))
+}
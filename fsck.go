@@ -0,0 +1,308 @@
+package scopy
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FsckProblem 是文件的问题，可以是多个问题的组合
+type FsckProblem int
+
+const (
+	// FsckMissingSequence 表示块的序号不连续或者不是从 0 开始的
+	FsckMissingSequence FsckProblem = 1 << iota
+
+	// FsckDuplicateSequence 表示有多个序号相同的块， 表上没有唯一约束时才会出现
+	FsckDuplicateSequence
+
+	// FsckMissingFinal 表示最后一块的 partitioning_count 不是 DataNone, 文件没有写完
+	FsckMissingFinal
+
+	// FsckZeroLength 表示多个块的文件中有长度为 0 的块
+	FsckZeroLength
+
+	// FsckChecksum 表示文件的大小或 sha256 和元数据表中的不一致
+	FsckChecksum
+)
+
+func (p FsckProblem) String() string {
+	var names []string
+	for _, item := range []struct {
+		problem FsckProblem
+		name    string
+	}{
+		{FsckMissingSequence, "missing sequence"},
+		{FsckDuplicateSequence, "duplicate sequence"},
+		{FsckMissingFinal, "missing final chunk"},
+		{FsckZeroLength, "zero-length chunk"},
+		{FsckChecksum, "checksum mismatch"},
+	} {
+		if p&item.problem != 0 {
+			names = append(names, item.name)
+		}
+	}
+	if len(names) == 0 {
+		return "ok"
+	}
+	return strings.Join(names, ", ")
+}
+
+// FsckRepair 指定如何处理有问题的文件
+type FsckRepair int
+
+const (
+	// FsckReport 只报告问题
+	FsckReport FsckRepair = iota
+
+	// FsckQuarantine 将有问题的文件移到 FsckOptions.QuarantineDir 目录下
+	FsckQuarantine
+
+	// FsckDelete 删除有问题的文件
+	FsckDelete
+)
+
+// ParseFsckRepair 解析 "report", "quarantine" 和 "delete", 空字符串为 FsckReport
+func ParseFsckRepair(s string) (FsckRepair, error) {
+	switch strings.ToLower(s) {
+	case "", "none", "report":
+		return FsckReport, nil
+	case "quarantine":
+		return FsckQuarantine, nil
+	case "delete":
+		return FsckDelete, nil
+	}
+	return FsckReport, errors.New("fsck repair mode '" + s + "' is unsupported")
+}
+
+const DefaultQuarantineDir = ".quarantine"
+
+// FsckOptions 是检查文件的选项
+type FsckOptions struct {
+	// Dir 不为空时只检查这个目录下的文件
+	Dir string
+
+	// Checksum 为 true 时读取文件的内容，和元数据表中的大小和 sha256 比较，需要启用 DBOptions.Metadata
+	Checksum bool
+
+	Repair FsckRepair
+
+	// QuarantineDir 是隔离有问题的文件的目录，为空时用 DefaultQuarantineDir, 这个目录下的文件不会被检查
+	QuarantineDir string
+}
+
+// FsckFile 是一个有问题的文件
+type FsckFile struct {
+	Path     string
+	Chunks   int
+	Size     int64
+	Problems FsckProblem
+
+	// Repaired 为 true 时文件已经被隔离或删除
+	Repaired bool
+}
+
+type fsckState struct {
+	file      FsckFile
+	next      int
+	lastCount int
+	zeros     int
+}
+
+// scanFiles 检查所有块的序号、标记和大小，不读取数据。 在大小写不敏感的排序规则下不同文件的块可能交错，所以按 uuid 分组
+func scanFiles(e execer, stmts *sqlStatements, dir string) (map[string]*fsckState, error) {
+	query, args := stmts.fsckScan, []interface{}(nil)
+	prefix := dirPrefix(dir)
+	if prefix != "" {
+		query, args = stmts.fsckScanPrefix, prefixArgs(prefix)
+	}
+
+	files := map[string]*fsckState{}
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		var uuid string
+		var count, seq sql.NullInt64
+		var size sql.NullInt64
+		if err := scan(&uuid, &count, &seq, &size); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(uuid, prefix) {
+			return nil
+		}
+
+		st := files[uuid]
+		if st == nil {
+			st = &fsckState{file: FsckFile{Path: uuid}}
+			files[uuid] = st
+		}
+		if int(seq.Int64) < st.next {
+			st.file.Problems |= FsckDuplicateSequence
+		} else if int(seq.Int64) != st.next {
+			st.file.Problems |= FsckMissingSequence
+		}
+		st.next = int(seq.Int64) + 1
+		st.lastCount = int(count.Int64)
+		if size.Int64 == 0 {
+			st.zeros++
+		}
+		st.file.Chunks++
+		st.file.Size += size.Int64
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range files {
+		if st.lastCount != DataNone {
+			st.file.Problems |= FsckMissingFinal
+		}
+		if st.zeros > 0 && st.file.Chunks > 1 {
+			st.file.Problems |= FsckZeroLength
+		}
+	}
+	return files, nil
+}
+
+// verifyChecksum 读取文件并和元数据比较
+func verifyChecksum(read func(string) (io.ReadCloser, error), uuid string, meta *FileMeta) (bool, error) {
+	r, err := read(uuid)
+	if err != nil {
+		if errors.Is(err, ErrIndexSequence) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return n == meta.Size && hex.EncodeToString(h.Sum(nil)) == meta.Hash, nil
+}
+
+func runFsck(st tableStore, stmts *sqlStatements, opts DBOptions, read func(string) (io.ReadCloser, error), fsckOpts FsckOptions) ([]FsckFile, error) {
+	quarantine := fsckOpts.QuarantineDir
+	if quarantine == "" {
+		quarantine = DefaultQuarantineDir
+	}
+	// 有命名空间时只检查命名空间中的文件，隔离目录也在命名空间中
+	quarantine = dirPrefix(opts.dir(quarantine))
+
+	files, err := scanFiles(st.execer(), stmts, opts.dir(fsckOpts.Dir))
+	if err != nil {
+		return nil, err
+	}
+
+	if fsckOpts.Checksum && opts.Metadata {
+		metas := map[string]*FileMeta{}
+		err := st.execer().query(stmts.metaList, nil, func(scan func(dest ...interface{}) error) error {
+			uuid, meta, err := scanMeta(scan)
+			if err != nil {
+				return err
+			}
+			if meta.Hash != "" {
+				metas[uuid] = meta
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for uuid, state := range files {
+			meta := metas[uuid]
+			if meta == nil || state.file.Problems != 0 || strings.HasPrefix(uuid, quarantine) {
+				continue
+			}
+			// read 是 target 的 Read, 它会加上命名空间的前缀
+			ok, err := verifyChecksum(read, opts.path(uuid), meta)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				state.file.Problems |= FsckChecksum
+			}
+		}
+	}
+
+	var broken []FsckFile
+	for uuid, state := range files {
+		if state.file.Problems != 0 && !strings.HasPrefix(uuid, quarantine) {
+			broken = append(broken, state.file)
+		}
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		return broken[i].Path < broken[j].Path
+	})
+
+	uuids := make([]string, len(broken))
+	for idx := range broken {
+		uuids[idx] = broken[idx].Path
+		broken[idx].Path = opts.path(uuids[idx])
+	}
+
+	for idx := range broken {
+		switch fsckOpts.Repair {
+		case FsckQuarantine:
+			err = quarantineFile(st, stmts, opts, uuids[idx], quarantine+broken[idx].Path)
+		case FsckDelete:
+			_, err = purgeFiles(st, stmts, opts, []gcFile{{uuid: uuids[idx], size: broken[idx].Size}})
+		default:
+			continue
+		}
+		if err != nil {
+			return broken, err
+		}
+		broken[idx].Repaired = true
+	}
+	return broken, nil
+}
+
+// quarantineFile 将文件移到隔离目录, 隔离目录中同名的文件会被覆盖
+func quarantineFile(st tableStore, stmts *sqlStatements, opts DBOptions, from, to string) error {
+	return st.inTx(func(e execer) error {
+		if err := releaseFile(e, stmts, opts, to); err != nil {
+			return err
+		}
+		if _, err := e.exec(stmts.deleteByUUID, to); err != nil {
+			return err
+		}
+		if _, err := e.exec(stmts.rename, to, from); err != nil {
+			return err
+		}
+		if err := resealFile(e, stmts, opts.Keys, from, to, true); err != nil {
+			return err
+		}
+		if opts.Metadata {
+			if _, err := e.exec(stmts.metaDelete, to); err != nil {
+				return err
+			}
+			if _, err := e.exec(stmts.metaRename, to, from); err != nil {
+				return err
+			}
+		}
+		if err := logChange(e, stmts, opts, ChangeDelete, from); err != nil {
+			return err
+		}
+		return logChange(e, stmts, opts, ChangeWrite, to)
+	})
+}
+
+// Fsck 检查文件的块是否完整，返回有问题的文件，启用了修复时将它们隔离或删除。 有命名空间时只检查命名空间中的文件
+func (st *dbTarget) Fsck(fsckOpts FsckOptions) ([]FsckFile, error) {
+	return runFsck(st, st.stmts, st.opts, st.Read, fsckOpts)
+}
+
+// Fsck 检查文件的块是否完整，返回有问题的文件，启用了修复时将它们隔离或删除。 有命名空间时只检查命名空间中的文件
+func (st *sqlhttpTarget) Fsck(fsckOpts FsckOptions) ([]FsckFile, error) {
+	return runFsck(st, st.stmts, st.opts, st.Read, fsckOpts)
+}
@@ -0,0 +1,242 @@
+package scopy
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultGCBatchSize     = 100
+	DefaultGCIncompleteAge = time.Hour
+)
+
+// GCOptions 是清理文件表的选项
+type GCOptions struct {
+	// Retention 大于 0 时删除最后一次写入早于 Retention 之前的文件
+	Retention time.Duration
+
+	// MaxTotalSize 大于 0 时从最旧的文件开始删除，直到所有文件的总大小不超过它
+	MaxTotalSize int64
+
+	// IncompleteAge 是没有写完的文件 (没有 partitioning_count 为 DataNone 的块) 被删除前至少要经过的时间,
+	// 以免删除正在写的文件。为 0 时用 DefaultGCIncompleteAge, 小于 0 时不清理没有写完的文件
+	IncompleteAge time.Duration
+
+	// BatchSize 是一个事务中最多删除的文件数，为 0 时用 DefaultGCBatchSize
+	BatchSize int
+
+	// RecountBlobs 为 true 时在删除没有引用的 blob 之前重新计算所有 blob 的引用计数, 用于修正关闭去重模式后删除的文件
+	RecountBlobs bool
+}
+
+// GCResult 是清理的结果
+type GCResult struct {
+	Files      int64 // 因为过期或超过配额被删除的文件数
+	Incomplete int64 // 被删除的没有写完的文件数
+	Bytes      int64 // 被删除的数据的大小
+	Versions   int64 // 启用了 DBOptions.Versioned 时被删除的过期的历史版本的块数
+	Blobs      int64 // 启用了 DBOptions.Dedup 时被删除的没有引用的 blob 数
+	Changes    int64 // 启用了 DBOptions.ChangeFeed 时被删除的过期的变更记录数
+}
+
+// tableStore 是 dbTarget 和 sqlhttpTarget 的公共部分
+type tableStore interface {
+	execer() execer
+	inTx(fn func(e execer) error) error
+}
+
+type gcFile struct {
+	uuid string
+	size int64
+}
+
+// selectGCFiles 返回 query 选出的以 prefix 开头的文件
+func selectGCFiles(e execer, query string, args []interface{}, prefix string) ([]gcFile, error) {
+	var files []gcFile
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		var file gcFile
+		var size sql.NullInt64
+		if err := scan(&file.uuid, &size); err != nil {
+			return err
+		}
+		// 在大小写不敏感的排序规则下，范围查询的结果可能多一些
+		if !strings.HasPrefix(file.uuid, prefix) {
+			return nil
+		}
+		file.size = size.Int64
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// purgeFiles 在一个事务中删除文件，不会保存历史版本
+func purgeFiles(st tableStore, stmts *sqlStatements, opts DBOptions, files []gcFile) (int64, error) {
+	var bytes int64
+	err := st.inTx(func(e execer) error {
+		bytes = 0
+		for _, file := range files {
+			if err := releaseFile(e, stmts, opts, file.uuid); err != nil {
+				return err
+			}
+			if _, err := e.exec(stmts.deleteByUUID, file.uuid); err != nil {
+				return err
+			}
+			if opts.Metadata {
+				if _, err := e.exec(stmts.metaDelete, file.uuid); err != nil {
+					return err
+				}
+			}
+			if err := logChange(e, stmts, opts, ChangeDelete, file.uuid); err != nil {
+				return err
+			}
+			bytes += file.size
+		}
+		return nil
+	})
+	return bytes, err
+}
+
+// purgeBatches 分批删除 query 选出的文件, 直到没有符合条件的文件
+func purgeBatches(st tableStore, stmts *sqlStatements, opts DBOptions, query string, args []interface{}) (int64, int64, error) {
+	var count, bytes int64
+	for {
+		files, err := selectGCFiles(st.execer(), query, args, opts.namespacePrefix())
+		if err != nil {
+			return count, bytes, err
+		}
+		if len(files) == 0 {
+			return count, bytes, nil
+		}
+		n, err := purgeFiles(st, stmts, opts, files)
+		if err != nil {
+			return count, bytes, err
+		}
+		count += int64(len(files))
+		bytes += n
+	}
+}
+
+// runGC 清理文件表, 有命名空间时只删除命名空间中的文件和变更。 没有引用的 blob 不属于任何命名空间，总是在整个表中清理
+func runGC(st tableStore, stmts *sqlStatements, d *dialect, opts DBOptions, gcOpts GCOptions) (GCResult, error) {
+	var result GCResult
+	prefix := opts.namespacePrefix()
+	// scoped 在有命名空间时返回 *Prefix 语句，前缀的参数在前面
+	scoped := func(query, prefixQuery string, args ...interface{}) (string, []interface{}) {
+		if prefix == "" {
+			return query, args
+		}
+		return prefixQuery, append(prefixArgs(prefix), args...)
+	}
+
+	batchSize := gcOpts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultGCBatchSize
+	}
+	incompleteAge := gcOpts.IncompleteAge
+	if incompleteAge == 0 {
+		incompleteAge = DefaultGCIncompleteAge
+	}
+	if incompleteAge > 0 {
+		query, args := scoped(stmts.gcIncomplete, stmts.gcIncompletePrefix, d.agoValue(incompleteAge))
+		count, bytes, err := purgeBatches(st, stmts, opts, query+d.limit(batchSize), args)
+		result.Incomplete += count
+		result.Bytes += bytes
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if gcOpts.Retention > 0 {
+		query, args := scoped(stmts.gcExpired, stmts.gcExpiredPrefix, d.agoValue(gcOpts.Retention))
+		count, bytes, err := purgeBatches(st, stmts, opts, query+d.limit(batchSize), args)
+		result.Files += count
+		result.Bytes += bytes
+		if err != nil {
+			return result, err
+		}
+
+		if opts.Versioned {
+			count, err := pruneVersions(st.execer(), stmts, d, opts, "", 0, time.Now().Add(-gcOpts.Retention))
+			result.Versions += count
+			if err != nil {
+				return result, err
+			}
+		}
+		if opts.ChangeFeed {
+			query, args := scoped(stmts.changePrune, stmts.changePrunePrefix, d.agoValue(gcOpts.Retention))
+			count, err := st.execer().exec(query, args...)
+			result.Changes += count
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if gcOpts.MaxTotalSize > 0 {
+		var total sql.NullInt64
+		if prefix == "" {
+			err := st.execer().query(stmts.totalSize, nil, func(scan func(dest ...interface{}) error) error {
+				return scan(&total)
+			})
+			if err != nil {
+				return result, err
+			}
+		} else {
+			usage, err := namespaceUsage(st.execer(), stmts, opts)
+			if err != nil {
+				return result, err
+			}
+			total.Int64 = usage.Bytes
+		}
+
+		query, args := scoped(stmts.gcOldest, stmts.gcOldestPrefix)
+		for total.Int64 > gcOpts.MaxTotalSize {
+			files, err := selectGCFiles(st.execer(), query+d.limit(batchSize), args, prefix)
+			if err != nil {
+				return result, err
+			}
+			if len(files) == 0 {
+				break
+			}
+
+			// 只删除超出配额的部分
+			remain := total.Int64
+			for idx, file := range files {
+				remain -= file.size
+				if remain <= gcOpts.MaxTotalSize {
+					files = files[:idx+1]
+					break
+				}
+			}
+			bytes, err := purgeFiles(st, stmts, opts, files)
+			if err != nil {
+				return result, err
+			}
+			result.Files += int64(len(files))
+			result.Bytes += bytes
+			total.Int64 -= bytes
+		}
+	}
+
+	if opts.Dedup || gcOpts.RecountBlobs {
+		count, err := gcBlobs(st, stmts, d, batchSize, gcOpts.RecountBlobs)
+		result.Blobs += count
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// GC 清理文件表，删除没有写完的文件、过期的文件和超过配额的文件，每批删除的文件在一个事务中。
+// 有命名空间时只清理命名空间中的文件, MaxTotalSize 是命名空间的总大小
+func (st *dbTarget) GC(gcOpts GCOptions) (GCResult, error) {
+	return runGC(st, st.stmts, st.dialect, st.opts, gcOpts)
+}
+
+// GC 清理文件表，删除没有写完的文件、过期的文件和超过配额的文件, 有命名空间时只清理命名空间中的文件
+func (st *sqlhttpTarget) GC(gcOpts GCOptions) (GCResult, error) {
+	return runGC(st, st.stmts, st.dialect, st.opts, gcOpts)
+}
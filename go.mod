@@ -1,9 +1,11 @@
 module github.com/mei-rune/scopy
 
-go 1.21.0
+go 1.22
 
 require (
 	github.com/go-sql-driver/mysql v1.7.1
+	github.com/klauspost/compress v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/mei-rune/aceql-http-go v0.0.0-20231010125607-1bd1d1177753
 	github.com/mei-rune/shell v0.0.0-20231010140236-d79e05ee32a2
 	github.com/pkg/sftp v1.13.6
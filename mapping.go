@@ -0,0 +1,140 @@
+package scopy
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// mappedColumns 是文件表中可以改名的列
+var mappedColumns = []string{"id", "uuid", "partitioning_count", "partitioning_sequence", "data",
+	"data_size", "created_at", "encoding", "key_id", "blob_hash", "claimed_by", "claimed_at", "lo_oid"}
+
+// TableMapping 是文件表的表名和列名的映射，用于使用已有的表。
+// 列名的映射同样用于 scopy 维护的 "<表名>_meta"、"<表名>_versions" 和 "<表名>_blobs" 表
+type TableMapping struct {
+	// Schema 是表所在的 schema 或数据库，为空时使用连接的默认 schema
+	Schema string
+
+	// Table 是表名，为空时为 tpt_files
+	Table string
+
+	// Columns 是默认的列名到实际的列名的映射，如 {"uuid": "file_name", "data": "content"},
+	// 可以改名的列见 mappedColumns
+	Columns map[string]string
+
+	// Extra 是额外的常量列，如 {"tenant_id": "x"}, 写入时填入这些值，读取时只读取列的值与它相同的行。
+	// 它只作用于文件表，不能和 DBOptions 中的 Metadata、Versioned 和 ChangeFeed 一起使用, SetOptions 会返回 ErrExtraUnsupported
+	Extra map[string]string
+}
+
+// name 返回带有 schema 的表名
+func (m *TableMapping) name() string {
+	table := m.Table
+	if table == "" {
+		table = "tpt_files"
+	}
+	if m.Schema != "" {
+		return m.Schema + "." + table
+	}
+	return table
+}
+
+// column 返回默认的列名对应的实际列名
+func (m *TableMapping) column(name string) string {
+	if s := m.Columns[name]; s != "" {
+		return s
+	}
+	return name
+}
+
+// extraColumns 返回按列名排序的额外列
+func (m *TableMapping) extraColumns() []string {
+	columns := make([]string, 0, len(m.Extra))
+	for column := range m.Extra {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func (m *TableMapping) validate() error {
+	for name, column := range m.Columns {
+		known := false
+		for _, s := range mappedColumns {
+			if s == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("scopy: column '" + name + "' can not be mapped")
+		}
+		if column == "" {
+			return errors.New("scopy: column '" + name + "' is mapped to an empty name")
+		}
+	}
+	for column := range m.Extra {
+		if column == "" {
+			return errors.New("scopy: extra column name is empty")
+		}
+		for _, s := range mappedColumns {
+			if m.column(s) == column {
+				return errors.New("scopy: extra column '" + column + "' conflicts with column '" + s + "'")
+			}
+		}
+	}
+	return nil
+}
+
+// ErrExtraUnsupported 表示 TableMapping.Extra 和元数据、历史版本或变更记录一起使用,
+// 它们的表中没有额外的列，不能按额外的列区分文件
+var ErrExtraUnsupported = errors.New("scopy: extra columns can not be used with Metadata, Versioned or ChangeFeed")
+
+// checkOptions 检查可选功能和映射是否兼容
+func (m *TableMapping) checkOptions(opts DBOptions) error {
+	if len(m.Extra) > 0 && (opts.Metadata || opts.Versioned || opts.ChangeFeed) {
+		return ErrExtraUnsupported
+	}
+	return nil
+}
+
+// literal 返回字符串常量
+func (d *dialect) literal(s string) string {
+	if d.name == DialectMySQL {
+		s = strings.Replace(s, `\`, `\\`, -1)
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// parseTableMapping 从 url 参数中读取 TableMapping, 读过的参数会被删除，以免传给数据库驱动。
+// 参数有 sc_dbtable, sc_dbschema, sc_dbcolumn_<默认的列名>=<实际的列名> 和 sc_dbextra_<列名>=<值>
+func parseTableMapping(queryParams url.Values) (TableMapping, error) {
+	m := TableMapping{
+		Schema: queryParams.Get("sc_dbschema"),
+		Table:  queryParams.Get("sc_dbtable"),
+	}
+	queryParams.Del("sc_dbschema")
+	queryParams.Del("sc_dbtable")
+
+	for key := range queryParams {
+		if name := strings.TrimPrefix(key, "sc_dbcolumn_"); name != key {
+			if m.Columns == nil {
+				m.Columns = map[string]string{}
+			}
+			m.Columns[name] = queryParams.Get(key)
+			queryParams.Del(key)
+		} else if name := strings.TrimPrefix(key, "sc_dbextra_"); name != key {
+			if m.Extra == nil {
+				m.Extra = map[string]string{}
+			}
+			m.Extra[name] = queryParams.Get(key)
+			queryParams.Del(key)
+		}
+	}
+	if err := m.validate(); err != nil {
+		return m, errWrap(err, "参数 sc_dbcolumn_ 或 sc_dbextra_ 不正确")
+	}
+	return m, nil
+}
@@ -0,0 +1,421 @@
+package scopy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjected 是 MemOptions 注入的故障
+var ErrInjected = errors.New("scopy: injected failure")
+
+// MemOptions 用于在内存 Session 上注入故障，方便测试
+type MemOptions struct {
+	// FailWriteN 表示第 N 次写操作 (Write 或 WriteFile) 返回 ErrInjected，0 表示不注入
+	FailWriteN int
+
+	// Latency 是每个操作前的延迟
+	Latency time.Duration
+
+	// TruncateRead 表示读取时最多只返回前 N 个字节，0 表示不截断
+	TruncateRead int64
+}
+
+var memStores = struct {
+	sync.Mutex
+	byName map[string]*memStore
+}{
+	byName: map[string]*memStore{},
+}
+
+// Mem 返回名为 name 的内存 Session，同名的 Session 共享同一份数据，
+// 数据在进程内一直存在，直到调用 ResetMem
+func Mem(name string) *memTarget {
+	return MemWithOptions(name, MemOptions{})
+}
+
+func MemWithOptions(name string, opts MemOptions) *memTarget {
+	memStores.Lock()
+	defer memStores.Unlock()
+
+	store := memStores.byName[name]
+	if store == nil {
+		store = newMemStore()
+		memStores.byName[name] = store
+	}
+	return &memTarget{
+		store: store,
+		opts:  opts,
+	}
+}
+
+// ResetMem 清除名为 name 的内存 Session 中的所有数据
+func ResetMem(name string) {
+	memStores.Lock()
+	defer memStores.Unlock()
+	delete(memStores.byName, name)
+}
+
+type memNode struct {
+	name     string
+	isDir    bool
+	data     []byte
+	modTime  time.Time
+	children map[string]*memNode
+}
+
+func (n *memNode) stat() *memFileInfo {
+	return &memFileInfo{
+		name:    n.name,
+		isDir:   n.isDir,
+		size:    int64(len(n.data)),
+		modTime: n.modTime,
+	}
+}
+
+type memFileInfo struct {
+	name    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+func (fi *memFileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type memStore struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		root: &memNode{
+			isDir:    true,
+			modTime:  time.Now(),
+			children: map[string]*memNode{},
+		},
+	}
+}
+
+func splitMemPath(pa string) []string {
+	pa = strings.Trim(path.Clean("/"+strings.Replace(pa, "\\", "/", -1)), "/")
+	if pa == "" {
+		return nil
+	}
+	return strings.Split(pa, "/")
+}
+
+// lookup 必须在持有锁时调用
+func (s *memStore) lookup(names []string) *memNode {
+	node := s.root
+	for _, name := range names {
+		if !node.isDir {
+			return nil
+		}
+		node = node.children[name]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// mkdirAll 必须在持有写锁时调用
+func (s *memStore) mkdirAll(op string, names []string) (*memNode, error) {
+	node := s.root
+	for idx, name := range names {
+		child := node.children[name]
+		if child == nil {
+			child = &memNode{
+				name:     name,
+				isDir:    true,
+				modTime:  time.Now(),
+				children: map[string]*memNode{},
+			}
+			node.children[name] = child
+			node.modTime = child.modTime
+		} else if !child.isDir {
+			return nil, &fs.PathError{Op: op, Path: strings.Join(names[:idx+1], "/"), Err: errors.New("not a directory")}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (s *memStore) put(pa string, data []byte) error {
+	names := splitMemPath(pa)
+	if len(names) == 0 {
+		return &fs.PathError{Op: "write", Path: pa, Err: fs.ErrInvalid}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parent, err := s.mkdirAll("write", names[:len(names)-1])
+	if err != nil {
+		return err
+	}
+	name := names[len(names)-1]
+	if old := parent.children[name]; old != nil && old.isDir {
+		return &fs.PathError{Op: "write", Path: pa, Err: errors.New("is a directory")}
+	}
+
+	now := time.Now()
+	parent.children[name] = &memNode{
+		name:    name,
+		data:    data,
+		modTime: now,
+	}
+	parent.modTime = now
+	return nil
+}
+
+type memTarget struct {
+	store *memStore
+	opts  MemOptions
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (st *memTarget) Close() error {
+	return nil
+}
+
+func (st *memTarget) delay() {
+	if st.opts.Latency > 0 {
+		time.Sleep(st.opts.Latency)
+	}
+}
+
+func (st *memTarget) injectWrite() error {
+	if st.opts.FailWriteN <= 0 {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.writes++
+	if st.writes == st.opts.FailWriteN {
+		return ErrInjected
+	}
+	return nil
+}
+
+// Stat 返回文件或目录的信息
+func (st *memTarget) Stat(remotePath string) (fs.FileInfo, error) {
+	st.delay()
+
+	st.store.mu.RLock()
+	defer st.store.mu.RUnlock()
+
+	node := st.store.lookup(splitMemPath(remotePath))
+	if node == nil {
+		return nil, &fs.PathError{Op: "stat", Path: remotePath, Err: fs.ErrNotExist}
+	}
+	return node.stat(), nil
+}
+
+func (st *memTarget) List(remotePath string) ([]fs.FileInfo, error) {
+	st.delay()
+
+	st.store.mu.RLock()
+	defer st.store.mu.RUnlock()
+
+	node := st.store.lookup(splitMemPath(remotePath))
+	if node == nil {
+		return nil, &fs.PathError{Op: "list", Path: remotePath, Err: fs.ErrNotExist}
+	}
+	if !node.isDir {
+		return nil, &fs.PathError{Op: "list", Path: remotePath, Err: errors.New("not a directory")}
+	}
+
+	list := make([]fs.FileInfo, 0, len(node.children))
+	for _, child := range node.children {
+		list = append(list, child.stat())
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Name() < list[b].Name()
+	})
+	return list, nil
+}
+
+type memFileReader struct {
+	*bytes.Reader
+}
+
+func (r memFileReader) Close() error {
+	return nil
+}
+
+func (st *memTarget) Read(remotePath string) (io.ReadCloser, error) {
+	st.delay()
+
+	st.store.mu.RLock()
+	node := st.store.lookup(splitMemPath(remotePath))
+	st.store.mu.RUnlock()
+
+	if node == nil {
+		return nil, &fs.PathError{Op: "open", Path: remotePath, Err: fs.ErrNotExist}
+	}
+	if node.isDir {
+		return nil, &fs.PathError{Op: "open", Path: remotePath, Err: errors.New("is a directory")}
+	}
+
+	// node.data 写入后不会再被修改，所以这里不需要复制
+	data := node.data
+	if st.opts.TruncateRead > 0 && int64(len(data)) > st.opts.TruncateRead {
+		data = data[:st.opts.TruncateRead]
+	}
+	return memFileReader{Reader: bytes.NewReader(data)}, nil
+}
+
+type memFileWriter struct {
+	st     *memTarget
+	path   string
+	buffer bytes.Buffer
+	closed bool
+	err    error // 写入失败后 Close 丢弃已写入的数据，返回这个错误
+}
+
+func (w *memFileWriter) Write(data []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.st.injectWrite(); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return w.buffer.Write(data)
+}
+
+func (w *memFileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.err != nil {
+		w.buffer.Reset()
+		return w.err
+	}
+	return w.st.store.put(w.path, w.buffer.Bytes())
+}
+
+// Write 返回的 io.WriteCloser 在 Close 时才会将数据提交，在此之前读取到的还是旧内容
+func (st *memTarget) Write(remotePath string) (io.WriteCloser, error) {
+	st.delay()
+
+	if len(splitMemPath(remotePath)) == 0 {
+		return nil, &fs.PathError{Op: "write", Path: remotePath, Err: fs.ErrInvalid}
+	}
+	return &memFileWriter{
+		st:   st,
+		path: remotePath,
+	}, nil
+}
+
+func (st *memTarget) WriteFile(remotePath string, data []byte) error {
+	st.delay()
+
+	if err := st.injectWrite(); err != nil {
+		return err
+	}
+	return st.store.put(remotePath, append([]byte(nil), data...))
+}
+
+func (st *memTarget) Exists(pa string) (bool, error) {
+	st.delay()
+
+	st.store.mu.RLock()
+	defer st.store.mu.RUnlock()
+	return st.store.lookup(splitMemPath(pa)) != nil, nil
+}
+
+func (st *memTarget) Rename(from, to string) error {
+	st.delay()
+
+	fromNames := splitMemPath(from)
+	toNames := splitMemPath(to)
+	if len(fromNames) == 0 || len(toNames) == 0 {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrInvalid}
+	}
+	if len(toNames) > len(fromNames) &&
+		strings.Join(toNames[:len(fromNames)], "/") == strings.Join(fromNames, "/") {
+		return &fs.PathError{Op: "rename", Path: from, Err: errors.New("cannot move a directory into itself")}
+	}
+
+	st.store.mu.Lock()
+	defer st.store.mu.Unlock()
+
+	fromParent := st.store.lookup(fromNames[:len(fromNames)-1])
+	if fromParent == nil || !fromParent.isDir {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+	node := fromParent.children[fromNames[len(fromNames)-1]]
+	if node == nil {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+
+	toParent, err := st.store.mkdirAll("rename", toNames[:len(toNames)-1])
+	if err != nil {
+		return err
+	}
+	name := toNames[len(toNames)-1]
+	if old := toParent.children[name]; old != nil && old.isDir && len(old.children) > 0 {
+		return &fs.PathError{Op: "rename", Path: to, Err: fs.ErrExist}
+	}
+
+	now := time.Now()
+	delete(fromParent.children, node.name)
+	fromParent.modTime = now
+	node.name = name
+	toParent.children[name] = node
+	toParent.modTime = now
+	return nil
+}
+
+// Delete 删除文件或空目录
+func (st *memTarget) Delete(pa string) error {
+	st.delay()
+
+	names := splitMemPath(pa)
+	if len(names) == 0 {
+		return &fs.PathError{Op: "remove", Path: pa, Err: fs.ErrInvalid}
+	}
+
+	st.store.mu.Lock()
+	defer st.store.mu.Unlock()
+
+	parent := st.store.lookup(names[:len(names)-1])
+	if parent == nil || !parent.isDir {
+		return &fs.PathError{Op: "remove", Path: pa, Err: fs.ErrNotExist}
+	}
+	node := parent.children[names[len(names)-1]]
+	if node == nil {
+		return &fs.PathError{Op: "remove", Path: pa, Err: fs.ErrNotExist}
+	}
+	if node.isDir && len(node.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: pa, Err: errors.New("directory not empty")}
+	}
+	delete(parent.children, node.name)
+	parent.modTime = time.Now()
+	return nil
+}
@@ -0,0 +1,241 @@
+package scopy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMem(t *testing.T) {
+	ResetMem("test")
+	defer ResetMem("test")
+
+	target := Mem("test")
+	runTest(t, target)
+	runTest(t, target)
+}
+
+func TestMemOpen(t *testing.T) {
+	ResetMem("test_open")
+	defer ResetMem("test_open")
+
+	target, err := Open2("mem://test_open/a/b", "", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	runTest(t, target)
+
+	err = target.WriteFile("c.txt", []byte("abc"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fis, err := Mem("test_open").List("a/b")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(fis) != 1 || fis[0].Name() != "c.txt" || fis[0].Size() != 3 || fis[0].IsDir() {
+		t.Error("want c.txt, got", fis)
+	}
+
+	fis, err = Mem("test_open").List("a")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(fis) != 1 || fis[0].Name() != "b" || !fis[0].IsDir() {
+		t.Error("want dir b, got", fis)
+	}
+}
+
+func TestMemDir(t *testing.T) {
+	ResetMem("test_dir")
+	defer ResetMem("test_dir")
+
+	tmp, err := ioutil.TempDir("", "scopy_mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	for name, content := range map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "bc",
+		"b/d/e.txt":   "bde",
+		"b/d/f/g.txt": "bdfg",
+	} {
+		filename := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := Mem("test_dir")
+
+	var okFiles []File
+	err = UploadDir(context.Background(), src, target, "x", false, &okFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(okFiles) != 4 {
+		t.Error("want 4 files, got", okFiles)
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	okFiles = nil
+	err = DownloadDir(context.Background(), target, "x", dst, func(remote, local string) bool {
+		return false
+	}, &okFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(okFiles) != 4 {
+		t.Error("want 4 files, got", okFiles)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dst, "b", "d", "f", "g.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "bdfg" {
+		t.Error("want bdfg, got", string(bs))
+	}
+
+	if err := target.Delete("x/b"); err == nil {
+		t.Error("want error when delete a non-empty directory")
+	}
+	if err := target.Delete("x/b/d/f/g.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := target.Delete("x/b/d/f/g.txt"); !os.IsNotExist(err) {
+		t.Error("want not exist, got", err)
+	}
+	if err := target.Rename("x/b", "y/z"); err != nil {
+		t.Error(err)
+	}
+	exists, err := target.Exists("y/z/d/e.txt")
+	if err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("y/z/d/e.txt isnot exists")
+	}
+}
+
+func TestMemFailureInjection(t *testing.T) {
+	ResetMem("test_fail")
+	defer ResetMem("test_fail")
+
+	target := MemWithOptions("test_fail", MemOptions{
+		FailWriteN:   2,
+		TruncateRead: 2,
+		Latency:      time.Millisecond,
+	})
+
+	if err := target.WriteFile("a.txt", []byte("abc")); err != nil {
+		t.Error(err)
+	}
+	if err := target.WriteFile("b.txt", []byte("abc")); err != ErrInjected {
+		t.Error("want ErrInjected, got", err)
+	}
+	if err := target.WriteFile("c.txt", []byte("abc")); err != nil {
+		t.Error(err)
+	}
+
+	failing := MemWithOptions("test_fail", MemOptions{FailWriteN: 2})
+	w, err := failing.Write("d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Error(err)
+	}
+	if _, err := w.Write([]byte("def")); err != ErrInjected {
+		t.Error("want ErrInjected, got", err)
+	}
+	if _, err := w.Write([]byte("ghi")); err != ErrInjected {
+		t.Error("want ErrInjected, got", err)
+	}
+	if err := w.Close(); err != ErrInjected {
+		t.Error("want ErrInjected, got", err)
+	}
+	if exists, err := failing.Exists("d.txt"); err != nil {
+		t.Error(err)
+	} else if exists {
+		t.Error("d.txt is committed after a failed write")
+	}
+
+	r, err := target.Read("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "ab" {
+		t.Error("want ab, got", string(bs))
+	}
+
+	fi, err := Mem("test_fail").Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 {
+		t.Error("want 3, got", fi.Size())
+	}
+}
+
+func TestMemConcurrent(t *testing.T) {
+	ResetMem("test_concurrent")
+	defer ResetMem("test_concurrent")
+
+	target := Mem("test_concurrent")
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := target.WriteFile("a/b.txt", data); err != nil {
+					t.Error(err)
+					return
+				}
+				r, err := target.Read("a/b.txt")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				bs, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(bs, data) {
+					t.Error("content is mismatch")
+					return
+				}
+				if _, err := target.List("a"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
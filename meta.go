@@ -0,0 +1,353 @@
+package scopy
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// DBOptions 是数据库后端的可选功能
+type DBOptions struct {
+	// Metadata 为 true 时在 "<表名>_meta" 表中维护每个文件的大小、块数、hash、类型、修改时间和权限,
+	// List 和 Stat 直接读取这个表。在已有数据的表上启用时需要先调用 RebuildMetadata
+	Metadata bool
+
+	// ReadAhead 是 dbTarget 读文件时在后台预读的块数，为 0 时不预读
+	ReadAhead int
+
+	// Versioned 为 true 时覆盖或删除文件前将当前的内容保存到 "<表名>_versions" 表中,
+	// 可以用 ListVersions、ReadVersion 和 RestoreVersion 访问历史版本
+	Versioned bool
+
+	// Compression 是写入时压缩每个块的算法， 可以是 EncodingGzip 或 EncodingZstd, 读取时根据每个块记录的算法解压
+	Compression string
+
+	// Keys 不为 nil 时用 AES-GCM 加密每个块, 读取时根据每个块记录的密钥 id 解密
+	Keys KeyProvider
+
+	// Dedup 为 true 时相同内容的块只保存一次，Copy 只复制块的引用, 见 blobTable
+	Dedup bool
+
+	// ChangeFeed 为 true 时在 "<表名>_changes" 表中记录文件的写入和删除, 可以用 Changes 和 Watch 读取
+	ChangeFeed bool
+
+	// Namespace 不为空时文件保存在这个命名空间中，和其它命名空间的文件互相隔离, 见 namespaceKey
+	Namespace string
+
+	// Quota 大于 0 时是命名空间 (没有 Namespace 时是整个表) 中所有文件的总大小的上限,
+	// 写入或复制文件后超过它时返回 ErrQuotaExceeded
+	Quota int64
+
+	// Storage 是文件的保存方式, 为空时按块保存在文件表的多行中，可以是 StorageAdaptive 或 StorageLargeObject
+	Storage string
+}
+
+// parseDBOptions 从 url 参数中读取 DBOptions, 读过的参数会被删除，以免传给数据库驱动
+func parseDBOptions(queryParams url.Values) (DBOptions, error) {
+	var opts DBOptions
+	if s := queryParams.Get("sc_dbmeta"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_dbmeta 不正确")
+		}
+		opts.Metadata = b
+	}
+	queryParams.Del("sc_dbmeta")
+
+	if s := queryParams.Get("sc_read_ahead"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_read_ahead 不正确")
+		}
+		opts.ReadAhead = i
+	}
+	queryParams.Del("sc_read_ahead")
+
+	if s := queryParams.Get("sc_versioned"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_versioned 不正确")
+		}
+		opts.Versioned = b
+	}
+	queryParams.Del("sc_versioned")
+
+	if s := queryParams.Get("sc_compress"); s != "" {
+		if err := checkEncoding(s); err != nil {
+			return opts, errWrap(err, "参数 sc_compress 不正确")
+		}
+		opts.Compression = s
+	}
+	queryParams.Del("sc_compress")
+
+	if s := queryParams.Get("sc_key_file"); s != "" {
+		keys, err := LoadKeyFile(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_key_file 不正确")
+		}
+		opts.Keys = keys
+	}
+	queryParams.Del("sc_key_file")
+
+	if s := queryParams.Get("sc_dedup"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_dedup 不正确")
+		}
+		opts.Dedup = b
+	}
+	queryParams.Del("sc_dedup")
+
+	if s := queryParams.Get("sc_changes"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_changes 不正确")
+		}
+		opts.ChangeFeed = b
+	}
+	queryParams.Del("sc_changes")
+
+	if s := queryParams.Get("sc_namespace"); s != "" {
+		if err := validNamespace(s); err != nil {
+			return opts, errWrap(err, "参数 sc_namespace 不正确")
+		}
+		opts.Namespace = s
+	}
+	queryParams.Del("sc_namespace")
+
+	if s := queryParams.Get("sc_quota"); s != "" {
+		i64, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_quota 不正确")
+		}
+		opts.Quota = i64
+	}
+	queryParams.Del("sc_quota")
+
+	if s := queryParams.Get("sc_storage"); s != "" {
+		storage, err := parseStorage(s)
+		if err != nil {
+			return opts, errWrap(err, "参数 sc_storage 不正确")
+		}
+		opts.Storage = storage
+	}
+	queryParams.Del("sc_storage")
+	return opts, nil
+}
+
+// FileMeta 是文件的元数据, 启用了 DBOptions.Metadata 时可以从 List 和 Stat 返回的 FileInfo.Sys() 中得到
+type FileMeta struct {
+	Size        int64
+	Chunks      int
+	Hash        string // sha256 的十六进制
+	ContentType string
+	ModTime     time.Time
+	Mode        fs.FileMode
+}
+
+// metaTable 返回文件表对应的元数据表的表名
+func metaTable(table string) string {
+	return table + "_meta"
+}
+
+func defaultFileMeta(remotePath string, meta FileMeta) FileMeta {
+	if meta.ContentType == "" {
+		meta.ContentType = mime.TypeByExtension(path.Ext(remotePath))
+	}
+	if meta.ModTime.IsZero() {
+		meta.ModTime = time.Now()
+	}
+	if meta.Mode == 0 {
+		meta.Mode = 0644
+	}
+	return meta
+}
+
+// metaTracker 在写文件时统计大小和 hash
+type metaTracker struct {
+	meta FileMeta
+	hash hash.Hash
+}
+
+func newMetaTracker(remotePath string, meta FileMeta) *metaTracker {
+	return &metaTracker{
+		meta: defaultFileMeta(remotePath, meta),
+		hash: sha256.New(),
+	}
+}
+
+func (t *metaTracker) add(data []byte) {
+	t.meta.Size += int64(len(data))
+	t.hash.Write(data)
+}
+
+func (t *metaTracker) finish(chunks int) FileMeta {
+	t.meta.Chunks = chunks
+	t.meta.Hash = hex.EncodeToString(t.hash.Sum(nil))
+	return t.meta
+}
+
+func writeMeta(e execer, stmts *sqlStatements, uuid string, meta FileMeta) error {
+	args := []interface{}{uuid, meta.Size, meta.Chunks, meta.Hash, meta.ContentType, meta.ModTime, int64(meta.Mode)}
+	if stmts.metaUpsert != "" {
+		_, err := e.exec(stmts.metaUpsert, args...)
+		return err
+	}
+	if _, err := e.exec(stmts.metaDelete, uuid); err != nil {
+		return err
+	}
+	_, err := e.exec(stmts.metaInsert, args...)
+	return err
+}
+
+// scanMeta 读取 metaList 等语句返回的一行
+func scanMeta(scan func(dest ...interface{}) error) (string, *FileMeta, error) {
+	var uuid string
+	var size, mode sql.NullInt64
+	var chunks sql.NullInt64
+	var hash, contentType sql.NullString
+	var mtime nullTime
+
+	if err := scan(&uuid, &size, &mtime, &mode, &chunks, &hash, &contentType); err != nil {
+		return "", nil, err
+	}
+	return uuid, &FileMeta{
+		Size:        size.Int64,
+		Chunks:      int(chunks.Int64),
+		Hash:        hash.String,
+		ContentType: contentType.String,
+		ModTime:     mtime.Time,
+		Mode:        fs.FileMode(mode.Int64),
+	}, nil
+}
+
+// statFile 返回文件或目录的信息，目录是从它下面的文件推断出来的
+func statFile(e execer, stmts *sqlStatements, metadata bool, remotePath string) (fs.FileInfo, error) {
+	var fi *fileStat
+	var err error
+	if metadata {
+		err = e.query(stmts.metaStat, []interface{}{remotePath}, func(scan func(dest ...interface{}) error) error {
+			uuid, meta, err := scanMeta(scan)
+			if err != nil {
+				return err
+			}
+			fi = &fileStat{
+				name:    path.Base(uuid),
+				size:    meta.Size,
+				modTime: meta.ModTime,
+				meta:    meta,
+			}
+			return nil
+		})
+	} else {
+		err = e.query(stmts.stat, []interface{}{remotePath}, func(scan func(dest ...interface{}) error) error {
+			var uuid string
+			var length sql.NullInt64
+			var created nullTime
+			if err := scan(&uuid, &length, &created); err != nil {
+				return err
+			}
+			fi = &fileStat{
+				name:    path.Base(uuid),
+				size:    length.Int64,
+				modTime: created.Time,
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi != nil {
+		return fi, nil
+	}
+
+	prefix := dirPrefix(remotePath)
+	if prefix != "" {
+		query := stmts.existPrefix
+		if metadata {
+			query = stmts.metaExistPrefix
+		}
+		found := false
+		err = e.query(query, prefixArgs(prefix), func(scan func(dest ...interface{}) error) error {
+			found = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return &fileStat{name: path.Base(remotePath), isDir: true}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: remotePath, Err: os.ErrNotExist}
+}
+
+// WriteWithMeta 和 Write 一样，但是可以指定文件的类型、修改时间和权限，它们在启用了 DBOptions.Metadata 时才会被保存
+func (st *dbTarget) WriteWithMeta(remotePath string, meta FileMeta) (io.WriteCloser, error) {
+	w, err := st.Write(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if st.opts.Metadata {
+		w.(*dbFileWriter).tracker = newMetaTracker(remotePath, meta)
+	}
+	return w, nil
+}
+
+// Stat 返回文件或目录的信息
+func (st *dbTarget) Stat(remotePath string) (fs.FileInfo, error) {
+	return statFile(st.execer(), st.stmts, st.opts.Metadata, st.opts.key(remotePath))
+}
+
+// RebuildMetadata 根据文件表重建元数据表, 文件的 hash 和类型会丢失。 它作用于整个表，有命名空间时返回 ErrNamespaceUnsupported
+func (st *dbTarget) RebuildMetadata() error {
+	if st.opts.Namespace != "" {
+		return ErrNamespaceUnsupported
+	}
+	return st.inTx(func(e execer) error {
+		return rebuildMeta(e, st.stmts)
+	})
+}
+
+// WriteWithMeta 和 Write 一样，但是可以指定文件的类型、修改时间和权限，它们在启用了 DBOptions.Metadata 时才会被保存
+func (st *sqlhttpTarget) WriteWithMeta(remotePath string, meta FileMeta) (io.WriteCloser, error) {
+	w, err := st.Write(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if st.opts.Metadata {
+		w.(*sqlhttpFileWriter).tracker = newMetaTracker(remotePath, meta)
+	}
+	return w, nil
+}
+
+// Stat 返回文件或目录的信息
+func (st *sqlhttpTarget) Stat(remotePath string) (fs.FileInfo, error) {
+	return statFile(st.execer(), st.stmts, st.opts.Metadata, st.opts.key(remotePath))
+}
+
+// RebuildMetadata 根据文件表重建元数据表, 文件的 hash 和类型会丢失。 它作用于整个表，有命名空间时返回 ErrNamespaceUnsupported
+func (st *sqlhttpTarget) RebuildMetadata() error {
+	if st.opts.Namespace != "" {
+		return ErrNamespaceUnsupported
+	}
+	return rebuildMeta(st.execer(), st.stmts)
+}
+
+func rebuildMeta(e execer, stmts *sqlStatements) error {
+	if _, err := e.exec(stmts.metaClear); err != nil {
+		return err
+	}
+	_, err := e.exec(stmts.metaRebuild)
+	return err
+}
@@ -0,0 +1,140 @@
+package scopy
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// 多个租户可以共用一个文件表，每个租户用 DBOptions.Namespace 选择自己的命名空间。
+// 命名空间 x 中的文件 a/b.txt 在 uuid 中保存为 "@x/a/b.txt", 所以元数据、历史版本和变更表也是按命名空间隔离的，
+// 不需要修改表结构和唯一约束。 没有命名空间的 target 看到的是整个表，命名空间在它的根目录下显示为 "@x" 目录。
+// GC 和 Fsck 只处理命名空间中的文件 (GC 删除的没有引用的 blob 不属于任何命名空间)。
+// ReEncrypt 和 RebuildMetadata 会修改整个表中的数据, 其中去重的 blob 是多个命名空间共用的，
+// 所以在有命名空间的 target 上它们返回 ErrNamespaceUnsupported, 要用没有命名空间的 target 执行
+
+var ErrQuotaExceeded = errors.New("scopy: quota of the namespace is exceeded")
+
+var ErrNamespaceUnsupported = errors.New("scopy: the operation works on the whole table and can not be used with a namespace")
+
+// namespaceMark 是命名空间在 uuid 中的前缀的第一个字符
+const namespaceMark = "@"
+
+func validNamespace(ns string) error {
+	if ns == "" || strings.ContainsAny(ns, "/\\") {
+		return errors.New("scopy: namespace '" + ns + "' is invalid")
+	}
+	return nil
+}
+
+// namespacePrefix 返回命名空间中的文件在 uuid 中的前缀，没有命名空间时为空
+func (opts DBOptions) namespacePrefix() string {
+	if opts.Namespace == "" {
+		return ""
+	}
+	return namespaceMark + opts.Namespace + "/"
+}
+
+// key 返回文件在 uuid 中的形式
+func (opts DBOptions) key(remotePath string) string {
+	prefix := opts.namespacePrefix()
+	if prefix == "" {
+		return remotePath
+	}
+	return prefix + strings.TrimPrefix(remotePath, "/")
+}
+
+// path 是 key 的逆运算
+func (opts DBOptions) path(key string) string {
+	return strings.TrimPrefix(key, opts.namespacePrefix())
+}
+
+// dir 返回目录在 uuid 中的形式，命名空间的根目录是 "@<名称>"
+func (opts DBOptions) dir(remoteDir string) string {
+	prefix := opts.namespacePrefix()
+	if prefix == "" {
+		return remoteDir
+	}
+	return strings.TrimSuffix(prefix+strings.TrimPrefix(dirPrefix(remoteDir), "/"), "/")
+}
+
+// NamespaceUsage 是命名空间的使用情况
+type NamespaceUsage struct {
+	Namespace string
+	Files     int64
+	Bytes     int64
+	Quota     int64 // 为 0 时没有限制
+}
+
+func namespaceUsage(e execer, stmts *sqlStatements, opts DBOptions) (NamespaceUsage, error) {
+	usage := NamespaceUsage{Namespace: opts.Namespace, Quota: opts.Quota}
+	if usage.Quota < 0 {
+		usage.Quota = 0
+	}
+
+	query, args := stmts.usage, []interface{}(nil)
+	if prefix := opts.namespacePrefix(); prefix != "" {
+		query, args = stmts.usagePrefix, prefixArgs(prefix)
+	}
+	var files, bytes sql.NullInt64
+	err := e.query(query, args, func(scan func(dest ...interface{}) error) error {
+		return scan(&files, &bytes)
+	})
+	usage.Files, usage.Bytes = files.Int64, bytes.Int64
+	return usage, err
+}
+
+// quotaLeft 返回写入 key 时还可以使用的字节数，被覆盖的文件原来的大小不计算在内, 没有配额时返回 -1。
+// 配额是在写入前检查的，并发写入时总大小可能略微超过配额
+func quotaLeft(e execer, stmts *sqlStatements, opts DBOptions, key string) (int64, error) {
+	if opts.Quota <= 0 {
+		return -1, nil
+	}
+	usage, err := namespaceUsage(e, stmts, opts)
+	if err != nil {
+		return 0, err
+	}
+	size, err := fileSize(e, stmts, key)
+	if err != nil {
+		return 0, err
+	}
+	left := opts.Quota - usage.Bytes + size
+	if left < 0 {
+		left = 0
+	}
+	return left, nil
+}
+
+// fileSize 返回文件的大小，文件不存在时为 0
+func fileSize(e execer, stmts *sqlStatements, key string) (int64, error) {
+	var size sql.NullInt64
+	err := e.query(stmts.stat, []interface{}{key}, func(scan func(dest ...interface{}) error) error {
+		var uuid string
+		var created nullTime
+		return scan(&uuid, &size, &created)
+	})
+	return size.Int64, err
+}
+
+// useQuota 从剩余的配额 left 中扣除 n 个字节，left 小于 0 时没有配额
+func useQuota(left *int64, n int) error {
+	if *left < 0 {
+		return nil
+	}
+	if *left < int64(n) {
+		*left = 0
+		return ErrQuotaExceeded
+	}
+	*left -= int64(n)
+	return nil
+}
+
+// Usage 返回命名空间 (没有命名空间时是整个表) 中的文件数和总大小
+func (st *dbTarget) Usage() (NamespaceUsage, error) {
+	return namespaceUsage(st.execer(), st.stmts, st.opts)
+}
+
+// Usage 返回命名空间 (没有命名空间时是整个表) 中的文件数和总大小
+func (st *sqlhttpTarget) Usage() (NamespaceUsage, error) {
+	return namespaceUsage(st.execer(), st.stmts, st.opts)
+}
@@ -6,7 +6,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 )
 
 func OS(dir string) *osTarget {
@@ -15,8 +14,21 @@ func OS(dir string) *osTarget {
 	}
 }
 
+// OSConfined 和 OS 一样，但是所有路径都被限制在 dir 之下, 见 ConfineMode
+func OSConfined(dir string, mode ConfineMode) *osTarget {
+	return &osTarget{
+		dir:     dir,
+		confine: mode,
+	}
+}
+
 type osTarget struct {
-	dir string
+	dir     string
+	confine ConfineMode
+}
+
+func (st *osTarget) join(remotePath string) (string, error) {
+	return confineLocalPath(st.dir, remotePath, st.confine, true)
 }
 
 func (st *osTarget) Close() error {
@@ -24,21 +36,37 @@ func (st *osTarget) Close() error {
 }
 
 func (st *osTarget) Write(remotePath string) (io.WriteCloser, error) {
+	filename, err := st.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
 	// create destination file
-	return os.Create(filepath.Join(st.dir, remotePath))
+	return os.Create(filename)
 }
 
 func (st *osTarget) WriteFile(remotePath string, data []byte) error {
-	return ioutil.WriteFile(filepath.Join(st.dir, remotePath), data, 0666)
+	filename, err := st.join(remotePath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0666)
 }
 
 func (st *osTarget) Read(remotePath string) (io.ReadCloser, error) {
+	filename, err := st.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
 	// open source file
-	return os.Open(filepath.Join(st.dir, remotePath))
+	return os.Open(filename)
 }
 
 func (st *osTarget) List(remotePath string) ([]fs.FileInfo, error) {
-	list, err := os.ReadDir(filepath.Join(st.dir, remotePath))
+	dir, err := st.join(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	list, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -55,16 +83,32 @@ func (st *osTarget) List(remotePath string) ([]fs.FileInfo, error) {
 }
 
 func (st *osTarget) Rename(from, to string) error {
-	return os.Rename(filepath.Join(st.dir, from), filepath.Join(st.dir, to))
+	fromPath, err := confineLocalPath(st.dir, from, st.confine, false)
+	if err != nil {
+		return err
+	}
+	toPath, err := confineLocalPath(st.dir, to, st.confine, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
 }
 
 func (st *osTarget) Delete(pa string) error {
-	log.Println("delete file", filepath.Join(st.dir, pa))
-	return os.Remove(filepath.Join(st.dir, pa))
+	filename, err := confineLocalPath(st.dir, pa, st.confine, false)
+	if err != nil {
+		return err
+	}
+	log.Println("delete file", filename)
+	return os.Remove(filename)
 }
 
 func (st *osTarget) Exists(pa string) (bool, error) {
-	s, err := os.Stat(filepath.Join(st.dir, pa))
+	filename, err := st.join(pa)
+	if err != nil {
+		return false, err
+	}
+	s, err := os.Stat(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -0,0 +1,205 @@
+package scopy
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// 文件表可以作为系统之间传递文件的队列, 消费者用 Claim 取得最旧的没有被取走的文件,
+// 读完后用 Ack 删除它或用 Release 放回队列。 取走文件时在它的块上记录 claimed_by 和 claimed_at,
+// 记录是在事务中用带条件的 update 完成的，所以同一个文件只会被一个消费者取走。
+// 消费者崩溃后，超过 ClaimOptions.Timeout 没有 Ack 的文件可以被其它消费者再次取走
+
+const DefaultClaimTimeout = 5 * time.Minute
+
+var (
+	ErrQueueEmpty = errors.New("scopy: no file to claim")
+	ErrClaimLost  = errors.New("scopy: claim is expired and taken by another consumer")
+)
+
+// ClaimOptions 是取文件的选项
+type ClaimOptions struct {
+	// Consumer 是消费者的名称, 会记录在 claimed_by 中，为空时用主机名
+	Consumer string
+
+	// Dir 不为空时只取这个目录下的文件
+	Dir string
+
+	// Timeout 是可见性超时，取走的文件超过这个时间没有 Ack 或 Release 时可以被再次取走,
+	// 为 0 时用 DefaultClaimTimeout
+	Timeout time.Duration
+}
+
+// ClaimedFile 是被取走的文件
+type ClaimedFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+
+	key   string // 文件在 uuid 中的形式, 见 DBOptions.Namespace
+	token string
+	st    tableStore
+	stmts *sqlStatements
+	opts  DBOptions
+	read  func(string) (io.ReadCloser, error)
+}
+
+// Open 读取文件的内容
+func (f *ClaimedFile) Open() (io.ReadCloser, error) {
+	return f.read(f.Name)
+}
+
+// Extend 延长可见性超时, 处理时间较长时要在超时之前调用
+func (f *ClaimedFile) Extend() error {
+	count, err := f.st.execer().exec(f.stmts.claimTouch, f.key, f.token)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// Ack 确认文件已经处理完了，并删除它
+func (f *ClaimedFile) Ack() error {
+	return f.st.inTx(func(e execer) error {
+		count, err := e.exec(f.stmts.claimTouch, f.key, f.token)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrClaimLost
+		}
+		if f.opts.Versioned {
+			if err := archiveVersion(e, f.stmts, f.opts, f.key); err != nil {
+				return err
+			}
+		}
+		if err := releaseFile(e, f.stmts, f.opts, f.key); err != nil {
+			return err
+		}
+		if _, err := e.exec(f.stmts.deleteByUUID, f.key); err != nil {
+			return err
+		}
+		if f.opts.Metadata {
+			if _, err := e.exec(f.stmts.metaDelete, f.key); err != nil {
+				return err
+			}
+		}
+		return logChange(e, f.stmts, f.opts, ChangeDelete, f.key)
+	})
+}
+
+// Release 将文件放回队列，其它消费者可以马上取走它
+func (f *ClaimedFile) Release() error {
+	count, err := f.st.execer().exec(f.stmts.claimRelease, f.key, f.token)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+func newClaimToken(consumer string) (string, error) {
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	var bs [8]byte
+	if _, err := io.ReadFull(rand.Reader, bs[:]); err != nil {
+		return "", err
+	}
+	return consumer + "/" + hex.EncodeToString(bs[:]), nil
+}
+
+// claimBatch 是每次查询的候选文件数，前面的文件被其它消费者抢先取走时尝试后面的文件
+const claimBatch = 10
+
+func claimFile(st tableStore, stmts *sqlStatements, d *dialect, claimOpts ClaimOptions) (*ClaimedFile, error) {
+	timeout := claimOpts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultClaimTimeout
+	}
+	token, err := newClaimToken(claimOpts.Consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := stmts.claimSelect, []interface{}(nil)
+	if prefix := dirPrefix(claimOpts.Dir); prefix != "" {
+		query, args = stmts.claimSelectPrefix, prefixArgs(prefix)
+	}
+
+	// 超时是按数据库的时间计算的，claimed_at 也是数据库写入的
+	expired := d.agoValue(timeout)
+	for {
+		var files []*ClaimedFile
+		err := st.execer().query(query+d.limit(claimBatch), append(args, expired), func(scan func(dest ...interface{}) error) error {
+			f := &ClaimedFile{}
+			var size sql.NullInt64
+			var created nullTime
+			if err := scan(&f.key, &size, &created); err != nil {
+				return err
+			}
+			f.Size, f.ModTime = size.Int64, created.Time
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, ErrQueueEmpty
+		}
+
+		for _, f := range files {
+			var count int64
+			err := st.inTx(func(e execer) error {
+				var err error
+				count, err = e.exec(stmts.claim, token, f.key, expired)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				f.token = token
+				return f, nil
+			}
+		}
+		// 所有的候选文件都被其它消费者取走了，重新查询
+	}
+}
+
+// Claim 取走最旧的没有被取走的文件, 没有文件时返回 ErrQueueEmpty。
+// 返回的文件读完后必须调用 Ack 或 Release
+func (st *dbTarget) Claim(claimOpts ClaimOptions) (*ClaimedFile, error) {
+	claimOpts.Dir = st.opts.dir(claimOpts.Dir)
+	f, err := claimFile(st, st.stmts, st.dialect, claimOpts)
+	if err != nil {
+		return nil, err
+	}
+	f.Name = st.opts.path(f.key)
+	f.st, f.stmts, f.opts, f.read = st, st.stmts, st.opts, st.Read
+	return f, nil
+}
+
+// Claim 取走最旧的没有被取走的文件, 没有文件时返回 ErrQueueEmpty。
+// 返回的文件读完后必须调用 Ack 或 Release
+func (st *sqlhttpTarget) Claim(claimOpts ClaimOptions) (*ClaimedFile, error) {
+	claimOpts.Dir = st.opts.dir(claimOpts.Dir)
+	f, err := claimFile(st, st.stmts, st.dialect, claimOpts)
+	if err != nil {
+		return nil, err
+	}
+	f.Name = st.opts.path(f.key)
+	f.st, f.stmts, f.opts, f.read = st, st.stmts, st.opts, st.Read
+	return f, nil
+}
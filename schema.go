@@ -0,0 +1,412 @@
+package scopy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SchemaVersionTable 记录了每个文件表的 schema 版本
+var SchemaVersionTable = "scopy_schema_versions"
+
+// migration 是一个 schema 版本, 版本号从 1 开始连续递增，已发布的版本不可以修改，
+// 只能追加新的版本
+type migration struct {
+	version int
+
+	// up 返回升级到这个版本的语句, 文件表的列名要通过 m.column 得到
+	up func(d *dialect, m TableMapping) []string
+
+	// tables 返回这个版本新建的表，用于 DropSchema
+	tables func(table string) []string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		up: func(d *dialect, m TableMapping) []string {
+			return []string{d.initSQL(m)}
+		},
+		tables: func(table string) []string {
+			return []string{table}
+		},
+	},
+	{
+		version: 2,
+		up: func(d *dialect, m TableMapping) []string {
+			table := m.name()
+			return []string{d.createIndex(table+"_created_at_idx", table, m.column("created_at"))}
+		},
+	},
+	{
+		version: 3,
+		up: func(d *dialect, m TableMapping) []string {
+			// 列目录时按 uuid 的前缀查询, 其它数据库可以直接使用 unique(uuid, partitioning_sequence) 索引,
+			// postgres 在非 C 排序规则下需要 pattern 索引
+			if d.name != DialectPostgres {
+				return nil
+			}
+			table := m.name()
+			return []string{"CREATE INDEX " + d.quote(strings.Replace(table, ".", "_", -1)+"_uuid_pattern_idx") +
+				" ON " + d.quoteTable(table) + "(" + d.quote(m.column("uuid")) + " varchar_pattern_ops)"}
+		},
+	},
+	{
+		version: 4,
+		up: func(d *dialect, m TableMapping) []string {
+			// 元数据表，启用 DBOptions.Metadata 时才会维护它，这里用已有的文件初始化它
+			mt := metaTable(m.name())
+			stmts := []string{
+				d.createTableIfNotExists(d.quoteTable(mt), `(
+  `+d.quote(m.column("uuid"))+`              `+d.varcharType(200)+` NOT NULL PRIMARY KEY,
+  size              `+d.bigintType()+`,
+  chunk_count       int,
+  hash              `+d.varcharType(128)+`,
+  content_type      `+d.varcharType(200)+`,
+  mtime             `+d.timestampType()+`,
+  mode              int,
+  updated_at        `+d.timestampType()+`
+)`),
+				// 这时还没有 data_size 列, 不能用 sqlStatements.metaRebuild
+				metaRebuildSQL(d, m, d.length(d.quote(m.column("data")))),
+			}
+			if d.name == DialectPostgres {
+				stmts = append(stmts, "CREATE INDEX "+d.quote(strings.Replace(mt, ".", "_", -1)+"_uuid_pattern_idx")+
+					" ON "+d.quoteTable(mt)+"("+d.quote(m.column("uuid"))+" varchar_pattern_ops)")
+			}
+			return stmts
+		},
+		tables: func(table string) []string {
+			return []string{metaTable(table)}
+		},
+	},
+	{
+		version: 5,
+		up: func(d *dialect, m TableMapping) []string {
+			// 记录每个块的大小，随机读时用它定位块
+			table := m.name()
+			return []string{
+				d.addColumn(table, m.column("data_size"), d.bigintType()),
+				"UPDATE " + d.quoteTable(table) + " SET " + d.quote(m.column("data_size")) + " = " + d.length(d.quote(m.column("data"))),
+			}
+		},
+	},
+	{
+		version: 6,
+		up: func(d *dialect, m TableMapping) []string {
+			// 历史版本表，启用 DBOptions.Versioned 时覆盖或删除文件前将当前的块复制到这里
+			vt := versionTable(m.name())
+			col := func(name string) string {
+				return d.quote(m.column(name))
+			}
+			return []string{
+				d.createTableIfNotExists(d.quoteTable(vt), `(
+  `+col("id")+`                `+d.idColumn()+`,
+  `+col("uuid")+`              `+d.varcharType(200)+` NOT NULL,
+  version           int NOT NULL,
+  `+col("partitioning_count")+`             int,
+  `+col("partitioning_sequence")+`          int,
+  `+col("data")+`              `+d.blobType()+`,
+  `+col("data_size")+`         `+d.bigintType()+`,
+  `+col("created_at")+`        `+d.timestampType()+`,
+  archived_at       `+d.timestampType()+`,
+
+  unique(`+col("uuid")+`, version, `+col("partitioning_sequence")+`)
+)`),
+				d.createIndex(vt+"_archived_at_idx", vt, "archived_at"),
+			}
+		},
+		tables: func(table string) []string {
+			return []string{versionTable(table)}
+		},
+	},
+	{
+		version: 7,
+		up: func(d *dialect, m TableMapping) []string {
+			// 块的压缩算法, 为空时没有压缩
+			return []string{
+				d.addColumn(m.name(), m.column("encoding"), d.varcharType(20)),
+				d.addColumn(versionTable(m.name()), m.column("encoding"), d.varcharType(20)),
+			}
+		},
+	},
+	{
+		version: 8,
+		up: func(d *dialect, m TableMapping) []string {
+			// 加密块的密钥的 id, 为空时没有加密
+			return []string{
+				d.addColumn(m.name(), m.column("key_id"), d.varcharType(100)),
+				d.addColumn(versionTable(m.name()), m.column("key_id"), d.varcharType(100)),
+			}
+		},
+	},
+	{
+		version: 9,
+		up: func(d *dialect, m TableMapping) []string {
+			// 去重模式下块的数据按 sha256 保存在 blob 表中，refcount 是文件表和历史版本表中引用它的行数
+			table := m.name()
+			col := func(name string) string {
+				return d.quote(m.column(name))
+			}
+			return []string{
+				d.createTableIfNotExists(d.quoteTable(blobTable(table)), `(
+  `+col("id")+`                `+d.idColumn()+`,
+  hash              `+d.varcharType(64)+` NOT NULL,
+  `+col("data")+`              `+d.blobType()+`,
+  `+col("data_size")+`         `+d.bigintType()+`,
+  `+col("encoding")+`          `+d.varcharType(20)+`,
+  `+col("key_id")+`            `+d.varcharType(100)+`,
+  refcount          int NOT NULL,
+  `+col("created_at")+`        `+d.timestampType()+`,
+
+  unique(hash)
+)`),
+				d.addColumn(table, m.column("blob_hash"), d.varcharType(64)),
+				d.addColumn(versionTable(table), m.column("blob_hash"), d.varcharType(64)),
+			}
+		},
+		tables: func(table string) []string {
+			return []string{blobTable(table)}
+		},
+	},
+	{
+		version: 10,
+		up: func(d *dialect, m TableMapping) []string {
+			// 作为队列使用时记录取走文件的消费者和时间, 见 Claim
+			return []string{
+				d.addColumn(m.name(), m.column("claimed_by"), d.varcharType(200)),
+				d.addColumn(m.name(), m.column("claimed_at"), d.timestampType()),
+			}
+		},
+	},
+	{
+		version: 11,
+		up: func(d *dialect, m TableMapping) []string {
+			// 变更表，启用 DBOptions.ChangeFeed 时记录文件的写入和删除
+			col := func(name string) string {
+				return d.quote(m.column(name))
+			}
+			return []string{
+				d.createTableIfNotExists(d.quoteTable(changeTable(m.name())), `(
+  `+col("id")+`                `+d.idColumn()+`,
+  `+col("uuid")+`              `+d.varcharType(200)+` NOT NULL,
+  op                `+d.varcharType(10)+` NOT NULL,
+  `+col("created_at")+`        `+d.timestampType()+`
+)`),
+			}
+		},
+		tables: func(table string) []string {
+			return []string{changeTable(table)}
+		},
+	},
+	{
+		version: 12,
+		up: func(d *dialect, m TableMapping) []string {
+			// postgres 中保存为大对象的文件的 oid, 见 StorageLargeObject
+			if d.name != DialectPostgres {
+				return nil
+			}
+			return []string{d.addColumn(m.name(), m.column("lo_oid"), "oid")}
+		},
+	},
+	{
+		version: 13,
+		up: func(d *dialect, m TableMapping) []string {
+			// 版本 4 初始化元数据表时用的是 data 的长度，压缩、去重的块和大对象的大小要用 data_size,
+			// 这里只更新 size, 元数据表中的其它列保持不变
+			table := m.name()
+			mt := d.quoteTable(metaTable(table))
+			uuid := d.quote(m.column("uuid"))
+			size := "coalesce(" + d.quote(m.column("data_size")) + ", " + d.length(d.quote(m.column("data"))) + ")"
+			return []string{"UPDATE " + mt + " SET " + d.quote("size") + " = (SELECT sum(" + size + ") FROM " + d.quoteTable(table) +
+				" WHERE " + d.quoteTable(table) + "." + uuid + " = " + mt + "." + uuid + extraScope(d, m) + ")"}
+		},
+	},
+}
+
+// metaRebuildSQL 返回用文件表中已有的文件初始化元数据表的语句，size 是块的大小的表达式。
+// 迁移中的语句不能随 sqlStatements 的修改而变化，所以这里单独生成
+func metaRebuildSQL(d *dialect, m TableMapping, size string) string {
+	uuid := d.quote(m.column("uuid"))
+	where := ""
+	if scope := extraScope(d, m); scope != "" {
+		where = " where " + strings.TrimPrefix(scope, " and ")
+	}
+	return "insert into " + d.quoteTable(metaTable(m.name())) + "(" + uuid + ", " + d.quote("size") + ", " + d.quote("chunk_count") + ", " +
+		d.quote("mtime") + ", " + d.quote("mode") + ", " + d.quote("updated_at") + ")" +
+		" select " + uuid + ", sum(" + size + "), count(*), max(" + d.quote(m.column("created_at")) + "), 420, " + d.now() +
+		" from " + d.quoteTable(m.name()) + where + " group by " + uuid
+}
+
+// extraScope 返回文件表上额外的常量列的条件，以 " and " 开头
+func extraScope(d *dialect, m TableMapping) string {
+	var scope string
+	for _, column := range m.extraColumns() {
+		scope += " and " + d.quote(column) + " = " + d.literal(m.Extra[column])
+	}
+	return scope
+}
+
+// LatestSchemaVersion 返回当前代码支持的最新 schema 版本
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func ensureVersionTable(e execer, d *dialect) error {
+	_, err := e.exec(d.createTableIfNotExists(SchemaVersionTable, `(
+  table_name        `+d.varcharType(200)+` NOT NULL PRIMARY KEY,
+  version           int NOT NULL
+)`))
+	return err
+}
+
+func readSchemaVersion(e execer, d *dialect, table string) (int, error) {
+	if err := ensureVersionTable(e, d); err != nil {
+		return 0, err
+	}
+
+	version := 0
+	err := e.query("select version from "+SchemaVersionTable+" where table_name = ?", []interface{}{table},
+		func(scan func(dest ...interface{}) error) error {
+			return scan(&version)
+		})
+	return version, err
+}
+
+func writeSchemaVersion(e execer, table string, version int) error {
+	_, err := e.exec("delete from "+SchemaVersionTable+" where table_name = ?", table)
+	if err != nil {
+		return err
+	}
+	_, err = e.exec("insert into "+SchemaVersionTable+"(table_name, version) values(?, ?)", table, version)
+	return err
+}
+
+// migrateSchema 将表升级到 to 版本，to 为 0 时升级到最新版本。
+// 版本 1 使用 CREATE TABLE IF NOT EXISTS, 所以已经手工建好的表也可以直接纳入管理。
+// ddl 可以回滚的数据库中每个版本的语句和版本号在一个事务中执行; mysql 和 oracle 中 ddl 会隐式提交,
+// 中途失败后再次执行时已经增加的列和表会被跳过
+func migrateSchema(st tableStore, d *dialect, m TableMapping, to int) error {
+	table := m.name()
+	if to <= 0 {
+		to = LatestSchemaVersion()
+	}
+	if to > LatestSchemaVersion() {
+		return errors.New("scopy: schema version " + strconv.Itoa(to) + " is unsupported")
+	}
+
+	current, err := readSchemaVersion(st.execer(), d, table)
+	if err != nil {
+		return err
+	}
+	if current > to {
+		return errors.New("scopy: schema version of '" + table + "' is " + strconv.Itoa(current) +
+			", downgrade to " + strconv.Itoa(to) + " is unsupported")
+	}
+
+	for _, mig := range migrations {
+		if mig.version <= current || mig.version > to {
+			continue
+		}
+		up := func(e execer) error {
+			for _, stmt := range mig.up(d, m) {
+				if _, err := e.exec(stmt); err != nil && !d.isDuplicateColumn(err) {
+					return errors.New("scopy: migrate '" + table + "' to version " + strconv.Itoa(mig.version) + " fail: " + err.Error())
+				}
+			}
+			return writeSchemaVersion(e, table, mig.version)
+		}
+		if d.transactionalDDL() {
+			err = st.inTx(up)
+		} else {
+			err = up(st.execer())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropSchema 删除所有版本新建的表和版本记录，主要用于测试
+func dropSchema(e execer, d *dialect, table string) error {
+	for idx := len(migrations) - 1; idx >= 0; idx-- {
+		if migrations[idx].tables == nil {
+			continue
+		}
+		for _, name := range migrations[idx].tables(table) {
+			if _, err := e.exec(d.dropTableIfExists(d.quoteTable(name))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ensureVersionTable(e, d); err != nil {
+		return err
+	}
+	_, err := e.exec("delete from "+SchemaVersionTable+" where table_name = ?", table)
+	return err
+}
+
+func (st *dbTarget) execer() execer {
+	return sqlExecer{conn: st.db(), dialect: st.dialect}
+}
+
+// EnsureSchema 创建文件表或将它升级到最新版本
+func (st *dbTarget) EnsureSchema() error {
+	return st.Migrate(0)
+}
+
+// Migrate 将文件表升级到指定的版本，version 为 0 时升级到最新版本
+func (st *dbTarget) Migrate(version int) error {
+	return migrateSchema(st, st.dialect, st.mapping, version)
+}
+
+// SchemaVersion 返回文件表当前的版本，0 表示还没有被管理
+func (st *dbTarget) SchemaVersion() (int, error) {
+	return readSchemaVersion(st.execer(), st.dialect, st.table)
+}
+
+// DropSchema 删除文件表及其相关的表，表中的数据会全部丢失
+func (st *dbTarget) DropSchema() error {
+	return dropSchema(st.execer(), st.dialect, st.table)
+}
+
+func (st *sqlhttpTarget) execer() execer {
+	return sqlhttpExecer{st: st}
+}
+
+// SetOptions 设置可选功能, 必须在读写文件之前调用。 可选功能和表的映射不兼容时返回错误，原来的设置不变
+func (st *sqlhttpTarget) SetOptions(opts DBOptions) error {
+	if err := st.mapping.checkOptions(opts); err != nil {
+		return err
+	}
+	st.opts = opts
+	return nil
+}
+
+// SetDialect 设置 aceql-http 后端的数据库类型，如 "mysql", "postgres", "sqlserver",
+// 它决定了 EnsureSchema 等生成的语句
+func (st *sqlhttpTarget) SetDialect(driverName string) {
+	st.dialect = dialectOf(driverName)
+	st.stmts = newStatements(st.dialect, st.mapping)
+}
+
+// EnsureSchema 创建文件表或将它升级到最新版本
+func (st *sqlhttpTarget) EnsureSchema() error {
+	return st.Migrate(0)
+}
+
+// Migrate 将文件表升级到指定的版本，version 为 0 时升级到最新版本
+func (st *sqlhttpTarget) Migrate(version int) error {
+	return migrateSchema(st, st.dialect, st.mapping, version)
+}
+
+// SchemaVersion 返回文件表当前的版本，0 表示还没有被管理
+func (st *sqlhttpTarget) SchemaVersion() (int, error) {
+	return readSchemaVersion(st.execer(), st.dialect, st.table)
+}
+
+// DropSchema 删除文件表及其相关的表，表中的数据会全部丢失
+func (st *sqlhttpTarget) DropSchema() error {
+	return dropSchema(st.execer(), st.dialect, st.table)
+}
@@ -0,0 +1,525 @@
+package scopy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"tech.hengwei.com.cn/go/shell"
+)
+
+func SCPWithKey(host, username, keyfile, passphrase string) (Session, error) {
+	bs, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, errWrap(err, "load keyfile fail")
+	}
+
+	conn, err := shell.DialSSH(host, username, passphrase, string(bs))
+	if err != nil {
+		return nil, err
+	}
+	return SCP(conn), nil
+}
+
+func SCPWithPassword(host, username, password string) (Session, error) {
+	conn, err := shell.DialSSH(host, username, password, "")
+	if err != nil {
+		return nil, err
+	}
+	return SCP(conn), nil
+}
+
+// SCP 在一个已有的 ssh 连接上用 scp 协议传输文件，用于没有 sftp 子系统的主机，
+// List, Delete 和 Rename 是通过执行远程的 shell 命令来实现的, Close 时会关闭 conn
+func SCP(conn *ssh.Client) Session {
+	return &scpTarget{
+		conn: conn,
+	}
+}
+
+type scpTarget struct {
+	conn *ssh.Client
+}
+
+func (st *scpTarget) Close() error {
+	return st.conn.Close()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// run 执行远程命令，返回标准输出，命令失败时错误中带有标准错误的内容
+func (st *scpTarget) run(cmd string) ([]byte, error) {
+	sess, err := st.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	err = sess.Run(cmd)
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return stdout.Bytes(), err
+		}
+		return stdout.Bytes(), &scpCommandError{cmd: cmd, msg: msg, err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+type scpCommandError struct {
+	cmd string
+	msg string
+	err error
+}
+
+func (e *scpCommandError) Error() string {
+	return "run '" + e.cmd + "' fail: " + e.msg
+}
+
+func (e *scpCommandError) Unwrap() error {
+	return e.err
+}
+
+func isNoSuchFile(err error) bool {
+	if e, ok := err.(*scpCommandError); ok {
+		return strings.Contains(e.msg, "No such file or directory")
+	}
+	return false
+}
+
+const lsTimeFormat = "2006-01-02T15:04:05-0700"
+
+func (st *scpTarget) List(remotePath string) ([]fs.FileInfo, error) {
+	if remotePath == "" {
+		remotePath = "."
+	}
+	out, err := st.run("LC_ALL=C ls -la --time-style=+%Y-%m-%dT%H:%M:%S%z " + shellQuote(remotePath))
+	if err != nil {
+		if isNoSuchFile(err) {
+			return nil, &fs.PathError{Op: "list", Path: remotePath, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+	return parseLsOutput(out)
+}
+
+// parseLsOutput 解析 ls -la --time-style=+%Y-%m-%dT%H:%M:%S%z 的输出
+func parseLsOutput(out []byte) ([]fs.FileInfo, error) {
+	var list []fs.FileInfo
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "total ") {
+			continue
+		}
+
+		// 格式为: mode links owner group size time name
+		var fields [6]string
+		rest := line
+		for i := range fields {
+			rest = strings.TrimLeft(rest, " ")
+			end := strings.IndexByte(rest, ' ')
+			if end < 0 {
+				return nil, errors.New("scopy: invalid ls output '" + line + "'")
+			}
+			fields[i] = rest[:end]
+			rest = rest[end+1:]
+		}
+		name := strings.TrimLeft(rest, " ")
+
+		mode, ok := parseLsMode(fields[0])
+		if !ok {
+			return nil, errors.New("scopy: invalid file mode in ls output '" + line + "'")
+		}
+		if mode&(fs.ModeDevice|fs.ModeCharDevice) != 0 {
+			// 设备文件的大小字段是 "major, minor"，不支持
+			continue
+		}
+		if mode&fs.ModeSymlink != 0 {
+			if idx := strings.Index(name, " -> "); idx >= 0 {
+				name = name[:idx]
+			}
+		}
+		if name == "." || name == ".." {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errors.New("scopy: invalid file size in ls output '" + line + "'")
+		}
+		modTime, err := time.Parse(lsTimeFormat, fields[5])
+		if err != nil {
+			return nil, errors.New("scopy: invalid file time in ls output '" + line + "'")
+		}
+
+		list = append(list, &scpFileInfo{
+			name:    path.Base(name),
+			size:    size,
+			mode:    mode,
+			modTime: modTime,
+		})
+	}
+	return list, scanner.Err()
+}
+
+func parseLsMode(s string) (fs.FileMode, bool) {
+	if len(s) < 10 {
+		return 0, false
+	}
+
+	var mode fs.FileMode
+	switch s[0] {
+	case '-':
+	case 'd':
+		mode |= fs.ModeDir
+	case 'l':
+		mode |= fs.ModeSymlink
+	case 'p':
+		mode |= fs.ModeNamedPipe
+	case 's':
+		mode |= fs.ModeSocket
+	case 'c':
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 'b':
+		mode |= fs.ModeDevice
+	default:
+		return 0, false
+	}
+
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		c := s[1+i]
+		switch {
+		case c == rwx[i]:
+			mode |= 1 << uint(8-i)
+		case c == '-':
+		case i == 2 || i == 5 || i == 8:
+			// s, S, t, T
+			if c == 's' || c == 't' {
+				mode |= 1 << uint(8-i)
+			}
+			if i == 2 {
+				mode |= fs.ModeSetuid
+			} else if i == 5 {
+				mode |= fs.ModeSetgid
+			} else {
+				mode |= fs.ModeSticky
+			}
+		default:
+			return 0, false
+		}
+	}
+	return mode, true
+}
+
+type scpFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *scpFileInfo) Name() string       { return fi.name }
+func (fi *scpFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *scpFileInfo) Size() int64        { return fi.size }
+func (fi *scpFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *scpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *scpFileInfo) Sys() interface{}   { return nil }
+
+// scpReadAck 读取 scp 协议的应答，0 为成功, 1 为警告, 2 为错误
+func scpReadAck(r *bufio.Reader) error {
+	c, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := r.ReadString('\n')
+		return errors.New("scp: " + strings.TrimSpace(msg))
+	default:
+		return fmt.Errorf("scp: unexpected response %q", c)
+	}
+}
+
+// scpReceive 是 scp -f 时的接收端，它读取文件头并返回文件的大小，
+// 调用者读完 size 个字节后再调用 scpReceiveEnd
+func scpReceive(r *bufio.Reader, w io.Writer) (int64, error) {
+	if _, err := w.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch c {
+		case 1, 2:
+			return 0, errors.New("scp: " + strings.TrimSpace(line))
+		case 'T':
+			// 时间戳，忽略
+			if _, err := w.Write([]byte{0}); err != nil {
+				return 0, err
+			}
+		case 'C':
+			// C0644 123 name
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) != 3 {
+				return 0, errors.New("scp: invalid file header 'C" + line + "'")
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.New("scp: invalid file header 'C" + line + "'")
+			}
+			if _, err := w.Write([]byte{0}); err != nil {
+				return 0, err
+			}
+			return size, nil
+		case 'D':
+			return 0, errors.New("scp: '" + scpEntryName(line) + "' is a directory")
+		default:
+			return 0, fmt.Errorf("scp: unexpected response %q", c)
+		}
+	}
+}
+
+func scpEntryName(line string) string {
+	fields := strings.SplitN(line, " ", 3)
+	return fields[len(fields)-1]
+}
+
+func scpReceiveEnd(r *bufio.Reader, w io.Writer) error {
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// scpSend 是 scp -t 时的发送端
+func scpSend(r *bufio.Reader, w io.Writer, name string, mode fs.FileMode, size int64, data io.Reader) error {
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "C%04o %d %s\n", mode&fs.ModePerm, size, name)
+	if err != nil {
+		return err
+	}
+	if err := scpReadAck(r); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, data)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("scp: short write, want %d, got %d", size, n)
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return scpReadAck(r)
+}
+
+type scpFileReader struct {
+	sess   *ssh.Session
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	r      io.Reader
+	done   bool
+}
+
+func (r *scpFileReader) Read(data []byte) (int, error) {
+	n, err := r.r.Read(data)
+	if err == io.EOF && !r.done {
+		r.done = true
+		if e := scpReceiveEnd(r.stdout, r.stdin); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+func (r *scpFileReader) Close() error {
+	if r.sess == nil {
+		return nil
+	}
+	r.stdin.Close()
+	var err error
+	if r.done {
+		err = r.sess.Wait()
+	}
+	r.sess.Close()
+	r.sess = nil
+	return err
+}
+
+func (st *scpTarget) Read(remotePath string) (io.ReadCloser, error) {
+	sess, err := st.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	stdoutPipe, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err = sess.Start("scp -f " + shellQuote(remotePath)); err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	stdout := bufio.NewReader(stdoutPipe)
+	size, err := scpReceive(stdout, stdin)
+	if err != nil {
+		sess.Close()
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil, &fs.PathError{Op: "open", Path: remotePath, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+
+	return &scpFileReader{
+		sess:   sess,
+		stdin:  stdin,
+		stdout: stdout,
+		r:      io.LimitReader(stdout, size),
+	}, nil
+}
+
+// scpFileWriter 因为 scp 协议需要先发送文件大小，所以数据会先写到临时文件中，在 Close 时发送
+type scpFileWriter struct {
+	st     *scpTarget
+	path   string
+	tmp    *os.File
+	size   int64
+	closed bool
+}
+
+func (w *scpFileWriter) Write(data []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.tmp == nil {
+		tmp, err := ioutil.TempFile("", "scopy_scp")
+		if err != nil {
+			return 0, err
+		}
+		w.tmp = tmp
+	}
+	n, err := w.tmp.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *scpFileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.tmp == nil {
+		return w.st.send(w.path, 0, bytes.NewReader(nil))
+	}
+	defer func() {
+		w.tmp.Close()
+		os.Remove(w.tmp.Name())
+	}()
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.st.send(w.path, w.size, w.tmp)
+}
+
+func (st *scpTarget) Write(remotePath string) (io.WriteCloser, error) {
+	return &scpFileWriter{
+		st:   st,
+		path: remotePath,
+	}, nil
+}
+
+func (st *scpTarget) WriteFile(remotePath string, data []byte) error {
+	return st.send(remotePath, int64(len(data)), bytes.NewReader(data))
+}
+
+// send 用 scp -t 将 size 个字节的 data 写入远端的文件
+func (st *scpTarget) send(remotePath string, size int64, data io.Reader) error {
+	sess, err := st.conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = sess.Start("scp -t " + shellQuote(remotePath)); err != nil {
+		return err
+	}
+
+	err = scpSend(bufio.NewReader(stdout), stdin, path.Base(remotePath), 0644, size, data)
+	stdin.Close()
+	if err != nil {
+		return err
+	}
+	return sess.Wait()
+}
+
+func (st *scpTarget) Exists(pa string) (bool, error) {
+	_, err := st.run("test -e " + shellQuote(pa))
+	if err != nil {
+		if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (st *scpTarget) Rename(from, to string) error {
+	_, err := st.run("mv -f -- " + shellQuote(from) + " " + shellQuote(to))
+	if err != nil && isNoSuchFile(err) {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (st *scpTarget) Delete(pa string) error {
+	_, err := st.run("rm -- " + shellQuote(pa))
+	if err != nil && isNoSuchFile(err) {
+		return &fs.PathError{Op: "remove", Path: pa, Err: fs.ErrNotExist}
+	}
+	return err
+}
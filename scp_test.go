@@ -0,0 +1,172 @@
+package scopy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseLsOutput(t *testing.T) {
+	out := `total 16
+drwxr-xr-x  3 root root 4096 2023-10-10T12:00:00+0800 .
+drwxr-xr-x 20 root root 4096 2023-10-09T08:00:00+0800 ..
+-rw-r--r--  1 root root  123 2023-10-10T12:01:02+0800 a b.txt
+drwxrwxrwt  2 root root 4096 2023-10-10T12:00:00+0000 tmp
+lrwxrwxrwx  1 root root    7 2023-10-10T12:00:00+0800 link -> a b.txt
+crw-rw-rw-  1 root root 1, 3 2023-10-10T12:00:00+0800 null
+-rwsr-xr-x  1 root root 5000 2023-10-10T12:00:00+0800 suid
+`
+	fis, err := parseLsOutput([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 4 {
+		t.Fatal("want 4 entries, got", len(fis))
+	}
+
+	if fis[0].Name() != "a b.txt" || fis[0].Size() != 123 || fis[0].IsDir() || fis[0].Mode() != 0644 {
+		t.Error("a b.txt:", fis[0].Name(), fis[0].Size(), fis[0].Mode())
+	}
+	if fis[0].ModTime().Unix() != 1696910462 {
+		t.Error("a b.txt: modtime is", fis[0].ModTime())
+	}
+	if fis[1].Name() != "tmp" || !fis[1].IsDir() || fis[1].Mode()&fs.ModeSticky == 0 {
+		t.Error("tmp:", fis[1].Name(), fis[1].Mode())
+	}
+	if fis[2].Name() != "link" || fis[2].Mode()&fs.ModeSymlink == 0 {
+		t.Error("link:", fis[2].Name(), fis[2].Mode())
+	}
+	if fis[3].Name() != "suid" || fis[3].Mode() != fs.ModeSetuid|0755 {
+		t.Error("suid:", fis[3].Name(), fis[3].Mode())
+	}
+}
+
+// fakeScpSource 模拟远端的 scp -f
+func fakeScpSource(t *testing.T, r io.Reader, w io.Writer, content string) {
+	br := bufio.NewReader(r)
+	if err := scpReadAck(br); err != nil {
+		t.Error(err)
+		return
+	}
+	io.WriteString(w, "T1696910462 0 1696910462 0\n")
+	if err := scpReadAck(br); err != nil {
+		t.Error(err)
+		return
+	}
+	io.WriteString(w, "C0644 "+strconv.Itoa(len(content))+" a.txt\n")
+	if err := scpReadAck(br); err != nil {
+		t.Error(err)
+		return
+	}
+	io.WriteString(w, content)
+	w.Write([]byte{0})
+	if err := scpReadAck(br); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScpReceive(t *testing.T) {
+	content := strings.Repeat("abcdefg", 1000)
+
+	remoteIn, localOut := io.Pipe()
+	localIn, remoteOut := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeScpSource(t, remoteIn, remoteOut, content)
+	}()
+
+	stdout := bufio.NewReader(localIn)
+	size, err := scpReceive(stdout, localOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Fatal("want", len(content), "got", size)
+	}
+
+	r := &scpFileReader{
+		stdin:  localOut,
+		stdout: stdout,
+		r:      io.LimitReader(stdout, size),
+	}
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != content {
+		t.Error("content is mismatch")
+	}
+	<-done
+}
+
+func TestScpSend(t *testing.T) {
+	content := strings.Repeat("abcdefg", 1000)
+
+	remoteIn, localOut := io.Pipe()
+	localIn, remoteOut := io.Pipe()
+
+	var received bytes.Buffer
+	var header string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		br := bufio.NewReader(remoteIn)
+		remoteOut.Write([]byte{0})
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		header = line
+		remoteOut.Write([]byte{0})
+		if _, err := io.CopyN(&received, br, int64(len(content))); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := scpReadAck(br); err != nil {
+			t.Error(err)
+			return
+		}
+		remoteOut.Write([]byte{0})
+	}()
+
+	err := scpSend(bufio.NewReader(localIn), localOut, "a.txt", 0644, int64(len(content)), strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if header != "C0644 "+strconv.Itoa(len(content))+" a.txt\n" {
+		t.Errorf("header is %q", header)
+	}
+	if received.String() != content {
+		t.Error("content is mismatch")
+	}
+}
+
+func TestScpReadAckError(t *testing.T) {
+	err := scpReadAck(bufio.NewReader(strings.NewReader("\x01scp: a.txt: No such file or directory\n")))
+	if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Error("want error, got", err)
+	}
+}
+
+func TestSftpUnavailable(t *testing.T) {
+	if !sftpUnavailable(errors.New("ssh: subsystem request failed")) {
+		t.Error("want true for rejected subsystem")
+	}
+	for _, err := range []error{nil, io.EOF, errors.New("ssh: unable to authenticate")} {
+		if sftpUnavailable(err) {
+			t.Error("want false for", err)
+		}
+	}
+}
@@ -116,3 +116,71 @@ func (st *sftpTarget) Delete(path string) error {
 func (st *sftpTarget) Exists(pa string) (bool, error) {
 	return fileExists(st, pa)
 }
+
+// SSHWithPassword 连接 ssh 服务器, 优先使用 sftp, 当服务器不支持 sftp 子系统时改用 scp
+func SSHWithPassword(host, username, password string) (Session, error) {
+	conn, err := shell.DialSSH(host, username, password, "")
+	if err != nil {
+		return nil, err
+	}
+	return sftpOrSCP(conn)
+}
+
+// SSHWithKey 连接 ssh 服务器, 优先使用 sftp, 当服务器不支持 sftp 子系统时改用 scp
+func SSHWithKey(host, username, keyfile, passphrase string) (Session, error) {
+	bs, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load keyfile fail")
+	}
+
+	conn, err := shell.DialSSH(host, username, passphrase, string(bs))
+	if err != nil {
+		return nil, err
+	}
+	return sftpOrSCP(conn)
+}
+
+// sftpUnavailable 判断错误是否是服务器拒绝了 sftp 子系统, ssh 包没有导出这个错误，只能比较错误消息
+func sftpUnavailable(err error) bool {
+	return err != nil && err.Error() == "ssh: subsystem request failed"
+}
+
+// sftpOrSCP 只在服务器拒绝 sftp 子系统时改用 scp, 连接断开等其它错误直接返回
+func sftpOrSCP(conn *ssh.Client) (Session, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pw, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		conn.Close()
+		return nil, err
+	}
+	pr, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		conn.Close()
+		return nil, err
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		sess.Close()
+		if sftpUnavailable(err) {
+			// 有些主机禁用了 sftp 子系统，但是允许 scp
+			return SCP(conn), nil
+		}
+		conn.Close()
+		return nil, err
+	}
+	client, err := sftp.NewClientPipe(pr, pw)
+	if err != nil {
+		sess.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &sftpTarget{
+		conn:   conn,
+		client: client,
+	}, nil
+}
@@ -1,20 +1,26 @@
 package scopy
 
 import (
-	"database/sql"
 	"errors"
-	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	aceql_http "github.com/mei-rune/aceql-http-go"
 )
 
+// DBHTTP 通过 aceql-http 打开数据库中的文件表，需要调用 EnsureSchema 建表或升级表
 func DBHTTP(baseURL, dbname, username, password, dbTable string, maxSize int, enableSavepoint bool) (*sqlhttpTarget, error) {
+	return DBHTTPWithMapping(baseURL, dbname, username, password, TableMapping{Table: dbTable}, maxSize, enableSavepoint)
+}
+
+// DBHTTPWithMapping 和 DBHTTP 一样, 但是可以指定表名和列名的映射，用于使用已有的表
+func DBHTTPWithMapping(baseURL, dbname, username, password string, mapping TableMapping, maxSize int, enableSavepoint bool) (*sqlhttpTarget, error) {
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
 	var c = &aceql_http.Client{
 		BaseURL:       baseURL,
 		LobAutoUpload: true,
@@ -33,27 +39,11 @@ func DBHTTP(baseURL, dbname, username, password, dbTable string, maxSize int, en
 		password:        password,
 		dataAsBinary:    true,
 		enableSavepoint: enableSavepoint,
-
-		insertSql:       DefaultInsertSQL,
-		readSqlByUUID:   DefaultReadSQLByUUID,
-		renameSql:       DefaultRenameSQL,
-		deleteSqlByUUID: DefaultDeleteSQLByUUID,
-		listSql:         DefaultListSql,
-		existSql:        DefaultExistSql,
-		readDataSql:     DefaultReadDataByID,
-		readIDsByUUID:   DefaultReadIDsByUUID,
-	}
-
-	if dbTable != "" {
-		target.insertSql = strings.Replace(DefaultInsertSQL, "tpt_files", dbTable, -1)
-		target.readSqlByUUID = strings.Replace(DefaultReadSQLByUUID, "tpt_files", dbTable, -1)
-		target.renameSql = strings.Replace(DefaultRenameSQL, "tpt_files", dbTable, -1)
-		target.deleteSqlByUUID = strings.Replace(DefaultDeleteSQLByUUID, "tpt_files", dbTable, -1)
-		target.listSql = strings.Replace(DefaultListSql, "tpt_files", dbTable, -1)
-		target.existSql = strings.Replace(DefaultExistSql, "tpt_files", dbTable, -1)
-		target.readDataSql = strings.Replace(DefaultReadDataByID, "tpt_files", dbTable, -1)
-		target.readIDsByUUID = strings.Replace(DefaultReadIDsByUUID, "tpt_files", dbTable, -1)
+		dialect:         dialectOf(""),
+		table:           mapping.name(),
+		mapping:         mapping,
 	}
+	target.stmts = newStatements(target.dialect, mapping)
 	return target, nil
 }
 
@@ -64,15 +54,12 @@ type sqlhttpTarget struct {
 	maxSize                    int
 	dataAsBinary               bool
 	enableSavepoint            bool
-
-	insertSql       string
-	readSqlByUUID   string
-	renameSql       string
-	deleteSqlByUUID string
-	listSql         string
-	existSql        string
-	readDataSql     string
-	readIDsByUUID   string
+	dialect                    *dialect
+	table                      string
+	mapping                    TableMapping
+	opts                       DBOptions
+	stmts                      *sqlStatements
+	batch                      bool // 绑定到批处理时会话失效后不再重新登录
 
 	sess *aceql_http.Session
 }
@@ -85,6 +72,9 @@ func (st *sqlhttpTarget) GetSession() (*aceql_http.Session, error) {
 	if st.sess != nil {
 		return st.sess, nil
 	}
+	if st.batch {
+		return nil, errBatchSessionLost
+	}
 
 	loginRes, err := st.c.Login(st.dbname, st.username, st.password)
 	if err != nil {
@@ -104,6 +94,9 @@ type sqlhttpFileWriter struct {
 	savepoint *aceql_http.SavepointResult
 	uuid      string
 	idx       int
+	tracker   *metaTracker
+	quota     int64 // 剩余的配额，小于 0 时没有配额
+	limit     int   // 块大小的上限, 见 StorageAdaptive
 
 	isCommited bool
 	lastError  error
@@ -180,6 +173,10 @@ func (w *sqlhttpFileWriter) Write(data []byte) (int, error) {
 	}
 
 	w.buffer = append(w.buffer, data...)
+	w.buffer, w.lastError = splitChunks(w.buffer, w.limit, w.write)
+	if w.lastError != nil {
+		return 0, w.lastError
+	}
 	return len(data), nil
 }
 
@@ -195,24 +192,59 @@ func (w *sqlhttpFileWriter) write(last bool, data []byte) error {
 		total = DataEnd
 	}
 
-	sess, err := w.st.GetSession()
+	if err := useQuota(&w.quota, len(data)); err != nil {
+		return err
+	}
+	if w.tracker != nil {
+		w.tracker.add(data)
+	}
+	if w.idx == 0 {
+		if w.st.opts.Versioned {
+			if err := archiveVersion(w.st.execer(), w.st.stmts, w.st.opts, w.uuid); err != nil {
+				return err
+			}
+		}
+		if err := clearFile(w.st.execer(), w.st.stmts, w.st.opts, w.uuid); err != nil {
+			return err
+		}
+	}
+	if w.st.opts.Dedup {
+		if err := writeDedupChunk(w.st.execer(), w.st.stmts, w.st.opts, w.uuid, total, w.idx, data); err != nil {
+			return err
+		}
+		w.idx++
+		return w.writeMeta(last)
+	}
+
+	stored, encoding, err := encodeChunk(w.st.opts.Compression, data)
+	if err != nil {
+		return err
+	}
+	stored, keyID, err := sealChunk(w.st.opts.Keys, encoding, chunkBinding(w.uuid, w.idx), stored)
 	if err != nil {
 		return err
 	}
 
 	var dataValue = aceql_http.ParamValue{
 		Type:  aceql_http.VARCHAR,
-		Value: string(data),
+		Value: string(stored),
 	}
-	if w.st.dataAsBinary {
+	if w.st.dataAsBinary || encoding != EncodingNone || keyID != "" {
 		dataValue.Type = aceql_http.BLOB
-	} else if len(data) > 10*1024 {
+		dataValue.Blob = stored
+	} else if len(stored) > 10*1024 {
 		dataValue.Type = aceql_http.BLOB
 	}
 
+	insertSql := w.st.stmts.insertData
+
 	retried := false
 retry:
-	_, err = w.st.c.ExecuteUpdate(sess, w.st.insertSql, []aceql_http.ParamValue{
+	sess, err := w.st.GetSession()
+	if err != nil {
+		return err
+	}
+	_, err = w.st.c.ExecuteUpdate(sess, insertSql, []aceql_http.ParamValue{
 		{
 			Type:  aceql_http.VARCHAR,
 			Value: w.uuid,
@@ -226,6 +258,18 @@ retry:
 			Value: strconv.Itoa(w.idx),
 		},
 		dataValue,
+		{
+			Type:  aceql_http.BIGINT,
+			Value: strconv.Itoa(len(data)),
+		},
+		{
+			Type:  aceql_http.VARCHAR,
+			Value: encoding,
+		},
+		{
+			Type:  aceql_http.VARCHAR,
+			Value: keyID,
+		},
 	}, true)
 	if err != nil {
 		if aceql_http.IsInvalidOrExipredConnection(err) {
@@ -236,8 +280,9 @@ retry:
 				goto retry
 			}
 		}
-		if strings.Contains(err.Error(), "Duplicate entry") {
-			_, err = w.st.c.ExecuteUpdate(sess, w.st.deleteSqlByUUID, []aceql_http.ParamValue{
+		// 其它的连接同时写入了这个文件
+		if w.idx == 0 && w.st.dialect.isDuplicateKey(err) {
+			_, err = w.st.c.ExecuteUpdate(sess, w.st.stmts.deleteByUUID, []aceql_http.ParamValue{
 				{
 					Type:  aceql_http.VARCHAR,
 					Value: w.uuid,
@@ -252,8 +297,22 @@ retry:
 		}
 		return err
 	}
+
 	w.idx++
-	return nil
+	return w.writeMeta(last)
+}
+
+// writeMeta 在写完最后一块后更新元数据和记录变更
+func (w *sqlhttpFileWriter) writeMeta(last bool) error {
+	if !last {
+		return nil
+	}
+	if w.tracker != nil {
+		if err := writeMeta(w.st.execer(), w.st.stmts, w.uuid, w.tracker.finish(w.idx)); err != nil {
+			return err
+		}
+	}
+	return logChange(w.st.execer(), w.st.stmts, w.st.opts, ChangeWrite, w.uuid)
 }
 
 func (w *sqlhttpFileWriter) OneWrite(data []byte) error {
@@ -267,6 +326,10 @@ func (w *sqlhttpFileWriter) OneWrite(data []byte) error {
 		}
 		w.buffer = w.buffer[:0]
 	}
+	data, w.lastError = splitChunks(data, w.limit, w.write)
+	if w.lastError != nil {
+		return w.lastError
+	}
 	w.lastError = w.write(true, data)
 	return w.lastError
 }
@@ -276,6 +339,20 @@ func (st *sqlhttpTarget) Write(remotePath string) (io.WriteCloser, error) {
 	// if err != nil {
 	// 	return nil, err
 	// }
+	// 大对象的函数要用 select 调用，aceql-http 的 ExecuteUpdate 不能执行 select
+	if st.opts.Storage == StorageLargeObject {
+		return nil, ErrLargeObjectUnsupported
+	}
+	key := st.opts.key(remotePath)
+	quota, err := quotaLeft(st.execer(), st.stmts, st.opts, key)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := chunkLimit(st.execer(), st.dialect, st.opts, st.maxSize)
+	if err != nil {
+		return nil, err
+	}
+
 	retryCount := 0
 	var savepoint *aceql_http.SavepointResult
 retry:
@@ -298,12 +375,19 @@ retry:
 		}
 	}
 
+	var tracker *metaTracker
+	if st.opts.Metadata {
+		tracker = newMetaTracker(remotePath, FileMeta{})
+	}
 	return &sqlhttpFileWriter{
 		st:        st,
 		savepoint: savepoint,
 		// maxSize: st.maxSize,
-		uuid: remotePath,
-		idx:  0,
+		uuid:    key,
+		idx:     0,
+		tracker: tracker,
+		quota:   quota,
+		limit:   limit,
 	}, nil
 }
 
@@ -320,233 +404,9 @@ func (st *sqlhttpTarget) WriteFile(remotePath string, data []byte) (reterr error
 	return w.(*sqlhttpFileWriter).OneWrite(data)
 }
 
-type sqlhttpFileReader struct {
-	st *sqlhttpTarget
-
-	idList  []string
-	next    []string
-	data    []byte
-	lastErr error
-}
-
-func (r *sqlhttpFileReader) Close() error {
-	return nil
-}
-
-func (r *sqlhttpFileReader) Read(data []byte) (int, error) {
-	if r.lastErr != nil {
-		return 0, r.lastErr
-	}
-
-	if len(data) == 0 {
-		return 0, nil
-	}
-
-	for len(r.data) == 0 {
-		if len(r.next) == 0 {
-			return 0, io.EOF
-		}
-
-		r.data, r.lastErr = r.read(r.next[0])
-		if r.lastErr != nil {
-			return 0, r.lastErr
-		}
-		r.next = r.next[1:]
-	}
-
-	if len(r.data) == 0 {
-		return 0, io.EOF
-	}
-
-	if len(r.data) > len(data) {
-		n := copy(data, r.data[:len(data)])
-		r.data = r.data[n:]
-		return n, nil
-	}
-
-	n := copy(data, r.data)
-	r.data = r.data[n:]
-	return n, nil
-}
-
-func (r *sqlhttpFileReader) read(id string) ([]byte, error) {
-	sess, err := r.st.GetSession()
-	if err != nil {
-		return nil, err
-	}
-
-	// args := []aceql_http.ParamValue{
-	// 	{
-	// 		Type:  aceql_http.INTEGER,
-	// 		Value: id,
-	// 	},
-	// }
-
-	sqlstr := strings.Replace(r.st.readDataSql, "?", id, 1)
-	qr, err := r.st.c.ExecuteQuery(sess, sqlstr, nil, true)
-	if err != nil {
-		if aceql_http.IsInvalidOrExipredConnection(err) {
-			r.st.ClearSession()
-		}
-		return nil, err
-	}
-
-	if len(qr.QueryRows) == 0 {
-		return nil, errors.New("scopy: result set is empty")
-	}
-
-	record := qr.QueryRows[0]["row_1"]
-	if record == nil {
-		return nil, errors.New("scopy: rows is empty")
-	}
-
-	if len(record) == 0 {
-		return nil, errors.New("scopy: columns is empty")
-	}
-
-	data := record[0]["data"]
-	if data == nil {
-		return nil, errors.New("scopy: column 'data' is missing")
-	}
-	s, ok := data.(string)
-	if !ok {
-		return nil, errors.New("scopy: column 'data' isnot string")
-	}
-
-	if len(qr.QueryTypes) > 0 {
-		if qr.QueryTypes[0] == aceql_http.CLOB ||
-			qr.QueryTypes[0] == aceql_http.BLOB ||
-			qr.QueryTypes[0] == aceql_http.BINARY ||
-			qr.QueryTypes[0] == aceql_http.LONGVARBINARY ||
-			qr.QueryTypes[0] == aceql_http.VARBINARY {
-			bs, err := r.st.c.GetBlob(sess, s)
-			if err != nil && aceql_http.IsInvalidOrExipredConnection(err) {
-				r.st.ClearSession()
-			}
-			return bs, err
-		}
-	}
-
-	return []byte(s), nil
-}
-
-func (st *sqlhttpTarget) Read(remotePath string) (io.ReadCloser, error) {
-	sess, err := st.GetSession()
-	if err != nil {
-		return nil, err
-	}
-
-	sqlstr := strings.Replace(st.readIDsByUUID, "?", "'"+remotePath+"'", 1)
-	// args := []aceql_http.ParamValue{
-	// 	{
-	// 		Type:  aceql_http.VARCHAR,
-	// 		Value: remotePath,
-	// 	},
-	// }
-
-	results, err := st.c.ExecuteQuery(sess, sqlstr, nil, true)
-	if err != nil {
-		if aceql_http.IsInvalidOrExipredConnection(err) {
-			st.ClearSession()
-		}
-		return nil, err
-	}
-
-	selectResults := results.ToSelectResult()
-
-	// if selectResults.Status != aceql_http.OK {
-	// 	return nil, results
-	// }
-
-	if len(selectResults.ResultSets) == 0 {
-		return nil, errors.New("scopy: result set is empty")
-	}
-
-	var idList []string
-	for idx := range selectResults.ResultSets[0].Rows {
-		id := selectResults.ResultSets[0].Rows[idx][0].Value
-		idList = append(idList, fmt.Sprint(id))
-	}
-
-	// defer rows.Close()
-
-	return &sqlhttpFileReader{
-		st: st,
-
-		idList: idList,
-		next:   idList,
-	}, nil
-}
-
+// List 返回目录下的文件和子目录，uuid 中用 / 分隔的部分被看作目录
 func (st *sqlhttpTarget) List(remotePath string) ([]fs.FileInfo, error) {
-	if remotePath != "" {
-		return nil, errors.New("remotePath must is empty")
-	}
-	sess, err := st.GetSession()
-	if err != nil {
-		return nil, err
-	}
-	results, err := st.c.ExecuteQuery(sess, st.listSql, nil, true)
-	if err != nil {
-		if aceql_http.IsInvalidOrExipredConnection(err) {
-			st.ClearSession()
-		}
-		return nil, err
-	}
-	selectResults := results.ToSelectResult()
-
-	// if selectResults.Status != aceql_http.OK {
-	// 	return nil, results
-	// }
-
-	if len(selectResults.ResultSets) == 0 {
-		return nil, errors.New("scopy: result set is empty")
-	}
-
-	var list []fs.FileInfo
-	for idx := range selectResults.ResultSets[0].Rows {
-		values := selectResults.ResultSets[0].Rows[idx]
-
-		var uuid string
-		var length sql.NullInt64
-		var created sql.NullTime
-		for _, value := range values {
-			switch value.Name {
-			case "uuid":
-				uuid = fmt.Sprint(value.Value)
-			case "length":
-				s := fmt.Sprint(value.Value)
-				i64, err := strconv.ParseInt(s, 10, 64)
-				if err != nil {
-					return nil, errors.New("scopy: colum 'length' is invalid value '" + s + "'")
-				}
-				length.Valid = true
-				length.Int64 = i64
-			case "created_at":
-				s := fmt.Sprint(value.Value)
-				t, err := ToDatetime(s)
-				if err != nil {
-					return nil, errors.New("scopy: colum 'created_at' is invalid value '" + s + "'")
-				}
-				created.Valid = true
-				created.Time = t
-			default:
-				s := fmt.Sprint(value.Value)
-				return nil, errors.New("scopy: colum '" + value.Name + "' is invalid value '" + s + "'")
-			}
-		}
-
-		if !length.Valid {
-			length.Int64 = -1
-		}
-		list = append(list, &fileStat{
-			name:    uuid,
-			size:    length.Int64,
-			modTime: created.Time,
-		})
-	}
-
-	return list, nil
+	return listDir(st.execer(), st.stmts, st.dialect, st.opts.Metadata, st.opts.dir(remotePath))
 }
 
 func (st *sqlhttpTarget) Exists(pa string) (bool, error) {
@@ -554,34 +414,32 @@ func (st *sqlhttpTarget) Exists(pa string) (bool, error) {
 }
 
 func (st *sqlhttpTarget) Rename(from, to string) error {
-	sess, err := st.GetSession()
-	if err != nil {
-		return err
+	from, to = st.opts.key(from), st.opts.key(to)
+	if from == to {
+		return nil
 	}
-
-	_, err = st.c.ExecuteUpdate(sess, st.renameSql, []aceql_http.ParamValue{
-		{
-			Type:  aceql_http.VARCHAR,
-			Value: to,
-		},
-		{
-			Type:  aceql_http.VARCHAR,
-			Value: from,
-		},
-	}, true)
-	if err != nil && aceql_http.IsInvalidOrExipredConnection(err) {
-		st.ClearSession()
-	}
-	return err
+	return st.inTx(func(e execer) error {
+		return renameFile(e, st.stmts, st.opts, from, to)
+	})
 }
 
 func (st *sqlhttpTarget) Delete(remotePath string) error {
+	remotePath = st.opts.key(remotePath)
+	if st.opts.Versioned {
+		if err := archiveVersion(st.execer(), st.stmts, st.opts, remotePath); err != nil {
+			return err
+		}
+	}
+	if err := releaseFile(st.execer(), st.stmts, st.opts, remotePath); err != nil {
+		return err
+	}
+
 	sess, err := st.GetSession()
 	if err != nil {
 		return err
 	}
 
-	count, err := st.c.ExecuteUpdate(sess, st.deleteSqlByUUID, []aceql_http.ParamValue{
+	count, err := st.c.ExecuteUpdate(sess, st.stmts.deleteByUUID, []aceql_http.ParamValue{
 		{
 			Type:  aceql_http.VARCHAR,
 			Value: remotePath,
@@ -594,10 +452,15 @@ func (st *sqlhttpTarget) Delete(remotePath string) error {
 		return err
 	}
 
+	if st.opts.Metadata {
+		if _, err := st.execer().exec(st.stmts.metaDelete, remotePath); err != nil {
+			return err
+		}
+	}
 	if count == 0 {
 		return os.ErrNotExist
 	}
-	return nil
+	return logChange(st.execer(), st.stmts, st.opts, ChangeDelete, remotePath)
 }
 
 var (
@@ -1,8 +1,13 @@
 package scopy
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
 	"testing"
 )
@@ -29,23 +34,15 @@ func TestSqlHttp(t *testing.T) {
 		return
 	}
 
-	sess, err := target.GetSession()
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	target.SetDialect(dbdrv)
 
-	_, err = target.c.ExecuteUpdate(sess, DefaultResetSQL, nil, false)
+	err = target.DropSchema()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	initSql := DefaultInitSQL
-	if dbdrv == "mysql" {
-		initSql = strings.Replace(initSql, "bytea", "blob", -1)
-	}
-	_, err = target.c.ExecuteUpdate(sess, initSql, nil, false)
+	err = target.EnsureSchema()
 	if err != nil {
 		t.Error(err)
 		return
@@ -70,35 +67,191 @@ func TestSqlHttpOpen(t *testing.T) {
 	fmt.Println("sqlhttp_db_username =", dbusername)
 	fmt.Println("sqlhttp_db_password =", dbpassword)
 
-	target, _, err := Open("db+"+dburl+"?sc_dbname="+dbname+"&sc_dbtable=abc",
+	target, _, err := Open("db+"+dburl+"?sc_dbname="+dbname+"&sc_dbtable=abc&sc_dbdriver="+dbdrv,
 		dbusername, dbpassword)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	sess, err := target.(*sqlhttpTarget).GetSession()
+	err = target.(*sqlhttpTarget).DropSchema()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	_, err = target.(*sqlhttpTarget).c.ExecuteUpdate(sess, strings.Replace(DefaultResetSQL, "tpt_files", "abc", -1), nil, false)
+	err = target.(*sqlhttpTarget).EnsureSchema()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	initSql := strings.Replace(DefaultInitSQL, "tpt_files", "abc", -1)
-	if dbdrv == "mysql" {
-		initSql = strings.Replace(initSql, "bytea", "blob", -1)
+	runTest(t, target)
+	runTest(t, target)
+}
+
+// 批处理在关闭了自动提交的连接上执行，会话失效后不会在新的 (自动提交的) 连接上继续
+func TestSqlHttpBatchAutoCommit(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := path.Base(r.URL.Path)
+		if strings.Contains(r.URL.Path, "/set_auto_commit/") {
+			action = "set_auto_commit/" + action
+		}
+		calls = append(calls, action)
+		switch action {
+		case "login":
+			fmt.Fprint(w, `{"status":"OK","session_id":"s1","connection_id":"c1"}`)
+		case "execute_update":
+			fmt.Fprint(w, `{"status":"OK","row_count":1}`)
+		default:
+			fmt.Fprint(w, `{"status":"OK"}`)
+		}
+	}))
+	defer srv.Close()
+
+	target, err := DBHTTP(srv.URL, "db", "u", "p", "", 0, true)
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err = target.(*sqlhttpTarget).c.ExecuteUpdate(sess, initSql, nil, false)
+
+	batch, err := target.Begin()
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if err := batch.Rename("a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// execute_query 是查找要重新绑定 uuid 的加密块
+	want := "login,set_auto_commit/false,execute_update,execute_query,commit,close"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("want %s, got %s", want, got)
 	}
 
-	runTest(t, target)
-	runTest(t, target)
+	calls = nil
+	batch, err = target.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.(*sqlhttpBatch).st.ClearSession()
+	if err := batch.Rename("a.txt", "b.txt"); err != errBatchSessionLost {
+		t.Error("want errBatchSessionLost, got", err)
+	}
+	if err := batch.Commit(); err != errBatchSessionLost {
+		t.Error("want errBatchSessionLost, got", err)
+	}
+	if got := strings.Join(calls, ","); got != "login,set_auto_commit/false" {
+		t.Error("want no calls after the session is lost, got", got)
+	}
+}
+
+// 批处理使用自己的连接，打开批处理时 target 的写入是自动提交的，不会被批处理回滚
+func TestSqlHttpBatchSession(t *testing.T) {
+	var calls []string
+	logins := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := path.Base(r.URL.Path)
+		if strings.Contains(r.URL.Path, "/set_auto_commit/") {
+			action = "set_auto_commit/" + action
+		}
+		if _, conn, ok := strings.Cut(r.URL.Path, "/connection/"); ok {
+			action = strings.SplitN(conn, "/", 2)[0] + ":" + action
+		}
+		calls = append(calls, action)
+		switch path.Base(r.URL.Path) {
+		case "login":
+			logins++
+			fmt.Fprintf(w, `{"status":"OK","session_id":"s%d","connection_id":"c%d"}`, logins, logins)
+		case "execute_update":
+			fmt.Fprint(w, `{"status":"OK","row_count":1}`)
+		default:
+			fmt.Fprint(w, `{"status":"OK"}`)
+		}
+	}))
+	defer srv.Close()
+
+	target, err := DBHTTP(srv.URL, "db", "u", "p", "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Delete("old.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := target.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete("c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "login,c1:execute_update," +
+		"login,c2:set_auto_commit/false," +
+		"c1:set_auto_commit/false,c1:execute_update,c1:execute_query,c1:commit,c1:set_auto_commit/true," +
+		"c2:execute_update," +
+		"c2:rollback,c2:close"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if target.sess == nil || target.sess.ConnectionID != "c1" {
+		t.Error("want the session of the target unchanged, got", target.sess)
+	}
+}
+
+// 不在批处理中时改名的多个语句在一个事务中执行，出错时回滚
+func TestSqlHttpRenameTx(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := path.Base(r.URL.Path)
+		if strings.Contains(r.URL.Path, "/set_auto_commit/") {
+			action = "set_auto_commit/" + action
+		}
+		calls = append(calls, action)
+		switch action {
+		case "login":
+			fmt.Fprint(w, `{"status":"OK","session_id":"s1","connection_id":"c1"}`)
+		case "execute_update":
+			fmt.Fprint(w, `{"status":"OK","row_count":1}`)
+		case "execute_query":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"FAIL","error_type":2,"error_message":"query failed","http_status":400}`)
+		default:
+			fmt.Fprint(w, `{"status":"OK"}`)
+		}
+	}))
+	defer srv.Close()
+
+	target, err := DBHTTP(srv.URL, "db", "u", "p", "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Rename("a.txt", "b.txt"); err == nil {
+		t.Error("want error")
+	}
+	want := "login,set_auto_commit/false,execute_update,execute_query,rollback,set_auto_commit/true"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	calls = nil
+	if err := target.Rename("a.txt", "a.txt"); err != nil {
+		t.Error(err)
+	}
+	if len(calls) != 0 {
+		t.Error("want no calls for renaming to the same path, got", calls)
+	}
+	// 复制到自己会删除文件
+	if _, err := target.Copy("a.txt", "a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Error("want fs.ErrInvalid, got", err)
+	}
 }
@@ -0,0 +1,500 @@
+package scopy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// sqlStatements 是文件表上用到的语句, 参数都用 ? 表示，执行时由 execer 转换为数据库的格式
+type sqlStatements struct {
+	insert string
+	// insertData 和 insert 一样，但是没有 blob_hash 参数，它总是 null
+	insertData string
+
+	readByUUID   string
+	readDataByID string
+	// readChunksByUUID 返回文件所有块的 id, 序号和大小
+	readChunksByUUID string
+	readFirst        string
+	rename           string
+	deleteByUUID     string
+	deleteByID       string
+	// listFiles 返回目录下的文件，listDirs 返回第一个子目录中的一个文件，listDirsFrom 和 listDirsPrefix
+	// 返回 uuid 不小于参数的第一个子目录中的文件, 见 listDir
+	listFiles       string
+	listFilesPrefix string
+	listDirs        string
+	listDirsFrom    string
+	listDirsPrefix  string
+	existPrefix     string
+	stat            string
+	exist           string
+
+	// 元数据表上的语句
+	metaUpsert          string
+	metaInsert          string
+	metaDelete          string
+	metaRename          string
+	metaList            string
+	metaListFiles       string
+	metaListFilesPrefix string
+	metaListDirs        string
+	metaListDirsFrom    string
+	metaListDirsPrefix  string
+	metaExistPrefix     string
+	metaStat            string
+	metaClear           string
+	metaRebuild         string
+	metaRebuildOne      string
+
+	// 历史版本表上的语句
+	verMax      string
+	verArchive  string
+	verList     string
+	verChunks   string
+	verReadData string
+	verRestore  string
+	verDeleteTo string
+	verPruneAge string
+	verPruneAll string
+	verUUIDs    string
+
+	// 清理时使用的语句, 执行时会加上 limit
+	gcExpired    string
+	gcIncomplete string
+	gcOldest     string
+	totalSize    string
+	// gc*Prefix 只选出命名空间中的文件, 前缀的参数在前面
+	gcExpiredPrefix    string
+	gcIncompletePrefix string
+	gcOldestPrefix     string
+
+	// 命名空间的文件数和总大小
+	usage       string
+	usagePrefix string
+
+	// 检查文件时使用的语句，不读取数据
+	fsckScan       string
+	fsckScanPrefix string
+
+	// 重新加密时使用的语句，执行时会加上 limit
+	rekeySelect    string
+	rekeyUpdate    string
+	verRekeySelect string
+	verRekeyUpdate string
+	resealChunks   string
+	resealRead     string
+
+	// 去重模式下块的数据保存在 "<表名>_blobs" 表中，文件表中的行通过 blob_hash 引用它
+	blobRetain        string
+	blobInsert        string
+	blobRelease       string
+	blobRetainFile    string
+	verBlobRetain     string
+	verBlobReleaseTo  string
+	verBlobReleaseAge string
+	verBlobReleaseAll string
+	blobUnused        string
+	blobDelete        string
+	blobRecount       string
+	blobRekeySelect   string
+	blobRekeyUpdate   string
+
+	// 在数据库中复制文件
+	copyFile string
+	metaCopy string
+
+	// 队列上的语句, claimSelect 执行时会加上 limit
+	claimSelect       string
+	claimSelectPrefix string
+	claim             string
+	claimTouch        string
+	claimRelease      string
+
+	// 变更表上的语句, changeList 执行时会加上 limit
+	changeInsert string
+	changeList   string
+	// changeListPrefix 只返回命名空间中的变更
+	changeListPrefix string
+	changeLast       string
+	changePrune      string
+	// changePrunePrefix 只删除命名空间中的变更, 前缀的参数在前面
+	changePrunePrefix string
+	// changeGet 后面要加上 "(?, ?, ...)"
+	changeGet string
+
+	// postgres 的大对象上的语句, 其它数据库上为空, 见 StorageLargeObject
+	loCreate  string
+	loPut     string
+	loCopyPut string
+	loInsert  string
+	loFile    string
+	loRead    string
+	loSet     string
+	loUnlink  string
+}
+
+// quote 返回加了引号的标识符，oracle 中不加引号的标识符是大写的，所以这里转为大写
+func (d *dialect) quote(ident string) string {
+	switch d.name {
+	case DialectMySQL:
+		return "`" + strings.Replace(ident, "`", "``", -1) + "`"
+	case DialectPostgres, DialectSQLite:
+		return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+	case DialectMSSQL:
+		return "[" + strings.Replace(ident, "]", "]]", -1) + "]"
+	case DialectOracle:
+		return `"` + strings.ToUpper(strings.Replace(ident, `"`, `""`, -1)) + `"`
+	}
+	// 不知道是什么数据库时不加引号
+	return ident
+}
+
+// quoteTable 和 quote 一样， 但是 table 中可以带有 schema, 如 "myschema.tpt_files"
+func (d *dialect) quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for idx := range parts {
+		parts[idx] = d.quote(parts[idx])
+	}
+	return strings.Join(parts, ".")
+}
+
+// limit 返回限制结果行数的子句，放在 order by 之后
+func (d *dialect) limit(n int) string {
+	switch d.name {
+	case DialectMSSQL:
+		return " OFFSET 0 ROWS FETCH NEXT " + strconv.Itoa(n) + " ROWS ONLY"
+	case DialectOracle:
+		return " FETCH FIRST " + strconv.Itoa(n) + " ROWS ONLY"
+	}
+	return " LIMIT " + strconv.Itoa(n)
+}
+
+// length 返回求二进制列长度的表达式
+func (d *dialect) length(column string) string {
+	switch d.name {
+	case DialectMSSQL:
+		return "DATALENGTH(" + column + ")"
+	case DialectOracle:
+		return "DBMS_LOB.GETLENGTH(" + column + ")"
+	}
+	return "length(" + column + ")"
+}
+
+// upsert 返回插入一行，并在 keys 冲突时更新其它列的语句，不支持时返回空字符串,
+// values 是与 columns 对应的值表达式, 一般为 ?
+func (d *dialect) upsert(table string, columns, values, keys []string) string {
+	return d.merge(table, columns, values, keys, "")
+}
+
+// upsertCounter 和 upsert 一样，但是在 keys 冲突时只将 counter 列加 1
+func (d *dialect) upsertCounter(table string, columns, values, keys []string, counter string) string {
+	return d.merge(table, columns, values, keys, counter)
+}
+
+func (d *dialect) merge(table string, columns, values, keys []string, counter string) string {
+	var updates []string
+	for _, column := range columns {
+		isKey := false
+		for _, key := range keys {
+			if key == column {
+				isKey = true
+				break
+			}
+		}
+		if !isKey {
+			updates = append(updates, column)
+		}
+	}
+
+	insert := "INSERT INTO " + table + "(" + strings.Join(columns, ", ") + ") VALUES(" + strings.Join(values, ", ") + ")"
+
+	switch d.name {
+	case DialectMySQL:
+		if counter != "" {
+			return insert + " ON DUPLICATE KEY UPDATE " + counter + " = " + counter + " + 1"
+		}
+		sets := make([]string, len(updates))
+		for idx, column := range updates {
+			sets[idx] = column + " = VALUES(" + column + ")"
+		}
+		return insert + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	case DialectPostgres, DialectSQLite:
+		if counter != "" {
+			// postgres 中不加限定的列名有歧义，要通过表的别名引用原来的行
+			if d.name == DialectPostgres {
+				insert = "INSERT INTO " + table + " AS dst(" + strings.Join(columns, ", ") + ") VALUES(" + strings.Join(values, ", ") + ")"
+				return insert + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + counter + " = dst." + counter + " + 1"
+			}
+			return insert + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + counter + " = " + counter + " + 1"
+		}
+		sets := make([]string, len(updates))
+		for idx, column := range updates {
+			sets[idx] = column + " = excluded." + column
+		}
+		return insert + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ")
+	case DialectMSSQL, DialectOracle:
+		selects := make([]string, len(columns))
+		srcColumns := make([]string, len(columns))
+		for idx, column := range columns {
+			selects[idx] = values[idx] + " AS " + column
+			srcColumns[idx] = "src." + column
+		}
+		ons := make([]string, len(keys))
+		for idx, key := range keys {
+			ons[idx] = "dst." + key + " = src." + key
+		}
+		sets := make([]string, len(updates))
+		for idx, column := range updates {
+			sets[idx] = "dst." + column + " = src." + column
+		}
+		if counter != "" {
+			sets = []string{"dst." + counter + " = dst." + counter + " + 1"}
+		}
+
+		if d.name == DialectMSSQL {
+			return "MERGE INTO " + table + " WITH (HOLDLOCK) AS dst USING (SELECT " + strings.Join(selects, ", ") + ") AS src" +
+				" ON " + strings.Join(ons, " AND ") +
+				" WHEN MATCHED THEN UPDATE SET " + strings.Join(sets, ", ") +
+				" WHEN NOT MATCHED THEN INSERT (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(srcColumns, ", ") + ");"
+		}
+		return "MERGE INTO " + table + " dst USING (SELECT " + strings.Join(selects, ", ") + " FROM dual) src" +
+			" ON (" + strings.Join(ons, " AND ") + ")" +
+			" WHEN MATCHED THEN UPDATE SET " + strings.Join(sets, ", ") +
+			" WHEN NOT MATCHED THEN INSERT (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(srcColumns, ", ") + ")"
+	}
+	return ""
+}
+
+func newStatements(d *dialect, m TableMapping) *sqlStatements {
+	table := m.name()
+	col := func(name string) string {
+		return d.quote(m.column(name))
+	}
+	t := d.quoteTable(table)
+	id := col("id")
+	uuid := col("uuid")
+	count := col("partitioning_count")
+	seq := col("partitioning_sequence")
+	data := col("data")
+	dataSize := col("data_size")
+	created := col("created_at")
+	encoding := col("encoding")
+	keyID := col("key_id")
+	blobHash := col("blob_hash")
+	claimedBy := col("claimed_by")
+	claimedAt := col("claimed_at")
+	loOID := col("lo_oid")
+
+	// 额外的常量列在写入时填入, 文件表上的查询都要加上 scope 条件
+	var extraColumns, extraValues []string
+	scope := extraScope(d, m)
+	for _, column := range m.extraColumns() {
+		extraColumns = append(extraColumns, d.quote(column))
+		extraValues = append(extraValues, d.literal(m.Extra[column]))
+	}
+	extraCopy, extraSelect := "", ""
+	for idx := range extraColumns {
+		extraCopy += ", " + extraColumns[idx]
+		extraSelect += ", " + extraValues[idx]
+	}
+	// where 返回文件表上的 where 子句, cond 为空时只有 scope 条件
+	where := func(cond string) string {
+		if cond == "" {
+			if scope == "" {
+				return ""
+			}
+			return " where " + strings.TrimPrefix(scope, " and ")
+		}
+		return " where " + cond + scope
+	}
+
+	allColumns := id + ", " + uuid + ", " + count + ", " + seq + ", " + data + ", " + created
+	chunkColumns := append([]string{uuid, count, seq, data, dataSize, encoding, keyID, blobHash, created}, extraColumns...)
+	chunkValues := append([]string{"?", "?", "?", "?", "?", "?", "?", "?", d.now()}, extraValues...)
+	dataValues := append([]string{"?", "?", "?", "?", "?", "?", "?", "null", d.now()}, extraValues...)
+	// data_size 是版本 5 增加的, 之前由其它程序写入的行没有它。块压缩后 data 的长度不是文件的大小
+	chunkSize := "coalesce(" + dataSize + ", " + d.length(data) + ")"
+	// 复制块时除了 uuid 和时间之外的列
+	chunkCopy := count + ", " + seq + ", " + data + ", " + dataSize + ", " + encoding + ", " + keyID + ", " + blobHash
+	// 参数是 subdirPattern 返回的模式
+	noSubdir := uuid + " not like ? escape '" + likeEscape + "'"
+	inSubdir := uuid + " like ? escape '" + likeEscape + "'"
+	listSelect := "select " + uuid + " as uuid, sum(" + chunkSize + ") as length, max(" + created + ") as created_at from " + t
+
+	mt := d.quoteTable(metaTable(table))
+	metaColumns := []string{uuid, d.quote("size"), d.quote("chunk_count"), d.quote("hash"), d.quote("content_type"),
+		d.quote("mtime"), d.quote("mode"), d.quote("updated_at")}
+	metaValues := []string{"?", "?", "?", "?", "?", "?", "?", d.now()}
+	vt := d.quoteTable(versionTable(table))
+	version := d.quote("version")
+	archived := d.quote("archived_at")
+	metaRebuild := "insert into " + mt + "(" + uuid + ", " + d.quote("size") + ", " + d.quote("chunk_count") + ", " +
+		d.quote("mtime") + ", " + d.quote("mode") + ", " + d.quote("updated_at") + ")" +
+		" select " + uuid + ", sum(" + chunkSize + "), count(*), max(" + created + "), 420, " + d.now() +
+		" from " + t
+
+	bt := d.quoteTable(blobTable(table))
+	hash := d.quote("hash")
+	refcount := d.quote("refcount")
+	// readData 返回块和它引用的 blob 的数据，去重的块的数据在 blob 中
+	readData := func(from string) string {
+		return "select c." + data + ", c." + encoding + ", c." + keyID + ", b." + data + ", b." + encoding + ", b." + keyID +
+			", c." + uuid + ", c." + seq + ", c." + blobHash +
+			" from " + from + " c left join " + bt + " b on b." + hash + " = c." + blobHash + " where c." + id + " = ?"
+	}
+	// adjustRefs 按 from 中符合 where 条件的行修改 blob 的引用计数，where 中的参数要传两次
+	adjustRefs := func(op, from, where string) string {
+		return "update " + bt + " set " + refcount + " = " + refcount + " " + op +
+			" (select count(*) from " + from + " where " + where + " and " + from + "." + blobHash + " = " + bt + "." + hash + ")" +
+			" where " + hash + " in (select " + blobHash + " from " + from + " where " + where + ")"
+	}
+
+	fsckSelect := "select " + uuid + ", " + count + ", " + seq + ", " + chunkSize + " from " + t
+	ct := d.quoteTable(changeTable(table))
+	op := d.quote("op")
+
+	usageSelect := "select count(distinct " + uuid + "), sum(" + chunkSize + ") from " + t
+	gcSelect := "select " + uuid + ", sum(" + chunkSize + ") from " + t
+	gcExpiredHaving := " group by " + uuid + " having max(" + created + ") < " + d.ago() + " order by max(" + created + "), " + uuid
+	gcIncompleteHaving := " group by " + uuid + " having max(" + count + ") < 0 and max(" + created + ") < " + d.ago() + " order by max(" + created + "), " + uuid
+	gcOldestOrder := " group by " + uuid + " order by max(" + created + "), " + uuid
+	// 只取已经写完的文件
+	claimHaving := " group by " + uuid + " having max(" + count + ") >= 0 and (max(" + claimedBy + ") is null or max(" + claimedAt + ") < " + d.ago() + ")" +
+		" order by max(" + created + "), " + uuid
+
+	metaSelect := "select " + uuid + ", " + d.quote("size") + ", " + d.quote("mtime") + ", " + d.quote("mode") + ", " +
+		d.quote("chunk_count") + ", " + d.quote("hash") + ", " + d.quote("content_type") + " from " + mt
+
+	stmts := &sqlStatements{
+		insert:     "insert into " + t + "(" + strings.Join(chunkColumns, ", ") + ") values(" + strings.Join(chunkValues, ", ") + ")",
+		insertData: "insert into " + t + "(" + strings.Join(chunkColumns, ", ") + ") values(" + strings.Join(dataValues, ", ") + ")",
+
+		readByUUID:       "select " + allColumns + " from " + t + where(uuid+" = ?") + " order by " + seq,
+		readDataByID:     readData(t),
+		readChunksByUUID: "select " + id + ", " + seq + ", " + chunkSize + " from " + t + where(uuid+" = ?") + " order by " + seq,
+		readFirst:        "select " + allColumns + " from " + t + where("") + " order by " + id + d.limit(1),
+		rename:           "update " + t + " set " + uuid + " = ?" + where(uuid+" = ?"),
+		deleteByUUID:     "delete from " + t + where(uuid+" = ?"),
+		deleteByID:       "delete from " + t + " where " + id + " = ?",
+		listFiles:        listSelect + where(noSubdir) + " group by " + uuid,
+		listFilesPrefix:  listSelect + where(d.prefixCondition(uuid)+" and "+noSubdir) + " group by " + uuid,
+		listDirs:         "select " + uuid + " from " + t + where(inSubdir) + d.byteOrder(uuid) + d.limit(1),
+		listDirsFrom:     "select " + uuid + " from " + t + where(d.fromCondition(uuid)+" and "+inSubdir) + d.byteOrder(uuid) + d.limit(1),
+		listDirsPrefix:   "select " + uuid + " from " + t + where(d.prefixCondition(uuid)+" and "+inSubdir) + d.byteOrder(uuid) + d.limit(1),
+		existPrefix:      "select " + uuid + " from " + t + where(d.prefixCondition(uuid)) + " order by " + uuid + d.limit(1),
+		stat:             listSelect + where(uuid+" = ?") + " group by " + uuid,
+		exist:            "select 1 from " + t + where(uuid+" = ?"),
+
+		metaUpsert:          d.upsert(mt, metaColumns, metaValues, []string{uuid}),
+		metaInsert:          "insert into " + mt + "(" + strings.Join(metaColumns, ", ") + ") values(" + strings.Join(metaValues, ", ") + ")",
+		metaDelete:          "delete from " + mt + " where " + uuid + " = ?",
+		metaRename:          "update " + mt + " set " + uuid + " = ? where " + uuid + " = ?",
+		metaList:            metaSelect,
+		metaListFiles:       metaSelect + " where " + noSubdir,
+		metaListFilesPrefix: metaSelect + " where " + d.prefixCondition(uuid) + " and " + noSubdir,
+		metaListDirs:        "select " + uuid + " from " + mt + " where " + inSubdir + d.byteOrder(uuid) + d.limit(1),
+		metaListDirsFrom:    "select " + uuid + " from " + mt + " where " + d.fromCondition(uuid) + " and " + inSubdir + d.byteOrder(uuid) + d.limit(1),
+		metaListDirsPrefix:  "select " + uuid + " from " + mt + " where " + d.prefixCondition(uuid) + " and " + inSubdir + d.byteOrder(uuid) + d.limit(1),
+		metaExistPrefix:     "select " + uuid + " from " + mt + " where " + d.prefixCondition(uuid) + " order by " + uuid + d.limit(1),
+		metaStat:            metaSelect + " where " + uuid + " = ?",
+		metaClear:           "delete from " + mt,
+		metaRebuild:         metaRebuild + where("") + " group by " + uuid,
+		metaRebuildOne:      metaRebuild + where(uuid+" = ?") + " group by " + uuid,
+
+		verMax: "select max(" + version + ") from " + vt + " where " + uuid + " = ?",
+		verArchive: "insert into " + vt + "(" + uuid + ", " + version + ", " + chunkCopy + ", " + created + ", " + archived + ")" +
+			" select " + uuid + ", " + d.castInt("?") + ", " + chunkCopy + ", " + created + ", " + d.now() +
+			" from " + t + where(uuid+" = ?"),
+		verList: "select " + version + ", sum(" + chunkSize + "), max(" + created + "), max(" + archived + ") from " + vt +
+			" where " + uuid + " = ? group by " + version + " order by " + version,
+		verChunks:   "select " + id + ", " + seq + ", " + chunkSize + " from " + vt + " where " + uuid + " = ? and " + version + " = ? order by " + seq,
+		verReadData: readData(vt),
+		verRestore: "insert into " + t + "(" + uuid + ", " + chunkCopy + ", " + created + extraCopy + ")" +
+			" select " + uuid + ", " + chunkCopy + ", " + d.now() + extraSelect +
+			" from " + vt + " where " + uuid + " = ? and " + version + " = ?",
+		verDeleteTo: "delete from " + vt + " where " + uuid + " = ? and " + version + " <= ?",
+		verPruneAge: "delete from " + vt + " where " + uuid + " = ? and " + archived + " < " + d.ago(),
+		verPruneAll: "delete from " + vt + " where " + archived + " < " + d.ago(),
+		verUUIDs:    "select distinct " + uuid + " from " + vt,
+
+		gcExpired: gcSelect + where("") + gcExpiredHaving,
+		// 文件的最后一块的 partitioning_count 是 DataNone, 只有 DataStart 和 DataEnd 的块的文件没有写完
+		gcIncomplete:       gcSelect + where("") + gcIncompleteHaving,
+		gcOldest:           gcSelect + where("") + gcOldestOrder,
+		gcExpiredPrefix:    gcSelect + where(d.prefixCondition(uuid)) + gcExpiredHaving,
+		gcIncompletePrefix: gcSelect + where(d.prefixCondition(uuid)) + gcIncompleteHaving,
+		gcOldestPrefix:     gcSelect + where(d.prefixCondition(uuid)) + gcOldestOrder,
+		totalSize:          "select sum(" + chunkSize + ") from " + t + where(""),
+
+		usage:       usageSelect + where(""),
+		usagePrefix: usageSelect + where(d.prefixCondition(uuid)),
+
+		fsckScan:       fsckSelect + where("") + " order by " + uuid + ", " + seq,
+		fsckScanPrefix: fsckSelect + where(d.prefixCondition(uuid)) + " order by " + uuid + ", " + seq,
+
+		rekeySelect:    "select " + id + ", " + data + ", " + encoding + ", " + keyID + ", " + uuid + ", " + seq + " from " + t + where(data+" is not null and ("+keyID+" is null or "+keyID+" <> ?)") + " order by " + id,
+		rekeyUpdate:    "update " + t + " set " + data + " = ?, " + keyID + " = ? where " + id + " = ?",
+		verRekeySelect: "select " + id + ", " + data + ", " + encoding + ", " + keyID + ", " + uuid + ", " + seq + " from " + vt + " where " + data + " is not null and (" + keyID + " is null or " + keyID + " <> ?) order by " + id,
+		verRekeyUpdate: "update " + vt + " set " + data + " = ?, " + keyID + " = ? where " + id + " = ?",
+		resealChunks:   "select " + id + ", " + seq + ", " + keyID + " from " + t + where(uuid+" = ? and "+data+" is not null and "+keyID+" is not null") + " order by " + seq,
+		resealRead:     "select " + data + ", " + encoding + " from " + t + " where " + id + " = ?",
+
+		blobRetain: "update " + bt + " set " + refcount + " = " + refcount + " + 1 where " + hash + " = ?",
+		// 其它的连接可能同时写入了相同的数据，所以在 hash 冲突时只增加引用计数。
+		// 不能在重复键的错误后重试，postgres 中出错后事务就不能再使用了
+		blobInsert: d.upsertCounter(bt, []string{hash, data, dataSize, encoding, keyID, refcount, created},
+			[]string{"?", "?", "?", "?", "?", "1", d.now()}, []string{hash}, refcount),
+		blobRelease:       adjustRefs("-", t, uuid+" = ?"+scope),
+		blobRetainFile:    adjustRefs("+", t, uuid+" = ?"+scope),
+		verBlobRetain:     adjustRefs("+", vt, uuid+" = ? and "+version+" = ?"),
+		verBlobReleaseTo:  adjustRefs("-", vt, uuid+" = ? and "+version+" <= ?"),
+		verBlobReleaseAge: adjustRefs("-", vt, uuid+" = ? and "+archived+" < "+d.ago()),
+		verBlobReleaseAll: adjustRefs("-", vt, archived+" < "+d.ago()),
+		blobUnused:        "select " + id + " from " + bt + " where " + refcount + " <= 0 order by " + id,
+		blobDelete:        "delete from " + bt + " where " + id + " = ? and " + refcount + " <= 0",
+		blobRecount: "update " + bt + " set " + refcount + " = " +
+			"(select count(*) from " + t + " where " + t + "." + blobHash + " = " + bt + "." + hash + ") + " +
+			"(select count(*) from " + vt + " where " + vt + "." + blobHash + " = " + bt + "." + hash + ")",
+		blobRekeySelect: "select " + id + ", " + data + ", " + encoding + ", " + keyID + ", " + hash + ", 0 from " + bt + " where " + keyID + " is null or " + keyID + " <> ? order by " + id,
+		blobRekeyUpdate: "update " + bt + " set " + data + " = ?, " + keyID + " = ? where " + id + " = ?",
+
+		copyFile: "insert into " + t + "(" + uuid + ", " + chunkCopy + ", " + created + extraCopy + ")" +
+			" select ?, " + count + ", " + seq + ", " + data + ", " + chunkSize + ", " + encoding + ", " + keyID + ", " + blobHash + ", " + d.now() + extraSelect +
+			" from " + t + where(uuid+" = ?"),
+		metaCopy: "insert into " + mt + "(" + strings.Join(metaColumns, ", ") + ")" +
+			" select ?, " + strings.Join(metaColumns[1:len(metaColumns)-1], ", ") + ", " + d.now() + " from " + mt + " where " + uuid + " = ?",
+
+		claimSelect:       listSelect + where("") + claimHaving,
+		claimSelectPrefix: listSelect + where(d.prefixCondition(uuid)) + claimHaving,
+		claim: "update " + t + " set " + claimedBy + " = ?, " + claimedAt + " = " + d.now() +
+			where(uuid+" = ? and ("+claimedBy+" is null or "+claimedAt+" < "+d.ago()+")"),
+		claimTouch:   "update " + t + " set " + claimedAt + " = " + d.now() + where(uuid+" = ? and "+claimedBy+" = ?"),
+		claimRelease: "update " + t + " set " + claimedBy + " = NULL, " + claimedAt + " = NULL" + where(uuid+" = ? and "+claimedBy+" = ?"),
+
+		changeInsert: "insert into " + ct + "(" + uuid + ", " + op + ", " + created + ") values(?, ?, " + d.now() + ")",
+		changeList:   "select " + id + ", " + uuid + ", " + op + ", " + created + " from " + ct + " where " + id + " > ? order by " + id,
+		changeListPrefix: "select " + id + ", " + uuid + ", " + op + ", " + created + " from " + ct +
+			" where " + id + " > ? and " + d.prefixCondition(uuid) + " order by " + id,
+		changeLast:        "select max(" + id + ") from " + ct,
+		changeGet:         "select " + id + ", " + uuid + ", " + op + ", " + created + " from " + ct + " where " + id + " in ",
+		changePrune:       "delete from " + ct + " where " + created + " < " + d.ago(),
+		changePrunePrefix: "delete from " + ct + " where " + d.prefixCondition(uuid) + " and " + created + " < " + d.ago(),
+	}
+
+	if d.name == DialectPostgres {
+		stmts.loCreate = "select lo_create(0)"
+		stmts.loPut = "select lo_put(?, ?, ?)"
+		stmts.loCopyPut = "select lo_put(?, ?, lo_get(?, ?, ?))"
+		stmts.loInsert = "insert into " + t + "(" + strings.Join(chunkColumns, ", ") + ", " + loOID + ") values(" + strings.Join(chunkValues, ", ") + ", ?)"
+		stmts.loFile = "select " + id + ", " + dataSize + ", " + loOID + " from " + t + where(uuid+" = ? and "+loOID+" is not null")
+		stmts.loRead = "select lo_get(" + loOID + ", ?, ?) from " + t + " where " + id + " = ?"
+		stmts.loSet = "update " + t + " set " + loOID + " = ?" + where(uuid+" = ?")
+		stmts.loUnlink = "select lo_unlink(" + loOID + ") from " + t + where(uuid+" = ? and "+loOID+" is not null")
+	}
+	if stmts.blobInsert == "" {
+		stmts.blobInsert = "insert into " + bt + "(" + hash + ", " + data + ", " + dataSize + ", " + encoding + ", " + keyID + ", " + refcount + ", " + created + ")" +
+			" values(?, ?, ?, ?, ?, 1, " + d.now() + ")"
+	}
+	return stmts
+}
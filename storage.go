@@ -0,0 +1,212 @@
+package scopy
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+)
+
+// 默认情况下文件按 maxSize 分成多行保存在文件表中，DBOptions.Storage 可以选择其它的保存方式:
+// StorageAdaptive 在写入前查询数据库的包大小限制 (mysql 的 max_allowed_packet), 块的大小不会超过它和 maxSize,
+// 一次写入的大块也会被拆开; StorageLargeObject 将 postgres 中的文件保存为一个大对象, 文件表中只有一行记录它的 oid,
+// 写入和读取都是按块流式进行的。
+// 一个表中的文件可以用不同的方式保存，但是启用 StorageLargeObject 后不要再关闭它，否则删除文件时不会删除大对象
+
+const (
+	StorageRows        = ""
+	StorageAdaptive    = "adaptive"
+	StorageLargeObject = "large_object"
+)
+
+// packetOverhead 是包中除了块的数据之外的部分的预留大小, 驱动在客户端拼接参数时二进制数据会被转义,
+// 所以块的大小只取剩余部分的一半
+const packetOverhead = 64 * 1024
+
+// minChunkSize 是 StorageAdaptive 的最小块大小
+const minChunkSize = 1024
+
+var ErrLargeObjectUnsupported = errors.New("scopy: large object storage is only supported by postgres with database/sql")
+
+func parseStorage(s string) (string, error) {
+	switch s {
+	case "", "rows":
+		return StorageRows, nil
+	case StorageAdaptive, StorageLargeObject:
+		return s, nil
+	}
+	return "", errors.New("scopy: storage '" + s + "' is unsupported")
+}
+
+// checkStorage 检查保存方式和其它选项是否兼容
+func checkStorage(d *dialect, opts DBOptions) error {
+	if opts.Storage != StorageLargeObject {
+		return nil
+	}
+	if d.name != DialectPostgres {
+		return ErrLargeObjectUnsupported
+	}
+	// 大对象没有块，不能保存历史版本、去重、压缩和加密
+	if opts.Versioned || opts.Dedup || opts.Compression != "" || opts.Keys != nil {
+		return errors.New("scopy: large object storage can not be used with Versioned, Dedup, Compression or Keys")
+	}
+	return nil
+}
+
+// packetLimit 返回查询数据库的包大小限制的语句，没有限制时返回空字符串
+func (d *dialect) packetLimit() string {
+	if d.name == DialectMySQL {
+		return "select @@max_allowed_packet"
+	}
+	return ""
+}
+
+// adaptiveChunkSize 返回不会超过包大小限制 packet 的块大小，packet 为 0 时没有限制
+func adaptiveChunkSize(packet int64, maxSize int) int {
+	if packet <= 0 {
+		return maxSize
+	}
+	size := (packet - packetOverhead) / 2
+	if size < minChunkSize {
+		size = minChunkSize
+	}
+	if size < int64(maxSize) {
+		return int(size)
+	}
+	return maxSize
+}
+
+// chunkLimit 返回写入时块大小的上限，为 0 时没有上限。 每次写入前都会查询，所以修改数据库的设置后不需要重新打开
+func chunkLimit(e execer, d *dialect, opts DBOptions, maxSize int) (int, error) {
+	if opts.Storage != StorageAdaptive {
+		return 0, nil
+	}
+	var packet sql.NullInt64
+	if query := d.packetLimit(); query != "" {
+		err := e.query(query, nil, func(scan func(dest ...interface{}) error) error {
+			return scan(&packet)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return adaptiveChunkSize(packet.Int64, maxSize), nil
+}
+
+// splitChunks 按 limit 写出 data 中的块，返回最后不超过 limit 的部分，limit 为 0 时不拆分
+func splitChunks(data []byte, limit int, write func(last bool, data []byte) error) ([]byte, error) {
+	if limit <= 0 {
+		return data, nil
+	}
+	for len(data) > limit {
+		if err := write(false, data[:limit]); err != nil {
+			return data, err
+		}
+		data = data[limit:]
+	}
+	return data, nil
+}
+
+// largeObject 是正在写的大对象
+type largeObject struct {
+	oid  int64
+	size int64
+}
+
+// writeLargeObject 将 data 追加到大对象中，写第一块之前删除文件原来的大对象，写完最后一块后再写入文件表中的行
+func writeLargeObject(e execer, stmts *sqlStatements, lo *largeObject, uuid string, first, last bool, data []byte) error {
+	if first {
+		if _, err := e.exec(stmts.loUnlink, uuid); err != nil {
+			return err
+		}
+		err := e.query(stmts.loCreate, nil, func(scan func(dest ...interface{}) error) error {
+			return scan(&lo.oid)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		if _, err := e.exec(stmts.loPut, lo.oid, lo.size, data); err != nil {
+			return err
+		}
+		lo.size += int64(len(data))
+	}
+	if !last {
+		return nil
+	}
+
+	// 删除文件原来的行 (包括按行保存的块) 后再插入新的行
+	if _, err := e.exec(stmts.deleteByUUID, uuid); err != nil {
+		return err
+	}
+	_, err := e.exec(stmts.loInsert, uuid, DataNone, 0, nil, lo.size, EncodingNone, "", nil, lo.oid)
+	return err
+}
+
+// statLargeObject 返回文件的行的 id、大小和大对象的 oid, 文件不是大对象时 found 为 false
+func statLargeObject(e execer, stmts *sqlStatements, uuid string) (id, size, oid int64, found bool, err error) {
+	err = e.query(stmts.loFile, []interface{}{uuid}, func(scan func(dest ...interface{}) error) error {
+		var dataSize sql.NullInt64
+		found = true
+		if err := scan(&id, &dataSize, &oid); err != nil {
+			return err
+		}
+		size = dataSize.Int64
+		return nil
+	})
+	return id, size, oid, found, err
+}
+
+// copyLargeObject 在数据库中复制文件的大对象, 必须在复制了文件表中的行之后调用
+func copyLargeObject(e execer, stmts *sqlStatements, from, to string) error {
+	_, size, src, found, err := statLargeObject(e, stmts, from)
+	if err != nil || !found {
+		return err
+	}
+	var dst int64
+	err = e.query(stmts.loCreate, nil, func(scan func(dest ...interface{}) error) error {
+		return scan(&dst)
+	})
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < size; off += DefaultMaxSize {
+		n := size - off
+		if n > DefaultMaxSize {
+			n = DefaultMaxSize
+		}
+		if _, err := e.exec(stmts.loCopyPut, dst, off, src, off, n); err != nil {
+			return err
+		}
+	}
+	_, err = e.exec(stmts.loSet, dst, to)
+	return err
+}
+
+// openLargeObject 按 maxSize 将大对象分成多块读取，文件不是大对象时返回 nil
+func (st *dbTarget) openLargeObject(uuid string) (*chunkReader, error) {
+	id, size, _, found, err := statLargeObject(st.execer(), st.stmts, uuid)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	piece := int64(st.maxSize)
+	var sizes []int64
+	for off := int64(0); off < size; off += piece {
+		if size-off < piece {
+			sizes = append(sizes, size-off)
+		} else {
+			sizes = append(sizes, piece)
+		}
+	}
+	conn, readAhead := st.readConn()
+	return newChunkReader(sizes, readAhead, func(idx int) ([]byte, error) {
+		var data []byte
+		err := conn.QueryRow(st.dialect.rebind(st.stmts.loRead), int64(idx)*piece, sizes[idx], id).Scan(&data)
+		if err == sql.ErrNoRows {
+			// 读的过程中文件被删除或覆盖了
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data, err
+	}), nil
+}
@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xo/dburl"
 )
@@ -16,6 +17,11 @@ func Open2(urlstr, username, password string) (Session, error) {
 		return nil, err
 	}
 	if dir != "" {
+		if u, err := url.Parse(urlstr); err == nil {
+			if mode, err := ParseConfineMode(u.Query().Get("sc_confine")); err == nil && mode != ConfineNone {
+				return ChangedirConfined(sess, dir, mode), nil
+			}
+		}
 		return Changedir(sess, dir), nil
 	}
 	return sess, nil
@@ -37,13 +43,28 @@ func Open(urlstr, username, password string) (Session, string, error) {
 		u.RawQuery = ""
 
 		dbname := queryParams.Get("sc_dbname")
-		dbTable := queryParams.Get("sc_dbtable")
 		maxSize, _ := strconv.Atoi(queryParams.Get("sc_max_size"))
-		enableSavepoint := strings.ToLower(queryParams.Get("sc_max_size")) == "true"
-		sess, err = DBHTTP(u.String(), dbname, username, password, dbTable, maxSize, enableSavepoint)
+		// 以前的版本从 sc_max_size 中读取这个开关 (sc_max_size=true), 为了兼容已有的 url 两个都接受
+		enableSavepoint := strings.ToLower(queryParams.Get("sc_savepoint")) == "true" ||
+			strings.ToLower(queryParams.Get("sc_max_size")) == "true"
+		mapping, err := parseTableMapping(queryParams)
+		if err != nil {
+			return nil, "", err
+		}
+		opts, err := parseDBOptions(queryParams)
+		if err != nil {
+			return nil, "", err
+		}
+		target, err := DBHTTPWithMapping(u.String(), dbname, username, password, mapping, maxSize, enableSavepoint)
 		if err != nil {
 			return nil, "", errWrap(err, "连接失败")
 		}
+		target.SetDialect(queryParams.Get("sc_dbdriver"))
+		if err := target.SetOptions(opts); err != nil {
+			target.Close()
+			return nil, "", err
+		}
+		sess = target
 	} else if strings.HasPrefix(urlstr, "db+") {
 		urlstr = strings.TrimPrefix(urlstr, "db+")
 
@@ -53,10 +74,16 @@ func Open(urlstr, username, password string) (Session, string, error) {
 		}
 		v.User = url.UserPassword(username, password)
 		queryParams := v.Query()
-		dbTable := queryParams.Get("sc_dbtable")
 		maxSize, _ := strconv.Atoi(queryParams.Get("sc_max_size"))
-		queryParams.Del("sc_dbtable")
 		queryParams.Del("sc_max_size")
+		mapping, err := parseTableMapping(queryParams)
+		if err != nil {
+			return nil, "", err
+		}
+		opts, err := parseDBOptions(queryParams)
+		if err != nil {
+			return nil, "", err
+		}
 		v.RawQuery = queryParams.Encode()
 
 		u, err := dburl.Parse(v.String())
@@ -64,10 +91,15 @@ func Open(urlstr, username, password string) (Session, string, error) {
 			return nil, "", err
 		}
 
-		sess, err = DB(u.Driver, u.DSN, dbTable, maxSize)
+		target, err := DBWithMapping(u.Driver, u.DSN, mapping, maxSize)
 		if err != nil {
 			return nil, "", errWrap(err, "连接失败")
 		}
+		if err := target.SetOptions(opts); err != nil {
+			target.Close()
+			return nil, "", err
+		}
+		sess = target
 	} else {
 		u, err := url.Parse(urlstr)
 		if err != nil {
@@ -80,14 +112,46 @@ func Open(urlstr, username, password string) (Session, string, error) {
 			if runtime.GOOS == "windows" {
 				dir = strings.TrimPrefix(dir, "/")
 			}
-			sess = OS(dir)
+			mode, err := ParseConfineMode(u.Query().Get("sc_confine"))
+			if err != nil {
+				return nil, "", err
+			}
+			sess = OSConfined(dir, mode)
 		case "ftp":
 			epsv := u.Query().Get("epsv")
 			disableEPSV := epsv == "false"
 			sess, err = FTP(u.Host, username, password, u.Path, disableEPSV)
 		case "sftp", "ssh":
 			remoteDir = u.Path
-			sess, err = SFTPWithPassword(u.Host, username, password)
+			sess, err = SSHWithPassword(u.Host, username, password)
+		case "scp":
+			remoteDir = u.Path
+			sess, err = SCPWithPassword(u.Host, username, password)
+		case "mem":
+			var opts MemOptions
+			queryParams := u.Query()
+			opts.FailWriteN, _ = strconv.Atoi(queryParams.Get("sc_fail_write"))
+			opts.TruncateRead, _ = strconv.ParseInt(queryParams.Get("sc_truncate_read"), 10, 64)
+			if s := queryParams.Get("sc_latency"); s != "" {
+				opts.Latency, err = time.ParseDuration(s)
+				if err != nil {
+					return nil, "", errWrap(err, "解析 sc_latency 失败")
+				}
+			}
+			remoteDir = strings.Trim(u.Path, "/")
+			sess = MemWithOptions(u.Host, opts)
+		case "zip", "tar":
+			// zip://backups/a.zip 中的 backups 被解析为 host, 它是相对路径的一部分
+			filename := u.Host + u.Path
+			if runtime.GOOS == "windows" {
+				filename = strings.TrimPrefix(filename, "/")
+			}
+			write := ArchiveWriteMode(filename, u.Query().Get("sc_mode"))
+			if u.Scheme == "zip" {
+				sess, err = Zip(filename, write)
+			} else {
+				sess, err = Tar(filename, write)
+			}
 		default:
 			return nil, "", errors.New("目录不支持 - '"+urlstr+"'")
 		}
@@ -0,0 +1,309 @@
+package scopy
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// 启用 DBOptions.Versioned 后，覆盖或删除文件前会将当前的块复制到 "<表名>_versions" 表中,
+// 复制是用 insert ... select 在数据库中完成的，不需要将数据读到本地。
+// 每个文件的版本号从 1 开始递增，当前的内容的版本号是最大的历史版本号加 1
+
+// FileVersion 是文件的一个版本
+type FileVersion struct {
+	Version    int
+	Size       int64
+	ModTime    time.Time
+	ArchivedAt time.Time // 当前版本为零值
+	Current    bool
+}
+
+// versionTable 返回文件表对应的历史版本表的表名
+func versionTable(table string) string {
+	return table + "_versions"
+}
+
+func maxVersion(e execer, stmts *sqlStatements, uuid string) (int, error) {
+	var version sql.NullInt64
+	err := e.query(stmts.verMax, []interface{}{uuid}, func(scan func(dest ...interface{}) error) error {
+		return scan(&version)
+	})
+	return int(version.Int64), err
+}
+
+// archiveVersion 将文件当前的块保存为一个新的版本, 文件不存在时什么也不做
+func archiveVersion(e execer, stmts *sqlStatements, opts DBOptions, uuid string) error {
+	version, err := maxVersion(e, stmts, uuid)
+	if err != nil {
+		return err
+	}
+	if _, err = e.exec(stmts.verArchive, version+1, uuid); err != nil {
+		return err
+	}
+	if opts.Dedup {
+		return adjustRefs(e, stmts.verBlobRetain, uuid, version+1)
+	}
+	return nil
+}
+
+func listVersions(e execer, stmts *sqlStatements, uuid string) ([]FileVersion, error) {
+	var versions []FileVersion
+	err := e.query(stmts.verList, []interface{}{uuid}, func(scan func(dest ...interface{}) error) error {
+		var version int
+		var size sql.NullInt64
+		var created, archived nullTime
+		if err := scan(&version, &size, &created, &archived); err != nil {
+			return err
+		}
+		versions = append(versions, FileVersion{
+			Version:    version,
+			Size:       size.Int64,
+			ModTime:    created.Time,
+			ArchivedAt: archived.Time,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := statFile(e, stmts, false, uuid)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	} else if !fi.IsDir() {
+		current := FileVersion{
+			Version: 1,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Current: true,
+		}
+		if len(versions) > 0 {
+			current.Version = versions[len(versions)-1].Version + 1
+		}
+		versions = append(versions, current)
+	}
+
+	if len(versions) == 0 {
+		return nil, &fs.PathError{Op: "versions", Path: uuid, Err: os.ErrNotExist}
+	}
+	return versions, nil
+}
+
+// restoreVersion 用历史版本替换文件当前的内容, 替换前当前的内容也会被保存为一个版本
+func restoreVersion(e execer, stmts *sqlStatements, opts DBOptions, uuid string, version int) error {
+	if _, _, err := scanChunks(e, stmts.verChunks, []interface{}{uuid, version}, uuid); err != nil {
+		return err
+	}
+	if opts.Versioned {
+		if err := archiveVersion(e, stmts, opts, uuid); err != nil {
+			return err
+		}
+	}
+	if err := clearFile(e, stmts, opts, uuid); err != nil {
+		return err
+	}
+	if _, err := e.exec(stmts.verRestore, uuid, version); err != nil {
+		return err
+	}
+	if opts.Dedup {
+		if err := adjustRefs(e, stmts.blobRetainFile, uuid); err != nil {
+			return err
+		}
+	}
+	if opts.Metadata {
+		if _, err := e.exec(stmts.metaDelete, uuid); err != nil {
+			return err
+		}
+		if _, err := e.exec(stmts.metaRebuildOne, uuid); err != nil {
+			return err
+		}
+	}
+	return logChange(e, stmts, opts, ChangeWrite, uuid)
+}
+
+// pruneVersions 删除历史版本，keep 大于 0 时每个文件只保留最新的 keep 个历史版本,
+// before 不是零值时删除在它之前保存的版本。uuid 为空时处理所有的文件。
+// 保存版本的时间是数据库的时间，所以 before 被换算为距现在的时间后在数据库中比较
+func pruneVersions(e execer, stmts *sqlStatements, d *dialect, opts DBOptions, uuid string, keep int, before time.Time) (int64, error) {
+	var total int64
+	if uuid == "" && opts.Namespace != "" {
+		// 命名空间中只处理它自己的文件
+		var uuids []string
+		err := e.query(stmts.verUUIDs, nil, func(scan func(dest ...interface{}) error) error {
+			var s string
+			if err := scan(&s); err != nil {
+				return err
+			}
+			if strings.HasPrefix(s, opts.namespacePrefix()) {
+				uuids = append(uuids, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		for _, s := range uuids {
+			count, err := pruneVersions(e, stmts, d, opts, s, keep, before)
+			total += count
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	}
+	if !before.IsZero() {
+		age := d.agoValue(time.Since(before))
+		query, release, args := stmts.verPruneAge, stmts.verBlobReleaseAge, []interface{}{uuid, age}
+		if uuid == "" {
+			query, release, args = stmts.verPruneAll, stmts.verBlobReleaseAll, []interface{}{age}
+		}
+		if opts.Dedup {
+			if err := adjustRefs(e, release, args...); err != nil {
+				return total, err
+			}
+		}
+		count, err := e.exec(query, args...)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	if keep <= 0 {
+		return total, nil
+	}
+
+	uuids := []string{uuid}
+	if uuid == "" {
+		uuids = nil
+		err := e.query(stmts.verUUIDs, nil, func(scan func(dest ...interface{}) error) error {
+			var s string
+			if err := scan(&s); err != nil {
+				return err
+			}
+			uuids = append(uuids, s)
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+
+	for _, s := range uuids {
+		// 版本号是连续的，只会从最旧的版本开始删除
+		version, err := maxVersion(e, stmts, s)
+		if err != nil {
+			return total, err
+		}
+		if version <= keep {
+			continue
+		}
+		if opts.Dedup {
+			if err := adjustRefs(e, stmts.verBlobReleaseTo, s, version-keep); err != nil {
+				return total, err
+			}
+		}
+		count, err := e.exec(stmts.verDeleteTo, s, version-keep)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// ListVersions 返回文件的所有版本，按版本号排序，最后一个是当前的版本
+func (st *dbTarget) ListVersions(remotePath string) ([]FileVersion, error) {
+	return listVersions(st.execer(), st.stmts, st.opts.key(remotePath))
+}
+
+// ReadVersion 读取文件的一个版本
+func (st *dbTarget) ReadVersion(remotePath string, version int) (io.ReadCloser, error) {
+	e := st.execer()
+	key := st.opts.key(remotePath)
+	ids, sizes, err := scanChunks(e, st.stmts.verChunks, []interface{}{key, version}, remotePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		max, e2 := maxVersion(e, st.stmts, key)
+		if e2 != nil {
+			return nil, e2
+		}
+		if version != max+1 {
+			return nil, err
+		}
+		return st.Read(remotePath)
+	}
+	return st.openChunks(st.stmts.verReadData, ids, sizes), nil
+}
+
+// RestoreVersion 将文件恢复到一个历史版本
+func (st *dbTarget) RestoreVersion(remotePath string, version int) error {
+	return st.inTx(func(e execer) error {
+		return restoreVersion(e, st.stmts, st.opts, st.opts.key(remotePath), version)
+	})
+}
+
+// PruneVersions 删除历史版本，keep 大于 0 时每个文件只保留最新的 keep 个历史版本,
+// before 不是零值时删除在它之前保存的版本。remotePath 为空时处理所有的文件, 返回删除的块数
+func (st *dbTarget) PruneVersions(remotePath string, keep int, before time.Time) (int64, error) {
+	if remotePath != "" {
+		remotePath = st.opts.key(remotePath)
+	}
+	var count int64
+	err := st.inTx(func(e execer) error {
+		var err error
+		count, err = pruneVersions(e, st.stmts, st.dialect, st.opts, remotePath, keep, before)
+		return err
+	})
+	return count, err
+}
+
+// ListVersions 返回文件的所有版本，按版本号排序，最后一个是当前的版本
+func (st *sqlhttpTarget) ListVersions(remotePath string) ([]FileVersion, error) {
+	return listVersions(st.execer(), st.stmts, st.opts.key(remotePath))
+}
+
+// ReadVersion 读取文件的一个版本
+func (st *sqlhttpTarget) ReadVersion(remotePath string, version int) (io.ReadCloser, error) {
+	e := st.execer()
+	key := st.opts.key(remotePath)
+	ids, sizes, err := scanChunks(e, st.stmts.verChunks, []interface{}{key, version}, remotePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		max, e2 := maxVersion(e, st.stmts, key)
+		if e2 != nil {
+			return nil, e2
+		}
+		if version != max+1 {
+			return nil, err
+		}
+		return st.Read(remotePath)
+	}
+	return st.openChunks(st.stmts.verReadData, ids, sizes), nil
+}
+
+// RestoreVersion 将文件恢复到一个历史版本
+func (st *sqlhttpTarget) RestoreVersion(remotePath string, version int) error {
+	return st.inTx(func(e execer) error {
+		return restoreVersion(e, st.stmts, st.opts, st.opts.key(remotePath), version)
+	})
+}
+
+// PruneVersions 删除历史版本，keep 大于 0 时每个文件只保留最新的 keep 个历史版本,
+// before 不是零值时删除在它之前保存的版本。remotePath 为空时处理所有的文件, 返回删除的块数
+func (st *sqlhttpTarget) PruneVersions(remotePath string, keep int, before time.Time) (int64, error) {
+	if remotePath != "" {
+		remotePath = st.opts.key(remotePath)
+	}
+	return pruneVersions(st.execer(), st.stmts, st.dialect, st.opts, remotePath, keep, before)
+}